@@ -1,14 +1,19 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -16,56 +21,140 @@ type AOF struct {
 	File      *os.File
 	Fsync     string
 	LastIndex int
+	ID        string     // 第一行记录的标识，快照通过它判断与 aof 文件是否对应
+	BaseSize  int64      // 启动时或者上次重写后的大小，用于计算自动重写的增长比例
+	Created   bool       // 启动时新建的文件，此时数据只能从快照加载
+	Loading   bool       // 重放期间产生的删除等不需要再次写入
+	Lock      sync.Mutex // 各个连接与时间轮都会追加写入，重写时也需要替换文件
+	// 重写相关，同一时间只能有一个重写
+	Rewriting         bool
+	RewriteBuff       *bytes.Buffer // 重写期间的写入同时记录一份，追加到新文件的快照之后
+	RewriteStart      time.Time
+	LastRewriteTime   time.Duration
+	LastRewriteStatus bool
+	RewriteScheduled  bool  // 重写期间又需要重写，当前的结束后由定时任务开始
+	Repl              *Repl // 写入同时作为复制流发送给从节点
 }
 
 var (
 	aofCmdSet = map[string]bool{ // 只记录对数据有修改的
-		CmdSet:     true,
-		CmdIncrBy:  true,
-		CmdSetNX:   true,
-		CmdSetEX:   true,
-		CmdZAdd:    true,
-		CmdZRem:    true,
-		CmdDel:     true,
-		CmdExpire:  true,
-		CmdPersist: true,
+		CmdSet:    true,
+		CmdIncrBy: true,
+		CmdSetNX:  true,
+		CmdSetEX:  true,
+		CmdZAdd:   true,
+		CmdZRem:   true,
+
+		CmdZPopMin: true,
+		CmdZPopMax: true,
+
+		CmdHSet:         true,
+		CmdHSetNX:       true,
+		CmdHDel:         true,
+		CmdHIncrBy:      true,
+		CmdHIncrByFloat: true,
+
+		CmdLPush:   true,
+		CmdRPush:   true,
+		CmdLPushX:  true,
+		CmdRPushX:  true,
+		CmdLPop:    true,
+		CmdRPop:    true,
+		CmdLSet:    true,
+		CmdLInsert: true,
+		CmdLRem:    true,
+		CmdLTrim:   true,
+		CmdLMove:   true,
+
+		CmdSAdd:        true,
+		CmdSRem:        true,
+		CmdSMove:       true,
+		CmdSInterStore: true,
+		CmdSUnionStore: true,
+		CmdSDiffStore:  true,
+
+		CmdDel:      true,
+		CmdExpire:   true,
+		CmdPersist:  true,
+		CmdFlushDB:  true,
+		CmdFlushAll: true, // 只会出现在事务中，事务之外记录为每个数据库的 flushdb
+
+		CmdAbsExpire: true, // 从节点执行复制流中的过期时间同样需要记录
 	}
 )
 
 func (a *AOF) WriteAOF(req *Req, index int) {
-	cmd := strings.ToUpper(req.Cmd)
-	if !aofCmdSet[cmd] {
+	if a.Loading {
 		return
 	}
-	if a.LastIndex != index { // 切换数据库
-		a.writeReq(a.File, &Req{
-			Cmd:  CmdSelect,
-			Args: []string{strconv.FormatInt(int64(index), 10)},
-		})
-		a.LastIndex = index
+	buff := &bytes.Buffer{}
+	if a.encode(buff, req) {
+		a.write(buff.Bytes(), index)
+	}
+}
+
+// WriteMulti 事务中的指令以 multi exec 包裹一次写入，重放时要么全部执行要么全部丢弃
+func (a *AOF) WriteMulti(body []byte, index int) {
+	if a.Loading || len(body) == 0 {
+		return
 	}
-	switch strings.ToUpper(req.Cmd) {
-	case CmdSetEX: // 相对超时时间需要修改为绝对的
-		a.writeReq(a.File, &Req{
+	buff := &bytes.Buffer{}
+	a.writeReq(buff, &Req{Cmd: CmdMulti})
+	buff.Write(body)
+	a.writeReq(buff, &Req{Cmd: CmdExec})
+	a.write(buff.Bytes(), index)
+}
+
+// encode 只记录对数据有修改的指令，相对超时时间需要修改为绝对的
+func (a *AOF) encode(buff *bytes.Buffer, req *Req) bool {
+	switch cmd := strings.ToUpper(req.Cmd); {
+	case !aofCmdSet[cmd]:
+		return false
+	case cmd == CmdSetEX:
+		a.writeReq(buff, &Req{
 			Cmd:  CmdSet,
 			Args: req.Args[:2],
 		})
 		ttl, _ := strconv.ParseInt(req.Args[2], 10, 64)
-		a.writeReq(a.File, &Req{
+		a.writeReq(buff, &Req{
 			Cmd:  CmdAbsExpire,
 			Args: []string{req.Args[0], strconv.FormatInt(ttl+time.Now().Unix(), 10)},
 		})
-	case CmdExpire: // 相对超时时间需要修改为绝对的
+	case cmd == CmdExpire:
 		ttl, _ := strconv.ParseInt(req.Args[1], 10, 64)
-		a.writeReq(a.File, &Req{
+		a.writeReq(buff, &Req{
 			Cmd:  CmdAbsExpire,
 			Args: []string{req.Args[0], strconv.FormatInt(ttl+time.Now().Unix(), 10)},
 		})
 	default:
-		a.writeReq(a.File, req)
+		a.writeReq(buff, req)
+	}
+	return true
+}
+
+// write 一次写入文件，必要时先切换数据库
+func (a *AOF) write(bs []byte, index int) {
+	a.Lock.Lock()
+	defer a.Lock.Unlock()
+	if a.LastIndex != index { // 切换数据库
+		buff := &bytes.Buffer{}
+		a.writeReq(buff, &Req{
+			Cmd:  CmdSelect,
+			Args: []string{strconv.FormatInt(int64(index), 10)},
+		})
+		bs = append(buff.Bytes(), bs...)
+		a.LastIndex = index
+	}
+	_, err := a.File.Write(bs)
+	HandleErr(err)
+	if a.RewriteBuff != nil {
+		a.RewriteBuff.Write(bs)
+	}
+	if a.Repl != nil {
+		a.Repl.Feed(bs)
 	}
 	if a.Fsync == FsyncAlways { // 判断是不是每次都要刷盘
-		err := a.File.Sync()
+		err = a.File.Sync()
 		HandleErr(err)
 	}
 }
@@ -75,20 +164,118 @@ func (a *AOF) fsyncEverySec() {
 	for {
 		select {
 		case <-timeChan:
+			a.Lock.Lock()
 			err := a.File.Sync()
+			a.Lock.Unlock()
 			HandleErr(err)
 		}
 	}
 }
 
+func (a *AOF) writeHead(writer io.Writer, id string) {
+	a.writeReq(writer, &Req{
+		Cmd:  CmdAOFID,
+		Args: []string{id},
+	})
+}
+
+// Size 调用方需要持有锁或者处于启动阶段
+func (a *AOF) Size() int64 {
+	info, err := a.File.Stat()
+	HandleErr(err)
+	return info.Size()
+}
+
+// writeReq 每条记录为 json 空格 crc32 换行，一次写入，进程崩溃时只可能留下不完整的最后一条
 func (a *AOF) writeReq(writer io.Writer, req *Req) {
 	bs, err := json.Marshal(req)
 	HandleErr(err)
-	bs = append(bs, '\r', '\n')
+	bs = fmt.Appendf(bs, " %08x\r\n", crc32.ChecksumIEEE(bs))
 	_, err = writer.Write(bs)
 	HandleErr(err)
 }
 
+type AOFError struct {
+	Offset int64 // 损坏的记录在文件中的位置，之前的都是完整的
+	Err    error
+}
+
+func (e *AOFError) Error() string {
+	return fmt.Sprintf("bad aof record at offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *AOFError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	ErrAOFTruncated = errors.New("unexpected end of aof")
+	ErrAOFChecksum  = errors.New("aof checksum mismatch")
+	ErrAOFMulti     = errors.New("unpaired aof multi exec")
+)
+
+// readRecord 解析开头的一条记录并返回记录的长度，没有校验和的旧格式以 } 结尾同样支持
+func readRecord(bs []byte) (*Req, int, error) {
+	end := bytes.Index(bs, []byte("\r\n"))
+	if end < 0 {
+		return nil, 0, ErrAOFTruncated
+	}
+	line := bs[:end]
+	if len(line) > 0 && line[len(line)-1] != '}' {
+		idx := bytes.LastIndexByte(line, ' ')
+		if idx < 0 {
+			return nil, 0, ErrAOFChecksum
+		}
+		sum, err := strconv.ParseUint(string(line[idx+1:]), 16, 32)
+		if err != nil || uint32(sum) != crc32.ChecksumIEEE(line[:idx]) {
+			return nil, 0, ErrAOFChecksum
+		}
+		line = line[:idx]
+	}
+	req := &Req{}
+	if err := json.Unmarshal(line, req); err != nil {
+		return nil, 0, err
+	}
+	return req, end + 2, nil
+}
+
+// scanAOF 依次回调每条记录，遇到损坏的记录返回 AOFError，base 为 bs 在文件中的位置
+// 事务读取到 exec 后才一次回调，事务中的记录损坏或者结尾的事务不完整时整个事务都视为损坏
+func scanAOF(bs []byte, base int64, callback func(reqs []*Req)) error {
+	offset := 0
+	blockStart := -1 // 当前事务 multi 的位置
+	var block []*Req
+	for offset < len(bs) {
+		req, n, err := readRecord(bs[offset:])
+		if err == nil && ((req.Cmd == CmdMulti && blockStart >= 0) || (req.Cmd == CmdExec && blockStart < 0)) {
+			err = ErrAOFMulti
+		}
+		if err != nil {
+			if blockStart >= 0 {
+				offset = blockStart
+			}
+			return &AOFError{Offset: base + int64(offset), Err: err}
+		}
+		switch {
+		case req.Cmd == CmdMulti:
+			blockStart = offset
+			block = make([]*Req, 0)
+		case req.Cmd == CmdExec:
+			callback(block)
+			blockStart = -1
+		case blockStart >= 0:
+			block = append(block, req)
+		default:
+			callback([]*Req{req})
+		}
+		offset += n
+	}
+	if blockStart >= 0 {
+		return &AOFError{Offset: base + int64(blockStart), Err: ErrAOFTruncated}
+	}
+	return nil
+}
+
 type FakeConn struct {
 	*net.TCPConn
 }
@@ -99,89 +286,247 @@ func NewFakeConn() *FakeConn {
 
 func (f *FakeConn) Write(bs []byte) (n int, err error) {
 	Info("FakeConn Write %s", string(bs))
-	return 0, nil
+	return len(bs), nil
 }
 
-func (a *AOF) LoadAOF(handler *Handler, fileName string, size int64) {
+func (a *AOF) LoadAOF(handler *Handler, fileName string) {
 	if !FileExist(fileName) {
 		return
 	}
-	// 若是指定了大小只重放指定大小的
 	bs, err := os.ReadFile(fileName)
 	HandleErr(err)
-	if size > 0 {
-		bs = bs[:size]
-	}
-	lines := bytes.Split(bs, []byte("\r\n"))
-	// 使用虚假的 session 进行重放
+	err = a.replay(handler, bs, 0, NewSession(NewFakeConn()))
+	a.handleLoadErr(handler.Conf, err)
+}
+
+// LoadTail 加载快照后只需要重放快照之后追加的部分，index 为快照时 aof 最后选择的数据库
+func (a *AOF) LoadTail(handler *Handler, fileName string, offset int64, index int) {
+	bs, err := os.ReadFile(fileName)
+	HandleErr(err)
 	session := NewSession(NewFakeConn())
-	for _, line := range lines {
-		if len(line) == 0 {
-			continue
-		}
-		req := &Req{}
-		err = json.Unmarshal(line, req)
-		HandleErr(err)
-		handler.HandleDBCmd(req, session, false)
+	if index >= 0 {
+		session.DBIndex = index
 	}
+	err = a.replay(handler, bs[offset:], offset, session)
+	a.handleLoadErr(handler.Conf, err)
 }
 
-func (a *AOF) ReWrite(fileName string, conf *Conf) { // AOF 日志重写
-	file, err := os.Open(fileName)
-	if os.IsNotExist(err) {
-		return
+// replay 使用虚假的 session 进行重放，混合 aof 先加载开头的快照再重放之后的指令，base 为 bs 在文件中的位置
+func (a *AOF) replay(handler *Handler, bs []byte, base int64, session *Session) error {
+	if HasRDBHead(bs) {
+		decoder := NewRDBDecoder(bytes.NewReader(bs))
+		decoder.ReadHead()
+		handler.loadRDB(decoder)
+		bs = bs[decoder.Offset:]
+		base += decoder.Offset
 	}
-	HandleErr(err)
-	info, err := file.Stat()
-	HandleErr(err)
-	// 记录快照点该点之前的参与本次压缩，之后的正常存储
-	size := info.Size()
-	// 重放日志到临时内存
-	handler := NewHandler(conf)
-	a.LoadAOF(handler, fileName, size)
-	// 生成指令
-	lastIdx := -1
-	buff := &bytes.Buffer{} // idx 是顺序来的一般不会变化太大
-	handler.ForEach(func(idx int, key string, entry *Entry) {
-		if lastIdx != idx {
-			lastIdx = idx
-			a.writeReq(buff, &Req{
-				Cmd:  CmdSelect,
-				Args: []string{strconv.FormatInt(int64(idx), 10)},
-			})
+	handler.AOF.Loading = true
+	defer func() {
+		handler.AOF.Loading = false
+	}()
+	return scanAOF(bs, base, func(reqs []*Req) {
+		for _, req := range reqs {
+			if req.Cmd != CmdAOFID {
+				handler.HandleDBCmd(req, session, false)
+			}
 		}
-		a.writeEntry(buff, key, entry)
 	})
-	// 写入 aof 文件 并重新打开文件
-	_, err = file.Seek(size, 0)
-	HandleErr(err)
-	_, err = io.Copy(buff, file) // 先把剩余的与压缩后的放到一块，写入文件
-	HandleErr(err)
-	a.File.Close() // 写入文件
-	err = os.WriteFile(fileName, buff.Bytes(), 0777)
-	HandleErr(err) // 重新打开
-	a.File, err = os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
-	HandleErr(err)
 }
 
-func (a *AOF) writeEntry(buff *bytes.Buffer, key string, entry *Entry) {
-	switch entry.Type {
-	case TypeStr:
+// handleLoadErr 只有结尾不完整的记录可以截断后继续启动，中间的记录损坏需要使用 check-aof 修复
+func (a *AOF) handleLoadErr(conf *Conf, err error) {
+	if err == nil {
+		return
+	}
+	aofErr := &AOFError{}
+	if !errors.As(err, &aofErr) || !errors.Is(err, ErrAOFTruncated) || !conf.AOFLoadTruncated {
+		panic(fmt.Errorf("%w, use check-aof --fix to repair", err))
+	}
+	size := a.Size()
+	HandleErr(a.File.Truncate(aofErr.Offset))
+	a.BaseSize = aofErr.Offset
+	Warn("AOF loaded anyway because aof_load_truncated is enabled, %d bytes truncated at offset %d", size-aofErr.Offset, aofErr.Offset)
+}
+
+func (a *AOF) beginRewrite() error {
+	a.Lock.Lock()
+	defer a.Lock.Unlock()
+	if a.Rewriting {
+		return errors.New("Background append only file rewriting already in progress")
+	}
+	a.Rewriting = true
+	a.RewriteStart = time.Now()
+	return nil
+}
+
+// startRewriteBuff 调用方需要持有全部数据的锁，保证快照之后的写入都记录在重写缓冲中
+// 重写缓冲从 select 开始，替换文件后之前选择的数据库仍然有效
+func (a *AOF) startRewriteBuff() {
+	a.Lock.Lock()
+	defer a.Lock.Unlock()
+	a.RewriteBuff = &bytes.Buffer{}
+	a.LastIndex = -1
+}
+
+// ReWrite 快照先写入临时文件并刷盘，再在锁内追加重写缓冲，最后原子重命名替换 aof 文件
+// 任意一步失败都不会影响原来的文件
+func (a *AOF) ReWrite(fileName string, bs []byte, id string) (err error) {
+	tempName := fmt.Sprintf("%s.rewrite-%d", fileName, os.Getpid())
+	defer func() {
+		a.Lock.Lock()
+		a.Rewriting = false
+		a.RewriteBuff = nil
+		a.LastRewriteTime = time.Since(a.RewriteStart)
+		a.LastRewriteStatus = err == nil
+		a.Lock.Unlock()
+		if err != nil {
+			_ = os.Remove(tempName)
+			Error("Rewrite AOF %s err %v", fileName, err)
+		} else {
+			Info("Background AOF rewrite finished successfully")
+		}
+	}()
+	file, err := os.OpenFile(tempName, os.O_APPEND|os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(bs); err == nil {
+		err = file.Sync() // 大部分数据在锁外刷盘
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.Lock.Lock()
+	defer a.Lock.Unlock()
+	if _, err = file.Write(a.RewriteBuff.Bytes()); err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tempName, fileName)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	_ = SyncDir(filepath.Dir(fileName))
+	// 新文件的句柄直接用于之后的追加，旧文件已经被替换
+	a.File.Close()
+	a.File = file
+	a.ID = id
+	a.BaseSize = a.Size()
+	return nil
+}
+
+// dumpAOF 登记快照的同时开始记录重写缓冲，两者以同一时刻为界，数据由 finishSnapshot 逐个分片编码
+func (h *Handler) dumpAOF(id string) *Snapshot {
+	var snap *Snapshot
+	if h.Conf.AOFUseRDBPreamble { // 标识记录在快照的辅助字段中
+		encoder := NewRDBEncoder()
+		encoder.WriteAux(RDBAuxCTime, strconv.FormatInt(time.Now().Unix(), 10))
+		encoder.WriteAux(RDBAuxAOFID, id)
+		snap = NewRDBSnapshot(encoder)
+	} else {
+		buff := &bytes.Buffer{}
+		h.AOF.writeHead(buff, id)
+		snap = &Snapshot{
+			Buff: buff,
+			Select: func(index int) {
+				h.AOF.writeReq(buff, &Req{Cmd: CmdSelect, Args: []string{strconv.Itoa(index)}})
+			},
+			Encode: h.AOF.writeEntry,
+			Finish: buff.Bytes,
+		}
+	}
+	h.beginSnapshot(snap, h.AOF.startRewriteBuff)
+	return snap
+}
+
+// BGRewriteAOF 直接使用内存中的数据生成快照，只有登记快照期间阻塞写指令，编码、写文件与刷盘交给后台协程
+func (h *Handler) BGRewriteAOF() error {
+	if err := h.AOF.beginRewrite(); err != nil {
+		return err
+	}
+	id := GenRunID() // 重写后是新的文件，之前的快照不再对应
+	snap := h.dumpAOF(id)
+	go func() {
+		h.AOF.ReWrite(h.Conf.AOFFile, h.finishSnapshot(snap, false), id)
+	}()
+	return nil
+}
+
+// ScheduleRewrite 当前的重写结束后再重写一次
+func (a *AOF) ScheduleRewrite() {
+	a.Lock.Lock()
+	defer a.Lock.Unlock()
+	a.RewriteScheduled = true
+}
+
+// needRewrite 与 redis 一致，大小超过最小值且相对上次重写后的增长超过百分比时自动重写
+func (h *Handler) needRewrite() bool {
+	a := h.AOF
+	a.Lock.Lock()
+	defer a.Lock.Unlock()
+	if a.Rewriting {
+		return false
+	}
+	if a.RewriteScheduled {
+		a.RewriteScheduled = false
+		Info("Starting scheduled rewriting of AOF")
+		return true
+	}
+	percentage := h.Conf.AutoAOFRewritePercentage
+	if percentage <= 0 || (!a.LastRewriteStatus && time.Since(a.RewriteStart) < AOFRetryDelay) {
+		return false
+	}
+	size := a.Size()
+	base := max(a.BaseSize, 1)
+	growth := (size - base) * 100 / base
+	if size < h.Conf.AutoAOFRewriteMinSize || growth < int64(percentage) {
+		return false
+	}
+	Info("Starting automatic rewriting of AOF on %d%% growth", growth)
+	return true
+}
+
+// writeEntry 生成能够还原一个 key 的指令，调用方持有 key 所在分片的锁
+func (a *AOF) writeEntry(buff *bytes.Buffer, db *DB, key string, entry *Entry) {
+	if db.IsExpire(key) { // 已经过期的不需要保留
+		return
+	}
+	a.writeReq(buff, entryReq(key, entry))
+	if ttl := db.TTLMap.Get(key); ttl != nil { // 过期时间也需要保留
 		a.writeReq(buff, &Req{
-			Cmd:  CmdSet,
-			Args: []string{key, entry.Str},
+			Cmd:  CmdAbsExpire,
+			Args: []string{key, strconv.FormatInt(ttl.Time.Unix(), 10)},
 		})
+	}
+}
+
+// entryReq 能够还原整个 key 的一条写指令，迁移时同样用它记录收到的 key
+func entryReq(key string, entry *Entry) *Req {
+	args := []string{key}
+	switch entry.Type {
+	case TypeStr:
+		return &Req{Cmd: CmdSet, Args: []string{key, entry.Str}}
 	case TypeZSet:
-		args := make([]string, 0)
-		args = append(args, key)
-		m := entry.SkipList.GetMap()
-		for name, score := range m {
-			args = append(args, name, strconv.FormatFloat(score, 'f', -1, 64))
+		for name, score := range entry.SkipList.GetMap() { // zadd 参数为 score member
+			args = append(args, strconv.FormatFloat(score, 'f', -1, 64), name)
 		}
-		a.writeReq(buff, &Req{
-			Cmd:  CmdZAdd,
-			Args: args,
+		return &Req{Cmd: CmdZAdd, Args: args}
+	case TypeHash:
+		for field, val := range entry.Hash.All() {
+			args = append(args, field, val)
+		}
+		return &Req{Cmd: CmdHSet, Args: args}
+	case TypeList:
+		entry.List.ForEach(func(_ int, item string) bool {
+			args = append(args, item)
+			return true
 		})
+		return &Req{Cmd: CmdRPush, Args: args}
+	case TypeSet:
+		return &Req{Cmd: CmdSAdd, Args: append(args, entry.Set.Members()...)}
 	default:
 		panic(fmt.Sprintf("unkown type %v", entry.Type))
 	}
@@ -191,9 +536,36 @@ func NewAOF(fileName string, fsync string) *AOF {
 	// 追加写文件
 	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
 	HandleErr(err)
-	res := &AOF{File: file, Fsync: fsync, LastIndex: -1}
+	res := &AOF{File: file, Fsync: fsync, LastIndex: -1, LastRewriteTime: -1, LastRewriteStatus: true}
+	res.ID = readAOFID(fileName)
+	if res.Size() == 0 { // 新文件先写入标识
+		res.ID = GenRunID()
+		res.Created = true
+		res.writeHead(file, res.ID)
+	}
+	res.BaseSize = res.Size()
 	if fsync == FsyncEverySec {
 		go res.fsyncEverySec()
 	}
 	return res
 }
+
+// readAOFID 读取第一行或者快照中的标识，没有标识的旧文件返回空
+func readAOFID(fileName string) string {
+	file, err := os.Open(fileName)
+	HandleErr(err)
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	if bs, _ := reader.Peek(len(RDBMagic)); HasRDBHead(bs) {
+		return NewRDBDecoder(reader).ReadHead()[RDBAuxAOFID]
+	}
+	line, err := reader.ReadBytes('\n')
+	if err != nil { // 空文件或者只有一条不完整的指令
+		return ""
+	}
+	req, _, err := readRecord(line)
+	if err != nil || req.Cmd != CmdAOFID || len(req.Args) != 1 {
+		return ""
+	}
+	return req.Args[0]
+}
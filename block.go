@@ -0,0 +1,142 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Waiter 阻塞在若干 key 上的会话，同一个 key 上按到达顺序唤醒
+type Waiter struct {
+	Session *Session
+	SeqID   string
+	DB      *DB
+	Keys    []string
+	Locks   []string                        // 重试时需要加锁的 key，与指令本身涉及的 key 一致
+	Retry   func(key string) (*Reply, bool) // key 有数据后重新尝试，成功后 Reply 就是最终回复
+	Reply   chan *Reply
+	Lock    sync.Mutex // 保证唤醒与超时只有一个生效
+	Done    bool
+}
+
+func (w *Waiter) taskKey() string {
+	return "block-" + strconv.FormatInt(w.Session.ID, 10)
+}
+
+// finish 只有第一次调用生效
+func (w *Waiter) finish(reply *Reply) bool {
+	if w.Done {
+		return false
+	}
+	w.Done = true
+	w.Reply <- reply
+	return true
+}
+
+// ParseBlockTimeout 超时时间单位秒，支持小数，0 表示一直阻塞
+func ParseBlockTimeout(arg string) (time.Duration, bool) {
+	timeout, err := strconv.ParseFloat(arg, 64)
+	if err != nil || timeout < 0 {
+		return 0, false
+	}
+	return time.Duration(timeout * float64(time.Second)), true
+}
+
+// Block 注册阻塞的会话，由连接协程在指令执行完毕后等待结果
+func (d *DB) Block(session *Session, req *Req, keys []string, timeout time.Duration, retry func(key string) (*Reply, bool)) {
+	locks := cmdMap[strings.ToUpper(req.Cmd)].Keys(req.Args)
+	waiter := &Waiter{Session: session, SeqID: req.SeqID, DB: d, Keys: keys, Locks: locks, Retry: retry, Reply: make(chan *Reply, 1)}
+	d.BlockLock.Lock()
+	for _, key := range keys {
+		d.Waiters[key] = append(d.Waiters[key], waiter)
+	}
+	d.BlockLock.Unlock()
+	if timeout > 0 {
+		d.TimeWheel.AddTask(waiter.taskKey(), func(string) {
+			d.CancelWaiter(waiter, NewNilReply())
+		}, timeout)
+	}
+	session.Waiter = waiter
+}
+
+// CancelWaiter 超时或连接断开时取消等待，已经被唤醒返回 false
+func (d *DB) CancelWaiter(waiter *Waiter, reply *Reply) bool {
+	waiter.Lock.Lock()
+	defer waiter.Lock.Unlock()
+	if !waiter.finish(reply) {
+		return false
+	}
+	d.removeWaiter(waiter)
+	d.TimeWheel.CancelTask(waiter.taskKey())
+	return true
+}
+
+func (d *DB) removeWaiter(waiter *Waiter) {
+	d.BlockLock.Lock()
+	defer d.BlockLock.Unlock()
+	for _, key := range waiter.Keys {
+		waiters := d.Waiters[key]
+		for i, item := range waiters {
+			if item == waiter {
+				waiters = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(waiters) == 0 {
+			delete(d.Waiters, key)
+		} else {
+			d.Waiters[key] = waiters
+		}
+	}
+}
+
+// SignalReady 写入数据后调用，只记录有会话在等待的 key
+func (d *DB) SignalReady(key string) {
+	d.BlockLock.Lock()
+	defer d.BlockLock.Unlock()
+	if _, ok := d.Waiters[key]; !ok || d.ReadyKeys[key] {
+		return
+	}
+	d.ReadyKeys[key] = true
+	d.ReadyQueue = append(d.ReadyQueue, key)
+}
+
+// ServeBlocked 指令执行完毕后调用，按阻塞的先后顺序唤醒等待的会话
+func (d *DB) ServeBlocked() {
+	for {
+		d.BlockLock.Lock()
+		if len(d.ReadyQueue) == 0 {
+			d.BlockLock.Unlock()
+			return
+		}
+		key := d.ReadyQueue[0]
+		d.ReadyQueue = d.ReadyQueue[1:]
+		delete(d.ReadyKeys, key)
+		waiters := append([]*Waiter{}, d.Waiters[key]...)
+		d.BlockLock.Unlock()
+		for _, waiter := range waiters {
+			if !d.serveWaiter(waiter, key) { // 数据已经被取完
+				break
+			}
+		}
+	}
+}
+
+func (d *DB) serveWaiter(waiter *Waiter, key string) bool {
+	waiter.Lock.Lock()
+	defer waiter.Lock.Unlock()
+	if waiter.Done { // 已经超时
+		return true
+	}
+	unlock := d.LockKeys(waiter.Locks, true)
+	defer unlock()
+	reply, ok := waiter.Retry(key)
+	if !ok {
+		return false
+	}
+	waiter.finish(reply)
+	d.removeWaiter(waiter)
+	d.TimeWheel.CancelTask(waiter.taskKey())
+	return true
+}
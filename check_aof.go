@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// CheckAOF check-aof [--fix] <file> 校验 aof 文件并输出第一条损坏记录的位置，--fix 时截断损坏的记录及之后的部分
+// 返回进程的退出码
+func CheckAOF(args []string) int {
+	fix := false
+	fileName := ""
+	for _, arg := range args {
+		if arg == "--fix" {
+			fix = true
+		} else {
+			fileName = arg
+		}
+	}
+	if fileName == "" {
+		fmt.Println("Usage: my_redis check-aof [--fix] <file.aof>")
+		return 1
+	}
+	bs, err := os.ReadFile(fileName)
+	if err != nil {
+		fmt.Printf("Cannot open file %s: %v\n", fileName, err)
+		return 1
+	}
+	offset, err := checkAOF(bs)
+	fmt.Printf("AOF analyzed: size=%d, ok_up_to=%d, diff=%d\n", len(bs), offset, int64(len(bs))-offset)
+	if err == nil {
+		fmt.Printf("AOF %s is valid\n", fileName)
+		return 0
+	}
+	fmt.Printf("First bad record at offset %d: %v\n", offset, err)
+	if !fix {
+		fmt.Println("AOF is not valid. Use the --fix option to try fixing it.")
+		return 1
+	}
+	if offset == 0 && HasRDBHead(bs) {
+		fmt.Println("RDB preamble is corrupted, can not fix it.")
+		return 1
+	}
+	if err = os.Truncate(fileName, offset); err != nil {
+		fmt.Printf("Failed to truncate AOF %s: %v\n", fileName, err)
+		return 1
+	}
+	fmt.Printf("Successfully truncated AOF %s, %d bytes dropped\n", fileName, int64(len(bs))-offset)
+	return 0
+}
+
+// checkAOF 返回完整部分的长度，混合 aof 的快照部分损坏时返回 0
+func checkAOF(bs []byte) (offset int64, err error) {
+	if HasRDBHead(bs) {
+		decoder := NewRDBDecoder(bytes.NewReader(bs))
+		err = func() (err error) {
+			defer func() {
+				if res := recover(); res != nil {
+					err = fmt.Errorf("bad rdb preamble: %v", res)
+				}
+			}()
+			decoder.ReadHead()
+			decoder.ReadEntries(func(int, string, *Entry, time.Time) {})
+			return nil
+		}()
+		if err != nil {
+			return 0, err
+		}
+		offset = decoder.Offset
+	}
+	err = scanAOF(bs[offset:], offset, func([]*Req) {})
+	aofErr := &AOFError{}
+	if errors.As(err, &aofErr) {
+		return aofErr.Offset, aofErr.Err
+	}
+	return int64(len(bs)), nil
+}
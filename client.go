@@ -33,7 +33,10 @@ type Client struct {
 func (c *Client) readLoop() {
 	for {
 		resp := &Resp{}
-		ReadObj(c.Conn, resp) // 异步读取数据
+		if err := ReadObj(c.Conn, resp); err != nil { // 异步读取数据
+			Error("Read %s err %v", c.Conn.RemoteAddr(), err)
+			return
+		}
 		if temp, ok := c.Resps[resp.SeqID]; ok {
 			temp.Ready(resp) // 设置完毕并移除
 			delete(c.Resps, resp.SeqID)
@@ -52,7 +55,10 @@ func (c *Client) Send(req *Req) *AsyncResp {
 
 func (c *Client) writeLoop() {
 	for req := range c.SendChan {
-		WriteObj(c.Conn, req) // 有任务就发一下
+		if err := WriteObj(c.Conn, req); err != nil { // 有任务就发一下
+			Error("Write %s err %v", c.Conn.RemoteAddr(), err)
+			return
+		}
 	}
 }
 
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Cluster 集群模式，peers 为全部节点，各个节点按照相同的顺序依次拆分最大的范围，得到相同的范围表
+// key 的 hash 不在自己的范围内时返回 MOVED，由客户端重定向到对应的节点
+type Cluster struct {
+	Self     string // 自己的 ip:port
+	Ring     *ConsistencyMap
+	Lock     sync.RWMutex
+	FileName string // 范围表修改后保存到这个文件，重启后不会撤销交接，为空时不保存
+}
+
+// ClusterState 持久化的范围表，拆分最大范围的堆按数组原样保存，重启后新增节点拆分的范围仍与其他节点一致
+type ClusterState struct {
+	Ranges []*RangeState `json:"ranges"`
+	Heap   []*Range      `json:"heap"`
+}
+
+type RangeState struct {
+	Start     uint64 `json:"start"`
+	End       uint64 `json:"end"`
+	Node      string `json:"node"`
+	Migrating string `json:"migrating"`
+	Importing string `json:"importing"`
+}
+
+// NewCluster 存在保存的范围表时直接加载，peers 只用于第一次启动
+func NewCluster(self string, peers []string, fileName string) *Cluster {
+	if !slices.Contains(peers, self) {
+		panic(fmt.Errorf("cluster peers %v does not contain self %s", peers, self))
+	}
+	res := &Cluster{Self: self, FileName: fileName}
+	if fileName != "" && FileExist(fileName) {
+		res.load()
+		return res
+	}
+	res.Ring = NewConsistencyMap()
+	res.Ring.Data[0].Node = peers[0]
+	for _, peer := range peers[1:] {
+		res.Ring.AddNode().Node = peer
+	}
+	return res
+}
+
+func (c *Cluster) load() {
+	bs, err := os.ReadFile(c.FileName)
+	HandleErr(err)
+	state := &ClusterState{}
+	HandleErr(json.Unmarshal(bs, state))
+	if len(state.Ranges) == 0 || len(state.Heap) == 0 {
+		panic(fmt.Errorf("cluster config %s has no range", c.FileName))
+	}
+	ring := &ConsistencyMap{Stack: &Stack{Data: state.Heap, Count: len(state.Heap)}, InvalidRange: make(map[string]bool)}
+	for _, item := range state.Ranges {
+		sub := NewSubMap(item.Start, item.End)
+		sub.Node, sub.Migrating, sub.Importing = item.Node, item.Migrating, item.Importing
+		ring.Data = append(ring.Data, sub)
+	}
+	c.Ring = ring
+}
+
+// save 调用方需要持有写锁，保存成功后才回复客户端
+func (c *Cluster) save() error {
+	if c.FileName == "" {
+		return nil
+	}
+	state := &ClusterState{Heap: c.Ring.Stack.Data[:c.Ring.Stack.Count]}
+	for _, item := range c.Ring.Data {
+		state.Ranges = append(state.Ranges, &RangeState{Start: item.Start, End: item.End, Node: item.Node, Migrating: item.Migrating, Importing: item.Importing})
+	}
+	bs, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(c.FileName, bs)
+}
+
+// Check 指令的 key 需要属于同一个范围，不由自己处理时返回重定向的错误信息
+// 迁出中的范围 key 还在本地时直接执行，都已迁走时返回 ASK 让客户端去目标节点，部分迁走时只能稍后重试
+// 迁入中的范围只处理带有 ASKING 的请求，exists 为 nil 表示事务入队时还没有加锁，不检查迁出
+func (c *Cluster) Check(keys []string, asking bool, exists func(string) bool) string {
+	c.Lock.RLock()
+	defer c.Lock.RUnlock()
+	var sub *SubMap
+	for _, key := range keys {
+		item := c.Ring.getSubMap(key)
+		if sub != nil && item != sub {
+			return MsgCrossSlot
+		}
+		sub = item
+	}
+	if sub == nil {
+		return ""
+	}
+	hash := KeyHash(keys[0])
+	if sub.Importing != "" {
+		if asking {
+			return ""
+		}
+		return fmt.Sprintf("MOVED %d %s", hash, sub.Importing)
+	}
+	if sub.Node != c.Self {
+		return fmt.Sprintf("MOVED %d %s", hash, sub.Node)
+	}
+	if sub.Migrating == "" || exists == nil {
+		return ""
+	}
+	count := 0
+	for _, key := range keys {
+		if exists(key) {
+			count++
+		}
+	}
+	if count == len(keys) {
+		return ""
+	}
+	if count == 0 {
+		return fmt.Sprintf("ASK %d %s", hash, sub.Migrating)
+	}
+	return MsgTryAgain
+}
+
+// findRange 按起点查找范围，调用方需要持有锁
+func (c *Cluster) findRange(start uint64) *SubMap {
+	for _, item := range c.Ring.Data {
+		if item.Start == start {
+			return item
+		}
+	}
+	return nil
+}
+
+// inRange 调用方需要持有锁
+func inRange(sub *SubMap, key string) bool {
+	hash := KeyHash(key)
+	return hash >= sub.Start && (hash < sub.End || sub.End == math.MaxUint64)
+}
+
+// Ranges 按起点排序的范围表，end 与 redis 的槽位一样包含在内
+func (c *Cluster) Ranges() []*SubMap {
+	c.Lock.RLock()
+	defer c.Lock.RUnlock()
+	res := make([]*SubMap, 0, len(c.Ring.Data))
+	for _, item := range c.Ring.Data {
+		end := item.End
+		if end != math.MaxUint64 {
+			end--
+		}
+		res = append(res, &SubMap{Start: item.Start, End: end, Node: item.Node, Migrating: item.Migrating, Importing: item.Importing})
+	}
+	slices.SortFunc(res, func(a, b *SubMap) int {
+		if a.Start < b.Start {
+			return -1
+		}
+		return 1
+	})
+	return res
+}
+
+// nodes 全部节点与各自的范围，节点按负责的第一个范围排序
+func (c *Cluster) nodes() ([]string, map[string][]*SubMap) {
+	order := make([]string, 0)
+	res := make(map[string][]*SubMap)
+	for _, item := range c.Ranges() {
+		if _, ok := res[item.Node]; !ok {
+			order = append(order, item.Node)
+		}
+		res[item.Node] = append(res[item.Node], item)
+	}
+	return order, res
+}
+
+// NodeID 节点没有持久化的标识，使用地址的 hash，各个节点计算的结果一致
+func NodeID(node string) string {
+	return fmt.Sprintf("%016x", Mix64(HashStr(node)))
+}
+
+// HandleCluster cluster nodes|slots|keyslot key|info|myid 查看范围表
+// addnode|setrange|countkeysinrange|getkeysinrange 配合 migrate 在线迁移范围
+func (h *Handler) HandleCluster(req *Req, session *Session) {
+	if h.Cluster == nil {
+		session.WriteError(req.SeqID, "This instance has cluster support disabled")
+		return
+	}
+	if len(req.Args) == 0 {
+		session.WriteError(req.SeqID, "Invalid Args")
+		return
+	}
+	c := h.Cluster
+	switch sub := strings.ToUpper(req.Args[0]); {
+	case sub == "NODES" && len(req.Args) == 1:
+		order, ranges := c.nodes()
+		buff := &strings.Builder{}
+		for _, node := range order {
+			flags := "master"
+			if node == c.Self {
+				flags = "myself,master"
+			}
+			_, port, _ := net.SplitHostPort(node)
+			fmt.Fprintf(buff, "%s %s@%s %s - 0 0 0 connected", NodeID(node), node, port, flags)
+			for _, item := range ranges[node] {
+				fmt.Fprintf(buff, " %d-%d", item.Start, item.End)
+			}
+			if node == c.Self { // 与 redis 一样只在自己的这一行展示迁移状态
+				for _, item := range c.Ranges() {
+					if item.Migrating != "" {
+						fmt.Fprintf(buff, " [%d->-%s]", item.Start, NodeID(item.Migrating))
+					}
+					if item.Importing != "" {
+						fmt.Fprintf(buff, " [%d-<-%s]", item.Start, NodeID(item.Importing))
+					}
+				}
+			}
+			buff.WriteString("\n")
+		}
+		session.WriteBulk(req.SeqID, buff.String())
+	case sub == "SLOTS" && len(req.Args) == 1:
+		res := make([]*Reply, 0)
+		for _, item := range c.Ranges() { // 范围超出 int64，以字符串返回
+			host, port, _ := net.SplitHostPort(item.Node)
+			res = append(res, NewArrayReply([]*Reply{
+				NewBulkReply(strconv.FormatUint(item.Start, 10)),
+				NewBulkReply(strconv.FormatUint(item.End, 10)),
+				NewStrsReply([]string{host, port, NodeID(item.Node)}),
+			}))
+		}
+		session.WriteReply(req.SeqID, NewArrayReply(res))
+	case sub == "KEYSLOT" && len(req.Args) == 2:
+		session.WriteBulk(req.SeqID, strconv.FormatUint(KeyHash(req.Args[1]), 10))
+	case sub == "INFO" && len(req.Args) == 1:
+		order, _ := c.nodes()
+		session.WriteBulk(req.SeqID, strings.Join([]string{
+			"cluster_enabled:1",
+			"cluster_state:ok",
+			fmt.Sprintf("cluster_known_nodes:%d", len(order)),
+			fmt.Sprintf("cluster_size:%d", len(order)),
+		}, "\r\n")+"\r\n")
+	case sub == "MYID" && len(req.Args) == 1:
+		session.WriteBulk(req.SeqID, NodeID(c.Self))
+	case sub == "ADDNODE" && len(req.Args) == 2:
+		start, err := c.AddNode(req.Args[1])
+		if err != nil {
+			Error("Save cluster config %s err %v", c.FileName, err)
+			session.WriteError(req.SeqID, "Save Cluster Config Err")
+			return
+		}
+		session.WriteBulk(req.SeqID, strconv.FormatUint(start, 10))
+	case sub == "SETRANGE" && len(req.Args) >= 3:
+		h.HandleSetRange(req, session)
+	case sub == "COUNTKEYSINRANGE" && len(req.Args) == 2:
+		start, err := strconv.ParseUint(req.Args[1], 10, 64)
+		if err != nil {
+			session.WriteError(req.SeqID, "Invalid Range")
+			return
+		}
+		keys, err := h.keysInRange(h.DBs[session.DBIndex], start, -1)
+		if err != nil {
+			session.WriteError(req.SeqID, err.Error())
+			return
+		}
+		session.WriteNum(req.SeqID, len(keys))
+	case sub == "GETKEYSINRANGE" && len(req.Args) == 3:
+		start, err := strconv.ParseUint(req.Args[1], 10, 64)
+		if err != nil {
+			session.WriteError(req.SeqID, "Invalid Range")
+			return
+		}
+		count, err := strconv.Atoi(req.Args[2])
+		if err != nil || count < 0 {
+			session.WriteError(req.SeqID, "Invalid Count")
+			return
+		}
+		keys, err := h.keysInRange(h.DBs[session.DBIndex], start, count)
+		if err != nil {
+			session.WriteError(req.SeqID, err.Error())
+			return
+		}
+		session.WriteReply(req.SeqID, NewStrsReply(keys))
+	default:
+		session.WriteError(req.SeqID, "Unknown Cluster Subcommand "+req.Args[0])
+	}
+}
+
+// AddNode 拆分最大的范围给新节点，范围仍由原来的节点负责，迁移完成后再通过 setrange node 交接
+// 新节点的 peers 追加在最后时，与它自己启动时计算的范围一致，返回拆分出的范围起点
+func (c *Cluster) AddNode(node string) (uint64, error) {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	sub := c.Ring.AddNode()
+	for _, item := range c.Ring.Data {
+		if item.End == sub.Start {
+			sub.Node = item.Node
+			break
+		}
+	}
+	return sub.Start, c.save()
+}
+
+// HandleSetRange cluster setrange start migrating|importing node / stable / node node
+// 交接时先在目标节点执行 node，再在源节点执行，源节点还有 key 时拒绝交接，避免丢失数据
+func (h *Handler) HandleSetRange(req *Req, session *Session) {
+	c := h.Cluster
+	start, err := strconv.ParseUint(req.Args[1], 10, 64)
+	if err != nil {
+		session.WriteError(req.SeqID, "Invalid Range")
+		return
+	}
+	action, node := strings.ToUpper(req.Args[2]), ""
+	if action == "STABLE" {
+		if len(req.Args) != 3 {
+			session.WriteError(req.SeqID, "Invalid Args")
+			return
+		}
+	} else {
+		if len(req.Args) != 4 {
+			session.WriteError(req.SeqID, "Invalid Args")
+			return
+		}
+		node = req.Args[3]
+	}
+	if action == "NODE" { // 检查 key 与交接在同一把锁内，期间不会有写入落到这个范围，分片锁在集群锁之前
+		unlock := h.LockAll()
+		defer unlock()
+	}
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	sub := c.findRange(start)
+	if sub == nil {
+		session.WriteError(req.SeqID, "Invalid Range")
+		return
+	}
+	switch action {
+	case "MIGRATING":
+		if sub.Node != c.Self {
+			session.WriteError(req.SeqID, "I'm Not The Owner Of This Range")
+			return
+		}
+		sub.Migrating, sub.Importing = node, ""
+	case "IMPORTING":
+		if node == c.Self {
+			session.WriteError(req.SeqID, "I'm Already The Owner Of This Range")
+			return
+		}
+		sub.Migrating, sub.Importing = "", node
+	case "STABLE":
+		sub.Migrating, sub.Importing = "", ""
+	case "NODE":
+		if node != c.Self && h.holdsKeys(sub) {
+			session.WriteError(req.SeqID, "I Still Hold Keys In This Range")
+			return
+		}
+		sub.Node, sub.Migrating, sub.Importing = node, "", ""
+	default:
+		session.WriteError(req.SeqID, "Invalid SetRange Action "+req.Args[2])
+		return
+	}
+	if err := c.save(); err != nil {
+		Error("Save cluster config %s err %v", c.FileName, err)
+		session.WriteError(req.SeqID, "Save Cluster Config Err")
+		return
+	}
+	session.WriteOk(req.SeqID)
+}
+
+// holdsKeys 全部数据库中是否还有属于范围的 key，调用方需要持有全部分片的锁，不能使用 ForEach
+func (h *Handler) holdsKeys(sub *SubMap) bool {
+	for _, db := range h.DBs {
+		for _, shard := range db.DataMap.Shards {
+			for key := range shard.Data {
+				if !db.IsExpire(key) && inRange(sub, key) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// keysInRange 数据库中属于范围的 key，count 小于 0 表示全部
+func (h *Handler) keysInRange(db *DB, start uint64, count int) ([]string, error) {
+	h.Cluster.Lock.RLock()
+	sub := h.Cluster.findRange(start)
+	var item *SubMap
+	if sub != nil { // 复制一份，遍历时需要加分片锁，不能持有集群锁
+		item = &SubMap{Start: sub.Start, End: sub.End}
+	}
+	h.Cluster.Lock.RUnlock()
+	if item == nil {
+		return nil, errors.New("Invalid Range")
+	}
+	res := make([]string, 0)
+	db.ForEach(func(key string, _ *Entry) {
+		if (count < 0 || len(res) < count) && !db.IsExpire(key) && inRange(item, key) {
+			res = append(res, key)
+		}
+	})
+	return res, nil
+}
+
+// HandleAsking 允许下一条指令访问迁入中的范围
+func (h *Handler) HandleAsking(req *Req, session *Session) {
+	if h.Cluster == nil {
+		session.WriteError(req.SeqID, "This instance has cluster support disabled")
+		return
+	}
+	session.Asking = true
+	session.WriteOk(req.SeqID)
+}
+
+// Mode info 与 hello 中的运行模式
+func (h *Handler) Mode() string {
+	if h.Cluster != nil {
+		return "cluster"
+	}
+	return "standalone"
+}
+
+func (h *Handler) infoCluster() []string {
+	return []string{fmt.Sprintf("cluster_enabled:%d", boolToInt(h.Cluster != nil))}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"strconv"
+	"strings"
 )
 
 type Cmd interface {
@@ -9,27 +10,88 @@ type Cmd interface {
 }
 
 func init() {
-	RegisterCmd(CmdSet, &SetCmd{})
-	RegisterCmd(CmdGet, &GetCmd{})
-	RegisterCmd(CmdIncrBy, &IncrByCmd{})
-	RegisterCmd(CmdSetNX, &SetNXCmd{})
-	RegisterCmd(CmdSetEX, &SetEXCmd{})
-
-	RegisterCmd(CmdZAdd, &ZAddCmd{})
-	RegisterCmd(CmdZRem, &ZRemCmd{})
-	RegisterCmd(CmdZRange, &ZRangeCmd{})
-	RegisterCmd(CmdZCard, &ZCardCmd{})
-	RegisterCmd(CmdZScore, &ZScoreCmd{})
-	RegisterCmd(CmdZRank, &ZRankCmd{})
-
-	RegisterCmd(CmdExists, &ExistsCmd{})
-	RegisterCmd(CmdType, &TypeCmd{})
-	RegisterCmd(CmdTTL, &TTLCmd{})
-	RegisterCmd(CmdDel, &DelCmd{})
-	RegisterCmd(CmdExpire, &ExpireCmd{})
-	RegisterCmd(CmdPersist, &PersistCmd{})
-
-	RegisterCmd(CmdAbsExpire, &AbsExpireCmd{})
+	RegisterCmd(CmdSet, &SetCmd{}, -3, true, KeyRange(0, -1, 2))
+	RegisterCmd(CmdGet, &GetCmd{}, -2, false, AllKeys)
+	RegisterCmd(CmdIncrBy, &IncrByCmd{}, 3, true, FirstKey)
+	RegisterCmd(CmdSetNX, &SetNXCmd{}, -3, true, KeyRange(0, -1, 2))
+	RegisterCmd(CmdSetEX, &SetEXCmd{}, 4, true, FirstKey)
+
+	RegisterCmd(CmdZAdd, &ZAddCmd{}, -4, true, FirstKey)
+	RegisterCmd(CmdZRem, &ZRemCmd{}, -3, true, FirstKey)
+	RegisterCmd(CmdZRange, &ZRangeCmd{}, -4, false, FirstKey)
+	RegisterCmd(CmdZCard, &ZCardCmd{}, 2, false, FirstKey)
+	RegisterCmd(CmdZScore, &ZScoreCmd{}, 3, false, FirstKey)
+	RegisterCmd(CmdZRank, &ZRankCmd{}, 3, false, FirstKey)
+	RegisterCmd(CmdZPopMin, &ZPopCmd{}, -2, true, FirstKey)
+	RegisterCmd(CmdZPopMax, &ZPopCmd{Max: true}, -2, true, FirstKey)
+	RegisterCmd(CmdBZPopMin, &BZPopCmd{}, -3, true, KeyRange(0, -2, 1))
+	RegisterCmd(CmdBZPopMax, &BZPopCmd{Max: true}, -3, true, KeyRange(0, -2, 1))
+
+	RegisterCmd(CmdHSet, &HSetCmd{}, -4, true, FirstKey)
+	RegisterCmd(CmdHSetNX, &HSetNXCmd{}, 4, true, FirstKey)
+	RegisterCmd(CmdHGet, &HGetCmd{}, 3, false, FirstKey)
+	RegisterCmd(CmdHMGet, &HMGetCmd{}, -3, false, FirstKey)
+	RegisterCmd(CmdHDel, &HDelCmd{}, -3, true, FirstKey)
+	RegisterCmd(CmdHExists, &HExistsCmd{}, 3, false, FirstKey)
+	RegisterCmd(CmdHLen, &HLenCmd{}, 2, false, FirstKey)
+	RegisterCmd(CmdHKeys, &HKeysCmd{}, 2, false, FirstKey)
+	RegisterCmd(CmdHVals, &HValsCmd{}, 2, false, FirstKey)
+	RegisterCmd(CmdHGetAll, &HGetAllCmd{}, 2, false, FirstKey)
+	RegisterCmd(CmdHIncrBy, &HIncrByCmd{}, 4, true, FirstKey)
+	RegisterCmd(CmdHIncrByFloat, &HIncrByFloatCmd{}, 4, true, FirstKey)
+	RegisterCmd(CmdHStrLen, &HStrLenCmd{}, 3, false, FirstKey)
+	RegisterCmd(CmdHRandField, &HRandFieldCmd{}, -2, false, FirstKey)
+	RegisterCmd(CmdHScan, &HScanCmd{}, -3, false, FirstKey)
+
+	RegisterCmd(CmdLPush, &LPushCmd{}, -3, true, FirstKey)
+	RegisterCmd(CmdRPush, &LPushCmd{Tail: true}, -3, true, FirstKey)
+	RegisterCmd(CmdLPushX, &LPushCmd{Exists: true}, -3, true, FirstKey)
+	RegisterCmd(CmdRPushX, &LPushCmd{Tail: true, Exists: true}, -3, true, FirstKey)
+	RegisterCmd(CmdLPop, &LPopCmd{}, -2, true, FirstKey)
+	RegisterCmd(CmdRPop, &LPopCmd{Tail: true}, -2, true, FirstKey)
+	RegisterCmd(CmdLRange, &LRangeCmd{}, 4, false, FirstKey)
+	RegisterCmd(CmdLIndex, &LIndexCmd{}, 3, false, FirstKey)
+	RegisterCmd(CmdLSet, &LSetCmd{}, 4, true, FirstKey)
+	RegisterCmd(CmdLInsert, &LInsertCmd{}, 5, true, FirstKey)
+	RegisterCmd(CmdLLen, &LLenCmd{}, 2, false, FirstKey)
+	RegisterCmd(CmdLRem, &LRemCmd{}, 4, true, FirstKey)
+	RegisterCmd(CmdLTrim, &LTrimCmd{}, 4, true, FirstKey)
+	RegisterCmd(CmdLPos, &LPosCmd{}, -3, false, FirstKey)
+	RegisterCmd(CmdLMove, &LMoveCmd{}, 5, true, KeyRange(0, 1, 1))
+	RegisterCmd(CmdBLPop, &BLPopCmd{}, -3, true, KeyRange(0, -2, 1))
+	RegisterCmd(CmdBRPop, &BLPopCmd{Tail: true}, -3, true, KeyRange(0, -2, 1))
+	RegisterCmd(CmdBLMove, &BLMoveCmd{}, 6, true, KeyRange(0, 1, 1))
+
+	RegisterCmd(CmdSAdd, &SAddCmd{}, -3, true, FirstKey)
+	RegisterCmd(CmdSRem, &SRemCmd{}, -3, true, FirstKey)
+	RegisterCmd(CmdSIsMember, &SIsMemberCmd{}, 3, false, FirstKey)
+	RegisterCmd(CmdSMIsMember, &SMIsMemberCmd{}, -3, false, FirstKey)
+	RegisterCmd(CmdSMembers, &SMembersCmd{}, 2, false, FirstKey)
+	RegisterCmd(CmdSCard, &SCardCmd{}, 2, false, FirstKey)
+	RegisterCmd(CmdSPop, &SPopCmd{}, -2, true, FirstKey)
+	RegisterCmd(CmdSRandMember, &SRandMemberCmd{}, -2, false, FirstKey)
+	RegisterCmd(CmdSMove, &SMoveCmd{}, 4, true, KeyRange(0, 1, 1))
+	RegisterCmd(CmdSInter, &SOpCmd{Op: SetOpInter}, -2, false, AllKeys)
+	RegisterCmd(CmdSUnion, &SOpCmd{Op: SetOpUnion}, -2, false, AllKeys)
+	RegisterCmd(CmdSDiff, &SOpCmd{Op: SetOpDiff}, -2, false, AllKeys)
+	RegisterCmd(CmdSInterStore, &SOpCmd{Op: SetOpInter, Store: true}, -3, true, AllKeys)
+	RegisterCmd(CmdSUnionStore, &SOpCmd{Op: SetOpUnion, Store: true}, -3, true, AllKeys)
+	RegisterCmd(CmdSDiffStore, &SOpCmd{Op: SetOpDiff, Store: true}, -3, true, AllKeys)
+	RegisterCmd(CmdSInterCard, &SInterCardCmd{}, -3, false, interCardKeys)
+	RegisterCmd(CmdSScan, &SScanCmd{}, -3, false, FirstKey)
+
+	RegisterCmd(CmdExists, &ExistsCmd{}, 2, false, FirstKey)
+	RegisterCmd(CmdType, &TypeCmd{}, 2, false, FirstKey)
+	RegisterCmd(CmdTTL, &TTLCmd{}, 2, false, FirstKey)
+	RegisterCmd(CmdDel, &DelCmd{}, 2, true, FirstKey)
+	RegisterCmd(CmdExpire, &ExpireCmd{}, 3, true, FirstKey)
+	RegisterCmd(CmdPersist, &PersistCmd{}, 2, true, FirstKey)
+
+	RegisterCmd(CmdMigrate, &MigrateCmd{}, -6, true, migrateKeys)
+	RegisterCmd(CmdRestore, &RestoreCmd{}, -4, true, FirstKey)
+	RegisterCmd(CmdRestoreAsking, &RestoreCmd{}, -4, true, FirstKey)
+
+	RegisterCmd(CmdAbsExpire, &AbsExpireCmd{}, 3, true, FirstKey)
 }
 
 //============================SetCmd=================================
@@ -44,21 +106,20 @@ func (s *SetCmd) Exec(db *DB, req *Req, session *Session) {
 		session.WriteError(req.SeqID, "Invalid Set Param")
 		return
 	}
-	count := 0
 	for i := 0; i < len(req.Args); i += 2 {
-		if entry := db.GetEntry(req.Args[i]); entry != nil {
+		if entry := db.GetEntry(req.Args[i]); entry != nil && entry.Type == TypeStr {
 			entry.Str = req.Args[i+1]
-			entry.Version++
-		} else { // 不存在
+			db.Touch(req.Args[i])
+		} else { // 不存在或者类型不同直接覆盖
 			db.PutEntry(req.Args[i], &Entry{
 				Type: TypeStr,
 				Str:  req.Args[i+1],
 			})
-			count++
 		}
 		db.RemoveTTL(req.Args[i])
+		db.Notify(NotifyString, "set", req.Args[i])
 	}
-	session.WriteNum(req.SeqID, count)
+	session.WriteOk(req.SeqID)
 }
 
 //===========================GetCmd==============================
@@ -72,16 +133,24 @@ func (g *GetCmd) Exec(db *DB, req *Req, session *Session) {
 		session.WriteError(req.SeqID, "Invalid Get Param")
 		return
 	}
-	res := make([]string, 0)
+	res := make([]*Reply, 0)
 	for _, key := range req.Args {
-		entry := db.GetEntry(key)
+		entry, ok := db.GetTypeEntry(key, TypeStr)
+		if !ok && len(req.Args) == 1 { // 多个 key 时与 mget 一致，类型不同的返回 nil
+			session.WriteError(req.SeqID, MsgWrongType)
+			return
+		}
 		if entry != nil {
-			res = append(res, entry.Str)
+			res = append(res, NewBulkReply(entry.Str))
 		} else {
-			res = append(res, "NIL")
+			res = append(res, NewNilReply())
 		}
 	}
-	session.WriteOk(req.SeqID, res...)
+	if len(res) == 1 { // 单个 key 与 redis 保持一致直接返回值
+		session.WriteReply(req.SeqID, res[0])
+	} else {
+		session.WriteReply(req.SeqID, NewArrayReply(res))
+	}
 }
 
 //=======================IncrByCmd==========================
@@ -102,7 +171,11 @@ func (i *IncrByCmd) Exec(db *DB, req *Req, session *Session) {
 		session.WriteError(req.SeqID, "IncrBy Num Err")
 		return
 	}
-	entry := db.GetEntry(key)
+	entry, ok := db.GetTypeEntry(key, TypeStr)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
 	if entry == nil {
 		session.WriteError(req.SeqID, "IncrBy Key Not Exist")
 		return
@@ -114,8 +187,13 @@ func (i *IncrByCmd) Exec(db *DB, req *Req, session *Session) {
 		return
 	}
 	entry.Str = strconv.FormatFloat(old+num, 'f', -1, 64)
-	entry.Version++
-	session.WriteOk(req.SeqID)
+	db.Touch(key)
+	db.Notify(NotifyString, "incrby", key)
+	if res, err := strconv.ParseInt(entry.Str, 10, 64); err == nil {
+		session.WriteNum(req.SeqID, int(res))
+	} else { // 存在小数部分只能返回字符串
+		session.WriteBulk(req.SeqID, entry.Str)
+	}
 }
 
 //==================SetNXCmd=====================
@@ -131,9 +209,10 @@ func (s *SetNXCmd) Exec(db *DB, req *Req, session *Session) {
 	}
 	count := 0
 	for i := 0; i < len(req.Args); i += 2 {
-		if entry := db.GetEntry(req.Args[i]); entry != nil {
+		if entry := db.GetEntry(req.Args[i]); entry != nil && entry.Type == TypeStr {
 			entry.Str = req.Args[i+1]
-			entry.Version++
+			db.Touch(req.Args[i])
+			db.Notify(NotifyString, "set", req.Args[i])
 			count++
 		}
 		db.RemoveTTL(req.Args[i])
@@ -160,15 +239,16 @@ func (s *SetEXCmd) Exec(db *DB, req *Req, session *Session) {
 		session.WriteError(req.SeqID, "Err SetEX TTL")
 		return
 	}
-	if entry := db.GetEntry(key); entry != nil {
+	if entry := db.GetEntry(key); entry != nil && entry.Type == TypeStr {
 		entry.Str = val
-		entry.Version++
+		db.Touch(key)
 	} else {
 		db.PutEntry(key, &Entry{
 			Type: TypeStr,
 			Str:  val,
 		})
 	}
+	db.Notify(NotifyString, "set", key)
 	db.SetTTL(key, int(ttl))
 	session.WriteOk(req.SeqID)
 }
@@ -184,11 +264,16 @@ func (z *ZAddCmd) Exec(db *DB, req *Req, session *Session) {
 		session.WriteError(req.SeqID, "Invalid ZAdd Param")
 		return
 	}
-	entry := db.GetOrPutEntry(req.Args[0], &Entry{
-		Type:     TypeZSet,
-		SkipList: NewSkipList(4),
-	})
-	entry.Version++
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeZSet)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	if entry == nil {
+		entry = &Entry{Type: TypeZSet, SkipList: NewSkipList(4)}
+		db.PutEntry(req.Args[0], entry)
+	}
+	db.Touch(req.Args[0])
 	count := 0
 	for i := 1; i < len(req.Args); i += 2 {
 		score, err := strconv.ParseFloat(req.Args[i], 10)
@@ -200,6 +285,10 @@ func (z *ZAddCmd) Exec(db *DB, req *Req, session *Session) {
 			count++
 		}
 	}
+	if count > 0 {
+		db.Notify(NotifyZSet, "zadd", req.Args[0])
+	}
+	db.SignalReady(req.Args[0])
 	session.WriteNum(req.SeqID, count)
 }
 
@@ -208,9 +297,14 @@ func (z *ZAddCmd) Exec(db *DB, req *Req, session *Session) {
 type ZRangeCmd struct {
 }
 
-// zrange key 1 -1
+// zrange key 1 -1 [withscores]
 func (z *ZRangeCmd) Exec(db *DB, req *Req, session *Session) {
-	if len(req.Args) != 3 {
+	if len(req.Args) != 3 && len(req.Args) != 4 {
+		session.WriteError(req.SeqID, "Invalid ZRange Param")
+		return
+	}
+	withScores := len(req.Args) == 4
+	if withScores && strings.ToUpper(req.Args[3]) != "WITHSCORES" {
 		session.WriteError(req.SeqID, "Invalid ZRange Param")
 		return
 	}
@@ -225,13 +319,31 @@ func (z *ZRangeCmd) Exec(db *DB, req *Req, session *Session) {
 		session.WriteError(req.SeqID, "Invalid End")
 		return
 	}
-	entry := db.GetEntry(key)
+	entry, ok := db.GetTypeEntry(key, TypeZSet)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
 	if entry == nil {
-		session.WriteOk(req.SeqID, "NIL")
+		session.WriteStrs(req.SeqID, make([]string, 0))
 		return
 	}
 	res := entry.SkipList.Range(int(start), int(end))
-	session.WriteOk(req.SeqID, res...)
+	if !withScores {
+		session.WriteStrs(req.SeqID, res)
+		return
+	}
+	// RESP3 返回 [member score] 二元组的数组，RESP2 打平
+	items := make([]*Reply, 0)
+	for _, name := range res {
+		score, _ := entry.SkipList.GetScore(name)
+		if session.Proto == ProtoRESP3 {
+			items = append(items, NewArrayReply([]*Reply{NewBulkReply(name), NewDoubleReply(score)}))
+		} else {
+			items = append(items, NewBulkReply(name), NewDoubleReply(score))
+		}
+	}
+	session.WriteReply(req.SeqID, NewArrayReply(items))
 }
 
 //========================ZRemCmd=======================
@@ -245,18 +357,25 @@ func (z *ZRemCmd) Exec(db *DB, req *Req, session *Session) {
 		session.WriteError(req.SeqID, "Invalid ZRem Param")
 		return
 	}
-	entry := db.GetEntry(req.Args[0])
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeZSet)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
 	if entry == nil {
 		session.WriteNum(req.SeqID, 0)
 		return
 	}
-	entry.Version++
+	db.Touch(req.Args[0])
 	count := 0
 	for _, key := range req.Args[1:] {
 		if entry.SkipList.Del(key) {
 			count++
 		}
 	}
+	if count > 0 {
+		db.Notify(NotifyZSet, "zrem", req.Args[0])
+	}
 	session.WriteNum(req.SeqID, count)
 }
 
@@ -271,7 +390,11 @@ func (z *ZCardCmd) Exec(db *DB, req *Req, session *Session) {
 		session.WriteError(req.SeqID, "Invalid ZCard Param")
 		return
 	}
-	entry := db.GetEntry(req.Args[0])
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeZSet)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
 	if entry == nil {
 		session.WriteNum(req.SeqID, 0)
 		return
@@ -290,17 +413,21 @@ func (z *ZScoreCmd) Exec(db *DB, req *Req, session *Session) {
 		session.WriteError(req.SeqID, "Invalid ZScore Param")
 		return
 	}
-	entry := db.GetEntry(req.Args[0])
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeZSet)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
 	if entry == nil {
-		session.WriteError(req.SeqID, "ZSet Not Exist")
+		session.WriteNil(req.SeqID)
 		return
 	}
 	val, ok := entry.SkipList.GetScore(req.Args[1])
 	if !ok {
-		session.WriteError(req.SeqID, "ZSet Key Not Exist")
+		session.WriteNil(req.SeqID)
 		return
 	}
-	session.WriteOk(req.SeqID, strconv.FormatFloat(val, 'f', -1, 64))
+	session.WriteDouble(req.SeqID, val)
 }
 
 //=======================ZRankCmd=====================
@@ -314,19 +441,118 @@ func (z *ZRankCmd) Exec(db *DB, req *Req, session *Session) {
 		session.WriteError(req.SeqID, "Invalid ZRank Param")
 		return
 	}
-	entry := db.GetEntry(req.Args[0])
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeZSet)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
 	if entry == nil {
-		session.WriteError(req.SeqID, "ZSet Not Exist")
+		session.WriteNil(req.SeqID)
 		return
 	}
 	rank, ok := entry.SkipList.GetRank(req.Args[1])
 	if !ok {
-		session.WriteError(req.SeqID, "ZSet Key Not Exist")
+		session.WriteNil(req.SeqID)
 		return
 	}
 	session.WriteNum(req.SeqID, rank)
 }
 
+//=======================ZPopCmd=====================
+
+// popZSet 弹出分数最小或最大的 count 个成员，返回 member score 交替的数组，元素全部弹出后删除 key
+func popZSet(db *DB, key string, entry *Entry, count int, max bool) []*Reply {
+	res := make([]*Reply, 0)
+	for i := 0; i < count && entry.SkipList.GetCount() > 0; i++ {
+		idx := 0
+		if max {
+			idx = entry.SkipList.GetCount() - 1
+		}
+		name := entry.SkipList.Range(idx, idx)[0]
+		score, _ := entry.SkipList.GetScore(name)
+		entry.SkipList.Del(name)
+		res = append(res, NewBulkReply(name), NewDoubleReply(score))
+	}
+	db.Touch(key)
+	if max {
+		db.Notify(NotifyZSet, "zpopmax", key)
+	} else {
+		db.Notify(NotifyZSet, "zpopmin", key)
+	}
+	if entry.SkipList.GetCount() == 0 {
+		db.DelEntry(key)
+		db.Notify(NotifyGeneric, "del", key)
+	}
+	return res
+}
+
+type ZPopCmd struct {
+	Max bool // zpopmax
+}
+
+// zpopmin key [count]
+func (z *ZPopCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) != 1 && len(req.Args) != 2 {
+		session.WriteError(req.SeqID, "Invalid ZPop Param")
+		return
+	}
+	count := 1
+	if len(req.Args) == 2 {
+		val, err := strconv.Atoi(req.Args[1])
+		if err != nil || val < 0 {
+			session.WriteError(req.SeqID, "Invalid Count")
+			return
+		}
+		count = val
+	}
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeZSet)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	if entry == nil || count == 0 {
+		session.WriteStrs(req.SeqID, make([]string, 0))
+		return
+	}
+	session.WriteReply(req.SeqID, NewArrayReply(popZSet(db, req.Args[0], entry, count, z.Max)))
+}
+
+//=======================BZPopCmd=====================
+
+type BZPopCmd struct {
+	Max bool // bzpopmax
+}
+
+// bzpopmin key1 key2 timeout  返回 [key member score]
+func (b *BZPopCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) < 2 {
+		session.WriteError(req.SeqID, "Invalid BZPop Param")
+		return
+	}
+	timeout, ok := ParseBlockTimeout(req.Args[len(req.Args)-1])
+	if !ok {
+		session.WriteError(req.SeqID, "timeout is not a float or out of range")
+		return
+	}
+	retry := func(key string) (*Reply, bool) {
+		entry, ok := db.GetTypeEntry(key, TypeZSet)
+		if !ok {
+			return NewErrorReply(MsgWrongType), true
+		}
+		if entry == nil {
+			return nil, false
+		}
+		cmd := CmdZPopMin
+		if b.Max {
+			cmd = CmdZPopMax
+		}
+		items := popZSet(db, key, entry, 1, b.Max)
+		db.Propagate(session, &Req{Cmd: cmd, Args: []string{key}})
+		return NewArrayReply(append([]*Reply{NewBulkReply(key)}, items...)), true
+	}
+	BlockOrServe(db, req, session, req.Args[:len(req.Args)-1], timeout, retry)
+}
+
 //======================ExistsCmd========================
 
 type ExistsCmd struct {
@@ -358,16 +584,22 @@ func (t *TypeCmd) Exec(db *DB, req *Req, session *Session) {
 	}
 	entry := db.GetEntry(req.Args[0])
 	if entry == nil {
-		session.WriteOk(req.SeqID, "none")
+		session.WriteStatus(req.SeqID, "none")
 		return
 	}
 	switch entry.Type {
 	case TypeStr:
-		session.WriteOk(req.SeqID, "string")
+		session.WriteStatus(req.SeqID, "string")
 	case TypeZSet:
-		session.WriteOk(req.SeqID, "zset")
+		session.WriteStatus(req.SeqID, "zset")
+	case TypeHash:
+		session.WriteStatus(req.SeqID, "hash")
+	case TypeList:
+		session.WriteStatus(req.SeqID, "list")
+	case TypeSet:
+		session.WriteStatus(req.SeqID, "set")
 	default:
-		session.WriteOk(req.SeqID, "none")
+		session.WriteStatus(req.SeqID, "none")
 	}
 }
 
@@ -397,10 +629,12 @@ func (d *DelCmd) Exec(db *DB, req *Req, session *Session) {
 		session.WriteError(req.SeqID, "Invalid Del Param")
 		return
 	}
-	if db.GetEntry(req.Args[0]) == nil {
+	// 从节点上到期的 key 只是被隐藏，主节点的 del 仍然需要删除
+	if db.GetEntry(req.Args[0]) == nil && (!session.Master || db.DataMap.Get(req.Args[0]) == nil) {
 		session.WriteNum(req.SeqID, 0)
 	} else {
 		db.DelEntry(req.Args[0])
+		db.Notify(NotifyGeneric, "del", req.Args[0])
 		session.WriteNum(req.SeqID, 1)
 	}
 }
@@ -444,6 +678,8 @@ func (p *PersistCmd) Exec(db *DB, req *Req, session *Session) {
 	}
 	if db.GetEntry(req.Args[0]) != nil {
 		db.RemoveTTL(req.Args[0])
+		db.Touch(req.Args[0])
+		db.Notify(NotifyGeneric, "persist", req.Args[0])
 		session.WriteNum(req.SeqID, 1)
 	} else {
 		session.WriteNum(req.SeqID, 0)
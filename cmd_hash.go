@@ -0,0 +1,495 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// getOrPutHash 写操作使用，不存在就创建
+func getOrPutHash(db *DB, key string) (*Entry, bool) {
+	entry, ok := db.GetTypeEntry(key, TypeHash)
+	if !ok {
+		return nil, false
+	}
+	if entry == nil {
+		entry = &Entry{Type: TypeHash, Hash: NewDict[string]()}
+		db.PutEntry(key, entry)
+	}
+	return entry, true
+}
+
+// delEmptyHash 字段全部删除后 key 也需要删除
+func delEmptyHash(db *DB, key string, entry *Entry) {
+	if entry.Hash.Len() == 0 {
+		db.DelEntry(key)
+		db.Notify(NotifyGeneric, "del", key)
+	}
+}
+
+//=======================HSetCmd========================
+
+type HSetCmd struct {
+}
+
+// hset key field1 val1 field2 val2
+func (h *HSetCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) < 3 || len(req.Args)%2 != 1 {
+		session.WriteError(req.SeqID, "Invalid HSet Param")
+		return
+	}
+	entry, ok := getOrPutHash(db, req.Args[0])
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	db.Touch(req.Args[0])
+	db.Notify(NotifyHash, "hset", req.Args[0])
+	count := 0
+	for i := 1; i < len(req.Args); i += 2 {
+		if entry.Hash.Put(req.Args[i], req.Args[i+1]) {
+			count++
+		}
+	}
+	session.WriteNum(req.SeqID, count)
+}
+
+//=======================HSetNXCmd========================
+
+type HSetNXCmd struct {
+}
+
+// hsetnx key field val
+func (h *HSetNXCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) != 3 {
+		session.WriteError(req.SeqID, "Invalid HSetNX Param")
+		return
+	}
+	entry, ok := getOrPutHash(db, req.Args[0])
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	if _, has := entry.Hash.Get(req.Args[1]); has {
+		session.WriteNum(req.SeqID, 0)
+		return
+	}
+	entry.Hash.Put(req.Args[1], req.Args[2])
+	db.Touch(req.Args[0])
+	db.Notify(NotifyHash, "hset", req.Args[0])
+	session.WriteNum(req.SeqID, 1)
+}
+
+//=======================HGetCmd========================
+
+type HGetCmd struct {
+}
+
+// hget key field
+func (h *HGetCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) != 2 {
+		session.WriteError(req.SeqID, "Invalid HGet Param")
+		return
+	}
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeHash)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	if entry == nil {
+		session.WriteNil(req.SeqID)
+		return
+	}
+	if val, has := entry.Hash.Get(req.Args[1]); has {
+		session.WriteBulk(req.SeqID, val)
+	} else {
+		session.WriteNil(req.SeqID)
+	}
+}
+
+//=======================HMGetCmd========================
+
+type HMGetCmd struct {
+}
+
+// hmget key field1 field2
+func (h *HMGetCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) < 2 {
+		session.WriteError(req.SeqID, "Invalid HMGet Param")
+		return
+	}
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeHash)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	res := make([]*Reply, 0)
+	for _, field := range req.Args[1:] {
+		if entry == nil {
+			res = append(res, NewNilReply())
+		} else if val, has := entry.Hash.Get(field); has {
+			res = append(res, NewBulkReply(val))
+		} else {
+			res = append(res, NewNilReply())
+		}
+	}
+	session.WriteReply(req.SeqID, NewArrayReply(res))
+}
+
+//=======================HDelCmd========================
+
+type HDelCmd struct {
+}
+
+// hdel key field1 field2
+func (h *HDelCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) < 2 {
+		session.WriteError(req.SeqID, "Invalid HDel Param")
+		return
+	}
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeHash)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	if entry == nil {
+		session.WriteNum(req.SeqID, 0)
+		return
+	}
+	count := 0
+	for _, field := range req.Args[1:] {
+		if entry.Hash.Del(field) {
+			count++
+		}
+	}
+	if count > 0 {
+		db.Touch(req.Args[0])
+		db.Notify(NotifyHash, "hdel", req.Args[0])
+		delEmptyHash(db, req.Args[0], entry)
+	}
+	session.WriteNum(req.SeqID, count)
+}
+
+//=======================HExistsCmd========================
+
+type HExistsCmd struct {
+}
+
+// hexists key field
+func (h *HExistsCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) != 2 {
+		session.WriteError(req.SeqID, "Invalid HExists Param")
+		return
+	}
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeHash)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	if entry == nil {
+		session.WriteNum(req.SeqID, 0)
+		return
+	}
+	if _, has := entry.Hash.Get(req.Args[1]); has {
+		session.WriteNum(req.SeqID, 1)
+	} else {
+		session.WriteNum(req.SeqID, 0)
+	}
+}
+
+//=======================HLenCmd========================
+
+type HLenCmd struct {
+}
+
+// hlen key
+func (h *HLenCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) != 1 {
+		session.WriteError(req.SeqID, "Invalid HLen Param")
+		return
+	}
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeHash)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	if entry == nil {
+		session.WriteNum(req.SeqID, 0)
+		return
+	}
+	session.WriteNum(req.SeqID, entry.Hash.Len())
+}
+
+//=======================HKeysCmd========================
+
+type HKeysCmd struct {
+}
+
+// hkeys key
+func (h *HKeysCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) != 1 {
+		session.WriteError(req.SeqID, "Invalid HKeys Param")
+		return
+	}
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeHash)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	res := make([]string, 0)
+	if entry != nil {
+		for field := range entry.Hash.Keys() {
+			res = append(res, field)
+		}
+	}
+	session.WriteStrs(req.SeqID, res)
+}
+
+//=======================HValsCmd========================
+
+type HValsCmd struct {
+}
+
+// hvals key
+func (h *HValsCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) != 1 {
+		session.WriteError(req.SeqID, "Invalid HVals Param")
+		return
+	}
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeHash)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	res := make([]string, 0)
+	if entry != nil {
+		for _, val := range entry.Hash.All() {
+			res = append(res, val)
+		}
+	}
+	session.WriteStrs(req.SeqID, res)
+}
+
+//=======================HGetAllCmd========================
+
+type HGetAllCmd struct {
+}
+
+// hgetall key
+func (h *HGetAllCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) != 1 {
+		session.WriteError(req.SeqID, "Invalid HGetAll Param")
+		return
+	}
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeHash)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	res := make([]*Reply, 0)
+	if entry != nil {
+		for field, val := range entry.Hash.All() {
+			res = append(res, NewBulkReply(field), NewBulkReply(val))
+		}
+	}
+	session.WriteReply(req.SeqID, NewMapReply(res))
+}
+
+//=======================HIncrByCmd========================
+
+type HIncrByCmd struct {
+}
+
+// hincrby key field num
+func (h *HIncrByCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) != 3 {
+		session.WriteError(req.SeqID, "Invalid HIncrBy Param")
+		return
+	}
+	num, err := strconv.ParseInt(req.Args[2], 10, 64)
+	if err != nil {
+		session.WriteError(req.SeqID, "HIncrBy Num Err")
+		return
+	}
+	entry, ok := getOrPutHash(db, req.Args[0])
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	old := int64(0)
+	if val, has := entry.Hash.Get(req.Args[1]); has {
+		old, err = strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			session.WriteError(req.SeqID, "hash value is not an integer")
+			return
+		}
+	}
+	if (num > 0 && old > math.MaxInt64-num) || (num < 0 && old < math.MinInt64-num) {
+		session.WriteError(req.SeqID, "increment or decrement would overflow")
+		return
+	}
+	entry.Hash.Put(req.Args[1], strconv.FormatInt(old+num, 10))
+	db.Touch(req.Args[0])
+	db.Notify(NotifyHash, "hincrby", req.Args[0])
+	session.WriteNum(req.SeqID, int(old+num))
+}
+
+//=======================HIncrByFloatCmd========================
+
+type HIncrByFloatCmd struct {
+}
+
+// hincrbyfloat key field num
+func (h *HIncrByFloatCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) != 3 {
+		session.WriteError(req.SeqID, "Invalid HIncrByFloat Param")
+		return
+	}
+	num, err := strconv.ParseFloat(req.Args[2], 64)
+	if err != nil || math.IsNaN(num) || math.IsInf(num, 0) {
+		session.WriteError(req.SeqID, "HIncrByFloat Num Err")
+		return
+	}
+	entry, ok := getOrPutHash(db, req.Args[0])
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	old := float64(0)
+	if val, has := entry.Hash.Get(req.Args[1]); has {
+		old, err = strconv.ParseFloat(val, 64)
+		if err != nil {
+			session.WriteError(req.SeqID, "hash value is not a float")
+			return
+		}
+	}
+	res := old + num
+	if math.IsNaN(res) || math.IsInf(res, 0) {
+		session.WriteError(req.SeqID, "increment would produce NaN or Infinity")
+		return
+	}
+	val := strconv.FormatFloat(res, 'f', -1, 64)
+	entry.Hash.Put(req.Args[1], val)
+	db.Touch(req.Args[0])
+	db.Notify(NotifyHash, "hincrbyfloat", req.Args[0])
+	session.WriteBulk(req.SeqID, val)
+}
+
+//=======================HStrLenCmd========================
+
+type HStrLenCmd struct {
+}
+
+// hstrlen key field
+func (h *HStrLenCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) != 2 {
+		session.WriteError(req.SeqID, "Invalid HStrLen Param")
+		return
+	}
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeHash)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	if entry == nil {
+		session.WriteNum(req.SeqID, 0)
+		return
+	}
+	val, _ := entry.Hash.Get(req.Args[1])
+	session.WriteNum(req.SeqID, len(val))
+}
+
+//=======================HRandFieldCmd========================
+
+type HRandFieldCmd struct {
+}
+
+// hrandfield key [count [withvalues]]  count 为负数时允许重复
+func (h *HRandFieldCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) < 1 || len(req.Args) > 3 {
+		session.WriteError(req.SeqID, "Invalid HRandField Param")
+		return
+	}
+	withValues := len(req.Args) == 3
+	if withValues && strings.ToUpper(req.Args[2]) != "WITHVALUES" {
+		session.WriteError(req.SeqID, "Invalid HRandField Param")
+		return
+	}
+	count := int64(1)
+	if len(req.Args) > 1 {
+		var err error
+		count, err = strconv.ParseInt(req.Args[1], 10, 64)
+		if err != nil {
+			session.WriteError(req.SeqID, "Invalid HRandField Count")
+			return
+		}
+		if count < -MaxRandCount {
+			session.WriteError(req.SeqID, MsgOutOfRange)
+			return
+		}
+	}
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeHash)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	if len(req.Args) == 1 { // 不指定数量只返回一个字段
+		if entry == nil {
+			session.WriteNil(req.SeqID)
+		} else {
+			session.WriteBulk(req.SeqID, RandKeys(entry.Hash.Keys(), 1)[0])
+		}
+		return
+	}
+	fields := make([]string, 0)
+	if entry != nil {
+		fields = RandKeys(entry.Hash.Keys(), count)
+	}
+	if !withValues {
+		session.WriteStrs(req.SeqID, fields)
+		return
+	}
+	items := make([]*Reply, 0)
+	for _, field := range fields {
+		val, _ := entry.Hash.Get(field)
+		if session.Proto == ProtoRESP3 {
+			items = append(items, NewStrsReply([]string{field, val}))
+		} else {
+			items = append(items, NewBulkReply(field), NewBulkReply(val))
+		}
+	}
+	session.WriteReply(req.SeqID, NewArrayReply(items))
+}
+
+//=======================HScanCmd========================
+
+type HScanCmd struct {
+}
+
+// hscan key cursor [match pattern] [count num]
+func (h *HScanCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) < 2 {
+		session.WriteError(req.SeqID, "Invalid HScan Param")
+		return
+	}
+	cursor, pattern, count, ok := ParseScanArgs(req.Args[1:])
+	if !ok {
+		session.WriteError(req.SeqID, "Invalid HScan Param")
+		return
+	}
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeHash)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	items := make([]string, 0)
+	next := uint64(0)
+	if entry != nil {
+		next = entry.Hash.Scan(cursor, count, func(field string, val string) {
+			if len(pattern) == 0 || MatchGlob(pattern, field) {
+				items = append(items, field, val)
+			}
+		})
+	}
+	session.WriteScan(req.SeqID, next, items)
+}
@@ -0,0 +1,608 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// getOrPutList 写操作使用，不存在就创建
+func getOrPutList(db *DB, key string) (*Entry, bool) {
+	entry, ok := db.GetTypeEntry(key, TypeList)
+	if !ok {
+		return nil, false
+	}
+	if entry == nil {
+		entry = &Entry{Type: TypeList, List: NewQuickList()}
+		db.PutEntry(key, entry)
+	}
+	return entry, true
+}
+
+// delEmptyList 元素全部弹出后 key 也需要删除
+func delEmptyList(db *DB, key string, entry *Entry) {
+	if entry.List.GetCount() == 0 {
+		db.DelEntry(key)
+		db.Notify(NotifyGeneric, "del", key)
+	}
+}
+
+// listEvent 键空间通知的事件名，例如 lpush rpop
+func listEvent(op string, tail bool) string {
+	if tail {
+		return "r" + op
+	}
+	return "l" + op
+}
+
+// normalizeRange 与 redis 一致处理负数下标与越界，返回 start > end 表示空区间
+func normalizeRange(start int, end int, count int) (int, int) {
+	if start < 0 {
+		start += count
+	}
+	if end < 0 {
+		end += count
+	}
+	start = max(start, 0)
+	end = min(end, count-1)
+	return start, end
+}
+
+//=======================LPushCmd========================
+
+type LPushCmd struct {
+	Tail   bool // rpush
+	Exists bool // lpushx rpushx 只有存在才写入
+}
+
+// lpush key val1 val2
+func (l *LPushCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) < 2 {
+		session.WriteError(req.SeqID, "Invalid Push Param")
+		return
+	}
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeList)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	if entry == nil && l.Exists {
+		session.WriteNum(req.SeqID, 0)
+		return
+	}
+	entry, _ = getOrPutList(db, req.Args[0])
+	for _, val := range req.Args[1:] {
+		if l.Tail {
+			entry.List.PushTail(val)
+		} else {
+			entry.List.PushHead(val)
+		}
+	}
+	db.Touch(req.Args[0])
+	db.Notify(NotifyList, listEvent("push", l.Tail), req.Args[0])
+	db.SignalReady(req.Args[0])
+	session.WriteNum(req.SeqID, entry.List.GetCount())
+}
+
+//=======================LPopCmd========================
+
+type LPopCmd struct {
+	Tail bool // rpop
+}
+
+// lpop key [count]
+func (l *LPopCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) != 1 && len(req.Args) != 2 {
+		session.WriteError(req.SeqID, "Invalid Pop Param")
+		return
+	}
+	count := int64(1)
+	if len(req.Args) == 2 {
+		var err error
+		count, err = strconv.ParseInt(req.Args[1], 10, 64)
+		if err != nil || count < 0 {
+			session.WriteError(req.SeqID, "Invalid Pop Count")
+			return
+		}
+	}
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeList)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	if entry == nil {
+		session.WriteNil(req.SeqID)
+		return
+	}
+	res := make([]string, 0)
+	for int64(len(res)) < count {
+		var val string
+		if l.Tail {
+			val, ok = entry.List.PopTail()
+		} else {
+			val, ok = entry.List.PopHead()
+		}
+		if !ok {
+			break
+		}
+		res = append(res, val)
+	}
+	if len(res) > 0 {
+		db.Touch(req.Args[0])
+		db.Notify(NotifyList, listEvent("pop", l.Tail), req.Args[0])
+		delEmptyList(db, req.Args[0], entry)
+	}
+	if len(req.Args) == 2 { // 指定了数量返回数组
+		session.WriteStrs(req.SeqID, res)
+	} else {
+		session.WriteBulk(req.SeqID, res[0])
+	}
+}
+
+//=======================LRangeCmd========================
+
+type LRangeCmd struct {
+}
+
+// lrange key 0 -1
+func (l *LRangeCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) != 3 {
+		session.WriteError(req.SeqID, "Invalid LRange Param")
+		return
+	}
+	start, err := strconv.ParseInt(req.Args[1], 10, 64)
+	if err != nil {
+		session.WriteError(req.SeqID, "Invalid Start")
+		return
+	}
+	end, err := strconv.ParseInt(req.Args[2], 10, 64)
+	if err != nil {
+		session.WriteError(req.SeqID, "Invalid End")
+		return
+	}
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeList)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	if entry == nil {
+		session.WriteStrs(req.SeqID, make([]string, 0))
+		return
+	}
+	s, e := normalizeRange(int(start), int(end), entry.List.GetCount())
+	session.WriteStrs(req.SeqID, entry.List.Range(s, e))
+}
+
+//=======================LIndexCmd========================
+
+type LIndexCmd struct {
+}
+
+// lindex key idx
+func (l *LIndexCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) != 2 {
+		session.WriteError(req.SeqID, "Invalid LIndex Param")
+		return
+	}
+	idx, err := strconv.ParseInt(req.Args[1], 10, 64)
+	if err != nil {
+		session.WriteError(req.SeqID, "Invalid Index")
+		return
+	}
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeList)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	if entry == nil {
+		session.WriteNil(req.SeqID)
+		return
+	}
+	if idx < 0 {
+		idx += int64(entry.List.GetCount())
+	}
+	if val, has := entry.List.Get(int(idx)); has {
+		session.WriteBulk(req.SeqID, val)
+	} else {
+		session.WriteNil(req.SeqID)
+	}
+}
+
+//=======================LSetCmd========================
+
+type LSetCmd struct {
+}
+
+// lset key idx val
+func (l *LSetCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) != 3 {
+		session.WriteError(req.SeqID, "Invalid LSet Param")
+		return
+	}
+	idx, err := strconv.ParseInt(req.Args[1], 10, 64)
+	if err != nil {
+		session.WriteError(req.SeqID, "Invalid Index")
+		return
+	}
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeList)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	if entry == nil {
+		session.WriteError(req.SeqID, "no such key")
+		return
+	}
+	if idx < 0 {
+		idx += int64(entry.List.GetCount())
+	}
+	if !entry.List.Set(int(idx), req.Args[2]) {
+		session.WriteError(req.SeqID, "index out of range")
+		return
+	}
+	db.Touch(req.Args[0])
+	db.Notify(NotifyList, "lset", req.Args[0])
+	session.WriteOk(req.SeqID)
+}
+
+//=======================LInsertCmd========================
+
+type LInsertCmd struct {
+}
+
+// linsert key before|after pivot val
+func (l *LInsertCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) != 4 {
+		session.WriteError(req.SeqID, "Invalid LInsert Param")
+		return
+	}
+	where := strings.ToUpper(req.Args[1])
+	if where != "BEFORE" && where != "AFTER" {
+		session.WriteError(req.SeqID, "Invalid LInsert Param")
+		return
+	}
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeList)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	if entry == nil {
+		session.WriteNum(req.SeqID, 0)
+		return
+	}
+	pos := -1
+	entry.List.ForEach(func(idx int, item string) bool {
+		if item == req.Args[2] {
+			pos = idx
+			return false
+		}
+		return true
+	})
+	if pos < 0 {
+		session.WriteNum(req.SeqID, -1)
+		return
+	}
+	if where == "AFTER" {
+		pos++
+	}
+	entry.List.Insert(pos, req.Args[3])
+	db.Touch(req.Args[0])
+	db.Notify(NotifyList, "linsert", req.Args[0])
+	session.WriteNum(req.SeqID, entry.List.GetCount())
+}
+
+//=======================LLenCmd========================
+
+type LLenCmd struct {
+}
+
+// llen key
+func (l *LLenCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) != 1 {
+		session.WriteError(req.SeqID, "Invalid LLen Param")
+		return
+	}
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeList)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	if entry == nil {
+		session.WriteNum(req.SeqID, 0)
+		return
+	}
+	session.WriteNum(req.SeqID, entry.List.GetCount())
+}
+
+//=======================LRemCmd========================
+
+type LRemCmd struct {
+}
+
+// lrem key count val  count > 0 从头部开始删除 count < 0 从尾部开始删除 0 删除全部
+func (l *LRemCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) != 3 {
+		session.WriteError(req.SeqID, "Invalid LRem Param")
+		return
+	}
+	count, err := strconv.ParseInt(req.Args[1], 10, 64)
+	if err != nil {
+		session.WriteError(req.SeqID, "Invalid LRem Count")
+		return
+	}
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeList)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	if entry == nil {
+		session.WriteNum(req.SeqID, 0)
+		return
+	}
+	limit := int(count)
+	if limit < 0 {
+		limit = -limit
+	}
+	res := entry.List.RemoveIf(func(item string) bool {
+		return item == req.Args[2]
+	}, limit, count < 0)
+	if res > 0 {
+		db.Touch(req.Args[0])
+		db.Notify(NotifyList, "lrem", req.Args[0])
+		delEmptyList(db, req.Args[0], entry)
+	}
+	session.WriteNum(req.SeqID, res)
+}
+
+//=======================LTrimCmd========================
+
+type LTrimCmd struct {
+}
+
+// ltrim key start end
+func (l *LTrimCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) != 3 {
+		session.WriteError(req.SeqID, "Invalid LTrim Param")
+		return
+	}
+	start, err := strconv.ParseInt(req.Args[1], 10, 64)
+	if err != nil {
+		session.WriteError(req.SeqID, "Invalid Start")
+		return
+	}
+	end, err := strconv.ParseInt(req.Args[2], 10, 64)
+	if err != nil {
+		session.WriteError(req.SeqID, "Invalid End")
+		return
+	}
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeList)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	if entry == nil {
+		session.WriteOk(req.SeqID)
+		return
+	}
+	s, e := normalizeRange(int(start), int(end), entry.List.GetCount())
+	entry.List.Trim(s, e)
+	db.Touch(req.Args[0])
+	db.Notify(NotifyList, "ltrim", req.Args[0])
+	delEmptyList(db, req.Args[0], entry)
+	session.WriteOk(req.SeqID)
+}
+
+//=======================LPosCmd========================
+
+type LPosCmd struct {
+}
+
+// lpos key val [rank num] [count num] [maxlen num]
+func (l *LPosCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) < 2 || len(req.Args)%2 != 0 {
+		session.WriteError(req.SeqID, "Invalid LPos Param")
+		return
+	}
+	rank, count, maxLen := int64(1), int64(-1), int64(0)
+	for i := 2; i < len(req.Args); i += 2 {
+		num, err := strconv.ParseInt(req.Args[i+1], 10, 64)
+		if err != nil {
+			session.WriteError(req.SeqID, "Invalid LPos Param")
+			return
+		}
+		switch strings.ToUpper(req.Args[i]) {
+		case "RANK":
+			rank = num
+		case "COUNT":
+			count = num
+		case "MAXLEN":
+			maxLen = num
+		default:
+			session.WriteError(req.SeqID, "Invalid LPos Param")
+			return
+		}
+	}
+	if rank == 0 || count < -1 || maxLen < 0 {
+		session.WriteError(req.SeqID, "Invalid LPos Param")
+		return
+	}
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeList)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	res := make([]*Reply, 0)
+	if entry != nil {
+		skip, checked := rank, int64(0)
+		if skip < 0 {
+			skip = -skip
+		}
+		callback := func(idx int, item string) bool {
+			checked++
+			if item == req.Args[1] {
+				skip--
+				if skip <= 0 { // 跳过 rank-1 个匹配的
+					res = append(res, NewIntReply(int64(idx)))
+				}
+			}
+			return (maxLen == 0 || checked < maxLen) && (count == 0 || int64(len(res)) < max(count, 1))
+		}
+		if rank < 0 {
+			entry.List.ForEachReverse(callback)
+		} else {
+			entry.List.ForEach(callback)
+		}
+	}
+	if count >= 0 { // 指定了 count 返回数组
+		session.WriteReply(req.SeqID, NewArrayReply(res))
+	} else if len(res) > 0 {
+		session.WriteReply(req.SeqID, res[0])
+	} else {
+		session.WriteNil(req.SeqID)
+	}
+}
+
+//=======================LMoveCmd========================
+
+type LMoveCmd struct {
+}
+
+// lmove src dst left|right left|right
+func (l *LMoveCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) != 4 {
+		session.WriteError(req.SeqID, "Invalid LMove Param")
+		return
+	}
+	from, to := strings.ToUpper(req.Args[2]), strings.ToUpper(req.Args[3])
+	if (from != "LEFT" && from != "RIGHT") || (to != "LEFT" && to != "RIGHT") {
+		session.WriteError(req.SeqID, "Invalid LMove Param")
+		return
+	}
+	session.WriteReply(req.SeqID, moveList(db, req.Args[0], req.Args[1], from, to))
+}
+
+// moveList lmove 与 blmove 共用，src 不存在返回 nil
+func moveList(db *DB, srcKey string, dstKey string, from string, to string) *Reply {
+	src, ok := db.GetTypeEntry(srcKey, TypeList)
+	if !ok {
+		return NewErrorReply(MsgWrongType)
+	}
+	if _, ok = db.GetTypeEntry(dstKey, TypeList); !ok { // 先检查再弹出，避免数据丢失
+		return NewErrorReply(MsgWrongType)
+	}
+	if src == nil {
+		return NewNilReply()
+	}
+	var val string
+	if from == "LEFT" {
+		val, _ = src.List.PopHead()
+	} else {
+		val, _ = src.List.PopTail()
+	}
+	// src 与 dst 相同时是同一个 entry，先写入再判断是否为空
+	dst, _ := getOrPutList(db, dstKey)
+	if to == "LEFT" {
+		dst.List.PushHead(val)
+	} else {
+		dst.List.PushTail(val)
+	}
+	db.Touch(srcKey)
+	db.Touch(dstKey)
+	db.Notify(NotifyList, listEvent("pop", from != "LEFT"), srcKey)
+	db.Notify(NotifyList, listEvent("push", to != "LEFT"), dstKey)
+	delEmptyList(db, srcKey, src)
+	db.SignalReady(dstKey)
+	return NewBulkReply(val)
+}
+
+//=======================BLPopCmd========================
+
+type BLPopCmd struct {
+	Tail bool // brpop
+}
+
+// blpop key1 key2 timeout  按顺序检查 key 都没有数据就阻塞
+func (b *BLPopCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) < 2 {
+		session.WriteError(req.SeqID, "Invalid BPop Param")
+		return
+	}
+	timeout, ok := ParseBlockTimeout(req.Args[len(req.Args)-1])
+	if !ok {
+		session.WriteError(req.SeqID, "timeout is not a float or out of range")
+		return
+	}
+	keys := req.Args[:len(req.Args)-1]
+	retry := func(key string) (*Reply, bool) {
+		entry, ok := db.GetTypeEntry(key, TypeList)
+		if !ok {
+			return NewErrorReply(MsgWrongType), true
+		}
+		if entry == nil {
+			return nil, false
+		}
+		var val string
+		cmd := CmdLPop
+		if b.Tail {
+			val, _ = entry.List.PopTail()
+			cmd = CmdRPop
+		} else {
+			val, _ = entry.List.PopHead()
+		}
+		db.Touch(key)
+		db.Notify(NotifyList, strings.ToLower(cmd), key)
+		delEmptyList(db, key, entry)
+		db.Propagate(session, &Req{Cmd: cmd, Args: []string{key}}) // 以非阻塞的形式记录
+		return NewStrsReply([]string{key, val}), true
+	}
+	BlockOrServe(db, req, session, keys, timeout, retry)
+}
+
+// BlockOrServe 有数据直接返回，否则阻塞，事务中不阻塞直接返回 nil
+func BlockOrServe(db *DB, req *Req, session *Session, keys []string, timeout time.Duration, retry func(string) (*Reply, bool)) {
+	for _, key := range keys {
+		if reply, ok := retry(key); ok {
+			session.WriteReply(req.SeqID, reply)
+			return
+		}
+	}
+	if session.InExec {
+		session.WriteNil(req.SeqID)
+		return
+	}
+	db.Block(session, req, keys, timeout, retry)
+}
+
+//=======================BLMoveCmd========================
+
+type BLMoveCmd struct {
+}
+
+// blmove src dst left|right left|right timeout
+func (b *BLMoveCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) != 5 {
+		session.WriteError(req.SeqID, "Invalid BLMove Param")
+		return
+	}
+	from, to := strings.ToUpper(req.Args[2]), strings.ToUpper(req.Args[3])
+	if (from != "LEFT" && from != "RIGHT") || (to != "LEFT" && to != "RIGHT") {
+		session.WriteError(req.SeqID, "Invalid BLMove Param")
+		return
+	}
+	timeout, ok := ParseBlockTimeout(req.Args[4])
+	if !ok {
+		session.WriteError(req.SeqID, "timeout is not a float or out of range")
+		return
+	}
+	retry := func(key string) (*Reply, bool) {
+		reply := moveList(db, req.Args[0], req.Args[1], from, to)
+		if reply.Type == ReplyNil {
+			return nil, false
+		}
+		if reply.Type != ReplyError {
+			db.Propagate(session, &Req{Cmd: CmdLMove, Args: req.Args[:4]})
+		}
+		return reply, true
+	}
+	BlockOrServe(db, req, session, req.Args[:1], timeout, retry)
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// getOrPutSet 写操作使用，不存在就创建
+func getOrPutSet(db *DB, key string) (*Entry, bool) {
+	entry, ok := db.GetTypeEntry(key, TypeSet)
+	if !ok {
+		return nil, false
+	}
+	if entry == nil {
+		entry = &Entry{Type: TypeSet, Set: NewSet()}
+		db.PutEntry(key, entry)
+	}
+	return entry, true
+}
+
+// delEmptySet 元素全部删除后 key 也需要删除
+func delEmptySet(db *DB, key string, entry *Entry) {
+	if entry.Set.GetCount() == 0 {
+		db.DelEntry(key)
+		db.Notify(NotifyGeneric, "del", key)
+	}
+}
+
+// getSets 集合运算使用，不存在的 key 对应 nil，任意一个类型不对 ok 为 false
+func getSets(db *DB, keys []string) ([]*Set, bool) {
+	res := make([]*Set, 0, len(keys))
+	for _, key := range keys {
+		entry, ok := db.GetTypeEntry(key, TypeSet)
+		if !ok {
+			return nil, false
+		}
+		if entry == nil {
+			res = append(res, nil)
+		} else {
+			res = append(res, entry.Set)
+		}
+	}
+	return res, true
+}
+
+// interSets 从最小的集合开始遍历，limit <= 0 不限制数量
+func interSets(sets []*Set, limit int) *Set {
+	res := NewSet()
+	for _, set := range sets {
+		if set == nil { // 任意一个为空交集为空
+			return res
+		}
+	}
+	minIdx := 0
+	for i, set := range sets {
+		if set.GetCount() < sets[minIdx].GetCount() {
+			minIdx = i
+		}
+	}
+	for member := range sets[minIdx].All() {
+		has := true
+		for i, set := range sets {
+			if i != minIdx && !set.Contains(member) {
+				has = false
+				break
+			}
+		}
+		if has {
+			res.Add(member)
+			if limit > 0 && res.GetCount() >= limit {
+				break
+			}
+		}
+	}
+	return res
+}
+
+func unionSets(sets []*Set) *Set {
+	res := NewSet()
+	for _, set := range sets {
+		if set == nil {
+			continue
+		}
+		for member := range set.All() {
+			res.Add(member)
+		}
+	}
+	return res
+}
+
+// diffSets 第一个集合减去其余的集合
+func diffSets(sets []*Set) *Set {
+	res := NewSet()
+	if sets[0] == nil {
+		return res
+	}
+	for member := range sets[0].All() {
+		has := false
+		for _, set := range sets[1:] {
+			if set != nil && set.Contains(member) {
+				has = true
+				break
+			}
+		}
+		if !has {
+			res.Add(member)
+		}
+	}
+	return res
+}
+
+// storeSet 覆盖写入 dest，不论原来是什么类型，结果为空时删除 dest，event 为键空间通知的事件名
+func storeSet(db *DB, key string, set *Set, event string) {
+	old := db.GetEntry(key)
+	if set.GetCount() == 0 {
+		if old != nil {
+			db.DelEntry(key)
+			db.Notify(NotifyGeneric, "del", key)
+		}
+		return
+	}
+	db.PutEntry(key, &Entry{Type: TypeSet, Set: set})
+	db.Notify(NotifySet, event, key)
+}
+
+func newMembersReply(members []string) *Reply {
+	items := make([]*Reply, 0, len(members))
+	for _, member := range members {
+		items = append(items, NewBulkReply(member))
+	}
+	return NewSetReply(items)
+}
+
+// interCardKeys sintercard numkeys key1 key2 [limit num]
+func interCardKeys(args []string) []string {
+	if len(args) == 0 {
+		return nil
+	}
+	num, err := strconv.Atoi(args[0])
+	if err != nil || num <= 0 {
+		return nil
+	}
+	return args[1:min(1+num, len(args))]
+}
+
+//=======================SAddCmd========================
+
+type SAddCmd struct {
+}
+
+// sadd key member1 member2
+func (s *SAddCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) < 2 {
+		session.WriteError(req.SeqID, "Invalid SAdd Param")
+		return
+	}
+	entry, ok := getOrPutSet(db, req.Args[0])
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	count := 0
+	for _, member := range req.Args[1:] {
+		if entry.Set.Add(member) {
+			count++
+		}
+	}
+	if count > 0 {
+		db.Touch(req.Args[0])
+		db.Notify(NotifySet, "sadd", req.Args[0])
+	}
+	session.WriteNum(req.SeqID, count)
+}
+
+//=======================SRemCmd========================
+
+type SRemCmd struct {
+}
+
+// srem key member1 member2
+func (s *SRemCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) < 2 {
+		session.WriteError(req.SeqID, "Invalid SRem Param")
+		return
+	}
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeSet)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	if entry == nil {
+		session.WriteNum(req.SeqID, 0)
+		return
+	}
+	count := 0
+	for _, member := range req.Args[1:] {
+		if entry.Set.Remove(member) {
+			count++
+		}
+	}
+	if count > 0 {
+		db.Touch(req.Args[0])
+		db.Notify(NotifySet, "srem", req.Args[0])
+		delEmptySet(db, req.Args[0], entry)
+	}
+	session.WriteNum(req.SeqID, count)
+}
+
+//=======================SIsMemberCmd========================
+
+type SIsMemberCmd struct {
+}
+
+// sismember key member
+func (s *SIsMemberCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) != 2 {
+		session.WriteError(req.SeqID, "Invalid SIsMember Param")
+		return
+	}
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeSet)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	if entry != nil && entry.Set.Contains(req.Args[1]) {
+		session.WriteNum(req.SeqID, 1)
+	} else {
+		session.WriteNum(req.SeqID, 0)
+	}
+}
+
+//=======================SMIsMemberCmd========================
+
+type SMIsMemberCmd struct {
+}
+
+// smismember key member1 member2
+func (s *SMIsMemberCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) < 2 {
+		session.WriteError(req.SeqID, "Invalid SMIsMember Param")
+		return
+	}
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeSet)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	res := make([]*Reply, 0)
+	for _, member := range req.Args[1:] {
+		if entry != nil && entry.Set.Contains(member) {
+			res = append(res, NewIntReply(1))
+		} else {
+			res = append(res, NewIntReply(0))
+		}
+	}
+	session.WriteReply(req.SeqID, NewArrayReply(res))
+}
+
+//=======================SMembersCmd========================
+
+type SMembersCmd struct {
+}
+
+// smembers key
+func (s *SMembersCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) != 1 {
+		session.WriteError(req.SeqID, "Invalid SMembers Param")
+		return
+	}
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeSet)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	members := make([]string, 0)
+	if entry != nil {
+		members = entry.Set.Members()
+	}
+	session.WriteReply(req.SeqID, newMembersReply(members))
+}
+
+//=======================SCardCmd========================
+
+type SCardCmd struct {
+}
+
+// scard key
+func (s *SCardCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) != 1 {
+		session.WriteError(req.SeqID, "Invalid SCard Param")
+		return
+	}
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeSet)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	if entry == nil {
+		session.WriteNum(req.SeqID, 0)
+		return
+	}
+	session.WriteNum(req.SeqID, entry.Set.GetCount())
+}
+
+//=======================SPopCmd========================
+
+type SPopCmd struct {
+}
+
+// spop key [count]  结果是随机的，aof 中记录为 srem 保证重放一致
+func (s *SPopCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) != 1 && len(req.Args) != 2 {
+		session.WriteError(req.SeqID, "Invalid SPop Param")
+		return
+	}
+	count := int64(1)
+	if len(req.Args) == 2 {
+		val, err := strconv.ParseInt(req.Args[1], 10, 64)
+		if err != nil || val < 0 {
+			session.WriteError(req.SeqID, "Invalid Count")
+			return
+		}
+		count = val
+	}
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeSet)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	members := make([]string, 0)
+	if entry != nil {
+		members = RandItems(entry.Set.Members(), count)
+		for _, member := range members {
+			entry.Set.Remove(member)
+		}
+		if len(members) > 0 {
+			db.Touch(req.Args[0])
+			db.Notify(NotifySet, "spop", req.Args[0])
+			delEmptySet(db, req.Args[0], entry)
+			db.Propagate(session, &Req{Cmd: CmdSRem, Args: append([]string{req.Args[0]}, members...)})
+		}
+	}
+	if len(req.Args) == 2 {
+		session.WriteReply(req.SeqID, newMembersReply(members))
+	} else if len(members) > 0 {
+		session.WriteBulk(req.SeqID, members[0])
+	} else {
+		session.WriteNil(req.SeqID)
+	}
+}
+
+//=======================SRandMemberCmd========================
+
+type SRandMemberCmd struct {
+}
+
+// srandmember key [count]  count 为负数时允许重复
+func (s *SRandMemberCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) != 1 && len(req.Args) != 2 {
+		session.WriteError(req.SeqID, "Invalid SRandMember Param")
+		return
+	}
+	count := int64(1)
+	if len(req.Args) == 2 {
+		val, err := strconv.ParseInt(req.Args[1], 10, 64)
+		if err != nil {
+			session.WriteError(req.SeqID, "Invalid Count")
+			return
+		}
+		if val < -MaxRandCount {
+			session.WriteError(req.SeqID, MsgOutOfRange)
+			return
+		}
+		count = val
+	}
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeSet)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	members := make([]string, 0)
+	if entry != nil {
+		members = RandItems(entry.Set.Members(), count)
+	}
+	if len(req.Args) == 2 {
+		session.WriteStrs(req.SeqID, members)
+	} else if len(members) > 0 {
+		session.WriteBulk(req.SeqID, members[0])
+	} else {
+		session.WriteNil(req.SeqID)
+	}
+}
+
+//=======================SMoveCmd========================
+
+type SMoveCmd struct {
+}
+
+// smove src dst member
+func (s *SMoveCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) != 3 {
+		session.WriteError(req.SeqID, "Invalid SMove Param")
+		return
+	}
+	src, ok := db.GetTypeEntry(req.Args[0], TypeSet)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	if _, ok = db.GetTypeEntry(req.Args[1], TypeSet); !ok { // 先检查再移除，避免数据丢失
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	if src == nil || !src.Set.Remove(req.Args[2]) {
+		session.WriteNum(req.SeqID, 0)
+		return
+	}
+	// src 与 dst 相同时是同一个 entry，先写入再判断是否为空
+	dst, _ := getOrPutSet(db, req.Args[1])
+	dst.Set.Add(req.Args[2])
+	db.Touch(req.Args[0])
+	db.Touch(req.Args[1])
+	db.Notify(NotifySet, "srem", req.Args[0])
+	db.Notify(NotifySet, "sadd", req.Args[1])
+	delEmptySet(db, req.Args[0], src)
+	session.WriteNum(req.SeqID, 1)
+}
+
+//=======================SOpCmd========================
+
+const (
+	SetOpInter = iota
+	SetOpUnion
+	SetOpDiff
+)
+
+// SOpCmd sinter sunion sdiff 以及对应的 store 版本
+type SOpCmd struct {
+	Op    int
+	Store bool
+}
+
+// sinter key1 key2  sinterstore dest key1 key2
+func (s *SOpCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) < 1 || (s.Store && len(req.Args) < 2) {
+		session.WriteError(req.SeqID, "Invalid SOp Param")
+		return
+	}
+	keys := req.Args
+	if s.Store {
+		keys = req.Args[1:]
+	}
+	sets, ok := getSets(db, keys)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	var res *Set
+	switch s.Op {
+	case SetOpInter:
+		res = interSets(sets, 0)
+	case SetOpUnion:
+		res = unionSets(sets)
+	default:
+		res = diffSets(sets)
+	}
+	if s.Store {
+		storeSet(db, req.Args[0], res, strings.ToLower(req.Cmd))
+		session.WriteNum(req.SeqID, res.GetCount())
+		return
+	}
+	session.WriteReply(req.SeqID, newMembersReply(res.Members()))
+}
+
+//=======================SInterCardCmd========================
+
+type SInterCardCmd struct {
+}
+
+// sintercard numkeys key1 key2 [limit num]
+func (s *SInterCardCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) < 2 {
+		session.WriteError(req.SeqID, "Invalid SInterCard Param")
+		return
+	}
+	num, err := strconv.Atoi(req.Args[0])
+	if err != nil || num <= 0 || num > len(req.Args)-1 {
+		session.WriteError(req.SeqID, "numkeys should be greater than 0")
+		return
+	}
+	limit := 0
+	rest := req.Args[1+num:]
+	if len(rest) > 0 {
+		if len(rest) != 2 || strings.ToUpper(rest[0]) != "LIMIT" {
+			session.WriteError(req.SeqID, "Invalid SInterCard Param")
+			return
+		}
+		limit, err = strconv.Atoi(rest[1])
+		if err != nil || limit < 0 {
+			session.WriteError(req.SeqID, "LIMIT can't be negative")
+			return
+		}
+	}
+	sets, ok := getSets(db, req.Args[1:1+num])
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	session.WriteNum(req.SeqID, interSets(sets, limit).GetCount())
+}
+
+//=======================SScanCmd========================
+
+type SScanCmd struct {
+}
+
+// sscan key cursor [match pattern] [count num]
+func (s *SScanCmd) Exec(db *DB, req *Req, session *Session) {
+	if len(req.Args) < 2 {
+		session.WriteError(req.SeqID, "Invalid SScan Param")
+		return
+	}
+	cursor, pattern, count, ok := ParseScanArgs(req.Args[1:])
+	if !ok {
+		session.WriteError(req.SeqID, "Invalid SScan Param")
+		return
+	}
+	entry, ok := db.GetTypeEntry(req.Args[0], TypeSet)
+	if !ok {
+		session.WriteError(req.SeqID, MsgWrongType)
+		return
+	}
+	items := make([]string, 0)
+	next := uint64(0)
+	if entry != nil {
+		next = entry.Set.Scan(cursor, count, func(member string) {
+			if len(pattern) == 0 || MatchGlob(pattern, member) {
+				items = append(items, member)
+			}
+		})
+	}
+	session.WriteScan(req.SeqID, next, items)
+}
@@ -6,15 +6,42 @@ import (
 )
 
 type Conf struct {
-	Ip         string        `json:"ip"`
-	Port       int           `json:"port"`
-	Peers      []interface{} `json:"peers"`
-	Dir        string        `json:"dir"`
-	Passwd     string        `json:"passwd"`
-	MaxDB      int           `json:"max_db"`
-	ShardCount int           `json:"shard_count"`
-	AOFFile    string        `json:"aof_file"`
-	AOFFsync   string        `json:"aof_fsync"`
+	Ip         string   `json:"ip"`
+	Port       int      `json:"port"`
+	Peers      []string `json:"peers"` // 集群的全部节点 ip:port，需要包含自己，为空时不开启集群
+	Dir        string   `json:"dir"`
+	Passwd     string   `json:"passwd"`
+	MaxDB      int      `json:"max_db"`
+	ShardCount int      `json:"shard_count"`
+	AOFFile    string   `json:"aof_file"`
+	AOFFsync   string   `json:"aof_fsync"`
+	// 启动时 aof 结尾的记录不完整则截断后继续启动，否则拒绝启动
+	AOFLoadTruncated bool `json:"aof_load_truncated"`
+	// 重写 aof 时以快照开头，之后追加的指令仍然是 json，文件更小加载更快
+	AOFUseRDBPreamble bool `json:"aof_use_rdb_preamble"`
+	// aof 大小超过 min size 且相对上次重写后增长超过百分比时自动重写，百分比为 0 时关闭
+	AutoAOFRewritePercentage int    `json:"auto_aof_rewrite_percentage"`
+	AutoAOFRewriteMinSize    int64  `json:"auto_aof_rewrite_min_size"`
+	RDBFile                  string `json:"rdb_file"` // 为空时不使用快照
+	// 任意一条规则满足时自动 bgsave，与 redis 的 save <seconds> <changes> 一致
+	Save []*SaveRule `json:"save"`
+	// 键空间通知，与 redis 的 notify-keyspace-events 一致，例如 KEA Ex，为空时关闭
+	NotifyKeyspaceEvents string `json:"notify_keyspace_events"`
+	// 启动时成为该主节点的从节点，格式为 host:port，为空时是主节点，运行期间使用 replicaof 切换
+	ReplicaOf  string `json:"replica_of"`
+	MasterAuth string `json:"master_auth"` // 主节点的密码
+	// 从节点默认只读，为 true 时允许写入但不会同步给主节点
+	ReplicaWritable bool `json:"replica_writable"`
+	ReplBacklogSize int  `json:"repl_backlog_size"` // 复制积压缓冲的大小，为 0 时使用默认值
+	// 为 true 时所有指令由一个协程顺序执行，否则各个连接协程按分片加锁并发执行
+	SingleThread bool `json:"single_thread"`
+	// 集群的范围表修改后保存到这个文件，存在时启动直接加载而不再按 peers 计算，为空时不保存
+	ClusterConfigFile string `json:"cluster_config_file"`
+}
+
+type SaveRule struct {
+	Seconds int `json:"seconds"`
+	Changes int `json:"changes"`
 }
 
 func GetConf() *Conf {
@@ -2,15 +2,14 @@ package main
 
 import (
 	"fmt"
-	"hash"
-	"hash/fnv"
 	"math"
+	"strings"
 )
 
 type Range struct {
-	Start uint64
-	End   uint64
-	Size  uint64
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+	Size  uint64 `json:"size"`
 }
 
 type Stack struct {
@@ -69,7 +68,11 @@ func NewStack() *Stack {
 type SubMap struct {
 	Start uint64
 	End   uint64
-	Data  map[string]string
+	Node  string // 集群模式下负责这个范围的节点
+	// 迁移中的范围，源节点记录迁出的目标，目标节点记录迁入的来源
+	Migrating string
+	Importing string
+	Data      map[string]string
 }
 
 func NewSubMap(start uint64, end uint64) *SubMap {
@@ -80,7 +83,6 @@ type ConsistencyMap struct {
 	Stack        *Stack          // 最大范围堆  每次添加节点都是拆分最大范围
 	InvalidRange map[string]bool // 违规的范围 删除不太方便标记违规
 	Data         []*SubMap       // 至少包含一个 0~2^64
-	Hash         hash.Hash64     // 一致性 hash
 }
 
 func NewConsistencyMap() *ConsistencyMap {
@@ -92,7 +94,6 @@ func NewConsistencyMap() *ConsistencyMap {
 		Stack:        stack,
 		InvalidRange: make(map[string]bool),
 		Data:         data,
-		Hash:         fnv.New64(),
 	}
 }
 
@@ -125,7 +126,8 @@ func (c *ConsistencyMap) RemoveNode(start uint64) {
 	c.Stack.Push(&Range{Start: m1.Start, End: m1.End, Size: m1.End - m1.Start})
 }
 
-func (c *ConsistencyMap) AddNode() { // 添加新节点并迁移数据
+// AddNode 添加新节点并迁移数据，返回新节点负责的范围
+func (c *ConsistencyMap) AddNode() *SubMap {
 	item := c.Stack.Pop() // 默认向占领区域最大的地方添加新节点
 	for {
 		key := c.genRangeKey(item)
@@ -150,10 +152,7 @@ func (c *ConsistencyMap) AddNode() { // 添加新节点并迁移数据
 	oldM.End = mid
 	m := NewSubMap(mid, item.End)
 	for key, val := range oldM.Data {
-		c.Hash.Reset()
-		_, err := c.Hash.Write([]byte(key))
-		HandleErr(err)
-		temp := c.Hash.Sum64() // 有需要就进行数据转移
+		temp := KeyHash(key) // 有需要就进行数据转移
 		if temp >= m.Start && temp < m.End {
 			m.Data[key] = val
 			delete(oldM.Data, key)
@@ -162,6 +161,7 @@ func (c *ConsistencyMap) AddNode() { // 添加新节点并迁移数据
 	c.Stack.Push(&Range{Start: m.Start, End: m.End, Size: m.End - m.Start})
 	c.Stack.Push(&Range{Start: oldM.Start, End: oldM.End, Size: oldM.End - oldM.Start})
 	c.Data = append(c.Data, m)
+	return m
 }
 
 func (c *ConsistencyMap) Get(key string) string {
@@ -179,19 +179,38 @@ func (c *ConsistencyMap) Del(key string) {
 	delete(m.Data, key)
 }
 
+// getSubMap 最后一个范围包含 2^64-1 本身
 func (c *ConsistencyMap) getSubMap(key string) *SubMap {
-	c.Hash.Reset()
-	_, err := c.Hash.Write([]byte(key))
-	HandleErr(err)
-	val := c.Hash.Sum64()
+	val := KeyHash(key)
 	for _, item := range c.Data {
-		if val >= item.Start && val < item.End {
+		if val >= item.Start && (val < item.End || item.End == math.MaxUint64) {
 			return item // 可以使用 二分 这里简单起见 不再使用二分
 		}
 	}
 	return nil
 }
 
+// KeyHash 与 redis 的 hash tag 一致，key 中第一个 {} 内不为空时只计算其中的部分，使相关的 key 落在同一个范围
+// 不再共用 hash.Hash64，多个连接可以并发计算
+func KeyHash(key string) uint64 {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return Mix64(HashStr(key))
+}
+
+// Mix64 murmur3 的 fmix64，fnv 对短 key 的高位几乎不变，按范围拆分前需要打散
+func Mix64(val uint64) uint64 {
+	val ^= val >> 33
+	val *= 0xff51afd7ed558ccd
+	val ^= val >> 33
+	val *= 0xc4ceb9fe1a85ec53
+	val ^= val >> 33
+	return val
+}
+
 func (c *ConsistencyMap) genRangeKey(item *Range) string {
 	return fmt.Sprintf("%d-%d", item.Start, item.End)
 }
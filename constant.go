@@ -1,5 +1,7 @@
 package main
 
+import "time"
+
 const (
 	// 临时使用绝对路径
 	ConfPath = "/Users/sky/GolandProjects/my_redis/data/conf.json"
@@ -24,15 +26,32 @@ const (
 )
 
 const (
-	CmdPing = "PING"
-	CmdAuth = "AUTH"
+	CmdPing  = "PING"
+	CmdAuth  = "AUTH"
+	CmdHello = "HELLO"
+	CmdReset = "RESET"
 
 	CmdSelect       = "SELECT"
 	CmdDBSize       = "DBSIZE"
+	CmdFlushDB      = "FLUSHDB"
+	CmdFlushAll     = "FLUSHALL"
 	CmdBGRewriteAOF = "BGREWRITEAOF"
+	CmdSave         = "SAVE"
+	CmdBGSave       = "BGSAVE"
+	CmdLastSave     = "LASTSAVE"
+	CmdServerInfo   = "INFO" // CmdInfo 已经是指令信息的类型名
 	CmdSubscribe    = "SUBSCRIBE"
 	CmdUnsubscribe  = "UNSUBSCRIBE"
 	CmdPublish      = "PUBLISH"
+	CmdPSubscribe   = "PSUBSCRIBE"
+	CmdPUnsubscribe = "PUNSUBSCRIBE"
+	CmdPubSub       = "PUBSUB"
+	CmdReplicaOf    = "REPLICAOF"
+	CmdReplConf     = "REPLCONF"
+	CmdPSync        = "PSYNC"
+	CmdWait         = "WAIT"
+	CmdCluster      = "CLUSTER"
+	CmdAsking       = "ASKING"
 
 	CmdMulti   = "MULTI"
 	CmdDiscard = "DISCARD"
@@ -52,6 +71,64 @@ const (
 	CmdZScore = "ZSCORE"
 	CmdZRank  = "ZRANK"
 
+	CmdZPopMin  = "ZPOPMIN"
+	CmdZPopMax  = "ZPOPMAX"
+	CmdBZPopMin = "BZPOPMIN"
+	CmdBZPopMax = "BZPOPMAX"
+
+	CmdHSet         = "HSET"
+	CmdHSetNX       = "HSETNX"
+	CmdHGet         = "HGET"
+	CmdHMGet        = "HMGET"
+	CmdHDel         = "HDEL"
+	CmdHExists      = "HEXISTS"
+	CmdHLen         = "HLEN"
+	CmdHKeys        = "HKEYS"
+	CmdHVals        = "HVALS"
+	CmdHGetAll      = "HGETALL"
+	CmdHIncrBy      = "HINCRBY"
+	CmdHIncrByFloat = "HINCRBYFLOAT"
+	CmdHStrLen      = "HSTRLEN"
+	CmdHRandField   = "HRANDFIELD"
+	CmdHScan        = "HSCAN"
+
+	CmdLPush   = "LPUSH"
+	CmdRPush   = "RPUSH"
+	CmdLPushX  = "LPUSHX"
+	CmdRPushX  = "RPUSHX"
+	CmdLPop    = "LPOP"
+	CmdRPop    = "RPOP"
+	CmdLRange  = "LRANGE"
+	CmdLIndex  = "LINDEX"
+	CmdLSet    = "LSET"
+	CmdLInsert = "LINSERT"
+	CmdLLen    = "LLEN"
+	CmdLRem    = "LREM"
+	CmdLTrim   = "LTRIM"
+	CmdLPos    = "LPOS"
+	CmdLMove   = "LMOVE"
+	CmdBLPop   = "BLPOP"
+	CmdBRPop   = "BRPOP"
+	CmdBLMove  = "BLMOVE"
+
+	CmdSAdd        = "SADD"
+	CmdSRem        = "SREM"
+	CmdSIsMember   = "SISMEMBER"
+	CmdSMIsMember  = "SMISMEMBER"
+	CmdSMembers    = "SMEMBERS"
+	CmdSCard       = "SCARD"
+	CmdSPop        = "SPOP"
+	CmdSRandMember = "SRANDMEMBER"
+	CmdSMove       = "SMOVE"
+	CmdSInter      = "SINTER"
+	CmdSUnion      = "SUNION"
+	CmdSDiff       = "SDIFF"
+	CmdSInterStore = "SINTERSTORE"
+	CmdSUnionStore = "SUNIONSTORE"
+	CmdSDiffStore  = "SDIFFSTORE"
+	CmdSInterCard  = "SINTERCARD"
+	CmdSScan       = "SSCAN"
+
 	CmdExists  = "EXISTS"
 	CmdType    = "TYPE"
 	CmdTTL     = "TTL"
@@ -59,13 +136,115 @@ const (
 	CmdExpire  = "EXPIRE"
 	CmdPersist = "PERSIST"
 
+	CmdMigrate       = "MIGRATE"
+	CmdRestore       = "RESTORE"
+	CmdRestoreAsking = "RESTORE-ASKING" // migrate 发给目标节点，可以写入迁入中的范围
+
 	CmdAbsExpire = "ABSEXPIRE" // 一般只给系统用 绝对的超时时间，用于 AOF 重放
+	CmdAOFID     = "AOFID"     // 只出现在 aof 文件的第一行，标识 aof 文件，重写后会变化
 )
 
 const (
 	TypeStr  = 1
 	TypeTime = 2
 	TypeZSet = 3
+	TypeHash = 4
+	TypeList = 5
+	TypeSet  = 6
+)
+
+const (
+	QuickListChunkSize  = 128         // 每个分片最多存储的元素个数
+	SetMaxIntSetEntries = 512         // 超过后 intset 转换为 map 存储
+	DictBucketSize      = 8           // Dict 平均每个桶的元素个数，超过后桶数翻倍
+	MaxRandCount        = 1024 * 1024 // 随机选取时 count 为负数允许重复，结果的个数不再受元素个数限制
+)
+
+const (
+	TimeWheelSlots    = 600 // 精度 100ms 一圈一分钟
+	TimeWheelInterval = 100 * time.Millisecond
+)
+
+const (
+	RDBMagic      = "MYREDIS"
+	RDBVersion    = 1
+	RDBOpAux      = 0xFA // 辅助字段 key value
+	RDBOpExpireMs = 0xFC // 后面的 key 带有毫秒级的过期时间
+	RDBOpSelectDB = 0xFE
+	RDBOpEOF      = 0xFF // 后面是 8 字节的 crc64 校验和
+
+	RDBAuxCTime     = "ctime"
+	RDBAuxAOFID     = "aof-id"     // 快照对应的 aof 文件
+	RDBAuxAOFOffset = "aof-offset" // 快照时 aof 文件的大小，之后的指令需要在加载快照后重放
+	RDBAuxAOFIndex  = "aof-index"  // 快照时 aof 最后选择的数据库，之后的指令在没有 select 前基于这个数据库
+	// 全量同步时复制流最后选择的数据库，与 aof-index 的作用相同
+	RDBAuxReplStreamDB = "repl-stream-db"
+
+	RDBRetryDelay = 5 * time.Second // 自动保存失败后的重试间隔
+	AOFRetryDelay = 5 * time.Second // 自动重写失败后的重试间隔
+)
+
+const (
+	ReplBacklogSize = 1024 * 1024      // 复制积压缓冲的默认大小
+	ReplOutputLimit = 64 * 1024 * 1024 // 从节点等待发送的复制流超过后断开
+	ReplPingPeriod  = 10 * time.Second // 主节点向从节点发送 ping 的间隔
+	ReplAckPeriod   = time.Second      // 从节点向主节点确认偏移量的间隔
+	ReplTimeout     = 60 * time.Second // 从节点超过这个时间没有收到数据视为断开
+	ReplRetryDelay  = time.Second      // 从节点断开后的重连间隔
+	ReplExpireDelay = time.Second      // 从节点上到期的 key 等待主节点删除，期间重新检查的间隔
+)
+
+const (
+	MsgWrongType  = "WRONGTYPE Operation against a key holding the wrong kind of value"
+	MsgReadOnly   = "READONLY You can't write against a read only replica."
+	MsgCrossSlot  = "CROSSSLOT Keys in request don't hash to the same slot"
+	MsgTryAgain   = "TRYAGAIN Multiple keys request during rehashing of slot"
+	MsgOutOfRange = "value is out of range"
+)
+
+const (
+	MaxReqSize    = 8 * 1024 * 1024 // 单个请求最大 8MB，也保证了 json 帧长度的第 4 个字节为 0
+	MaxBulkCount  = 1024 * 1024     // RESP 单个请求最多的参数个数
+	ReadBuffSize  = 16 * 1024       // 也是 inline 指令的最大长度
+	PushQueueSize = 1024            // 订阅者积压的回复与推送上限，发布时队列已满直接断开连接
+)
+
+const (
+	ProtoJSON  = 0
+	ProtoRESP2 = 2
+	ProtoRESP3 = 3
+)
+
+const (
+	ReplyStatus = '+'
+	ReplyError  = '-'
+	ReplyInt    = ':'
+	ReplyBulk   = '$'
+	ReplyArray  = '*'
+	ReplyNil    = '_' // RESP2 中编码为 $-1
+	// 以下为 RESP3 新增类型，RESP2 连接会降级编码
+	ReplyMap    = '%'
+	ReplySet    = '~'
+	ReplyDouble = ','
+	ReplyBool   = '#'
+	ReplyPush   = '>'
+)
+
+// 键空间通知的事件类型，与 redis notify-keyspace-events 的字母一一对应
+const (
+	NotifyKeyspace = 1 << iota // K  __keyspace@<db>__:<key>
+	NotifyKeyevent             // E  __keyevent@<db>__:<event>
+	NotifyGeneric              // g  del expire persist 等与类型无关的指令
+	NotifyString               // $
+	NotifyList                 // l
+	NotifySet                  // s
+	NotifyHash                 // h
+	NotifyZSet                 // z
+	NotifyExpired              // x  key 过期被删除
+	NotifyEvicted              // e  key 被淘汰，目前没有内存淘汰不会产生
+	NotifyNew                  // n  新建 key，不包含在 A 中
+	// A 表示 g$lshzxe
+	NotifyAll = NotifyGeneric | NotifyString | NotifyList | NotifySet | NotifyHash | NotifyZSet | NotifyExpired | NotifyEvicted
 )
 
 const (
@@ -1,21 +1,82 @@
 package main
 
 import (
+	"bytes"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
-	cmdMap = make(map[string]Cmd)
+	cmdMap = make(map[string]*CmdInfo)
 )
 
-func RegisterCmd(name string, cmd Cmd) {
-	cmdMap[name] = cmd
+type CmdInfo struct {
+	Cmd   Cmd
+	Arity int                          // 与 redis 一致包含指令名，负数表示参数个数至少为 -Arity
+	Write bool                         // 写指令对 key 加写锁，读指令加读锁
+	Keys  func(args []string) []string // 指令涉及的 key，执行前统一加锁
 }
 
+func RegisterCmd(name string, cmd Cmd, arity int, write bool, keys func(args []string) []string) {
+	cmdMap[name] = &CmdInfo{Cmd: cmd, Arity: arity, Write: write, Keys: keys}
+}
+
+// LookupCmd 检查指令是否存在以及参数个数，失败时返回错误信息
+func LookupCmd(req *Req) (*CmdInfo, string) {
+	info := cmdMap[strings.ToUpper(req.Cmd)]
+	if info == nil {
+		return nil, "Invalid Cmd"
+	}
+	count := len(req.Args) + 1
+	if (info.Arity > 0 && count != info.Arity) || count < -info.Arity {
+		return nil, "Wrong Number Of Args For " + strings.ToLower(req.Cmd)
+	}
+	return info, ""
+}
+
+// KeyRange 与 redis 的 first last step 规则一致，last 为负数时从末尾开始计算
+func KeyRange(first int, last int, step int) func(args []string) []string {
+	return func(args []string) []string {
+		end := last
+		if end < 0 {
+			end += len(args)
+		}
+		res := make([]string, 0)
+		for i := first; i <= end && i < len(args); i += step {
+			res = append(res, args[i])
+		}
+		return res
+	}
+}
+
+var (
+	FirstKey = KeyRange(0, 0, 1)
+	AllKeys  = KeyRange(0, -1, 1)
+)
+
 type DB struct {
-	DataMap *Map // key -> data
-	TTLMap  *Map // key -> 过期时间
+	DataMap   *Map // key -> data
+	TTLMap    *Map // key -> 过期时间
+	Index     int
+	AOF       *AOF
+	TimeWheel *TimeWheel
+	Executor  *Executor    // 单线程模式下不需要加锁，时间轮的任务也交给执行协程
+	Pubhub    *Pubhub      // 发布键空间通知
+	Cluster   *Cluster     // 集群模式才有，执行前检查 key 是否由自己负责
+	Repl      *Repl        // 从节点不自己删除过期的 key
+	Dirty     atomic.Int64 // 上次快照之后的修改次数
+	// watch 相关，key -> watch 它的会话
+	Watched    map[string]map[*Session]bool
+	WatchCount atomic.Int64 // 没有 watch 时修改 key 不需要加锁
+	WatchLock  sync.Mutex
+	// 阻塞指令相关
+	Waiters    map[string][]*Waiter
+	ReadyKeys  map[string]bool
+	ReadyQueue []string
+	BlockLock  sync.Mutex
 }
 
 func (d *DB) Exec(req *Req, session *Session, aof *AOF, writeAOF bool) {
@@ -25,8 +86,6 @@ func (d *DB) Exec(req *Req, session *Session, aof *AOF, writeAOF bool) {
 		d.ExecMulti(req, session)
 	case CmdDiscard:
 		d.ExecDiscard(req, session)
-	case CmdExec:
-		d.ExecExec(req, session, aof)
 	case CmdWatch:
 		d.ExecWatch(req, session)
 	case CmdUnwatch:
@@ -37,24 +96,133 @@ func (d *DB) Exec(req *Req, session *Session, aof *AOF, writeAOF bool) {
 }
 
 func (d *DB) ExecNormal(req *Req, session *Session, aof *AOF, writeAOF bool) {
+	info, msg := LookupCmd(req)
+	if info == nil {
+		if session.InTransaction { // 入队时出错整个事务都不再执行
+			session.TxDirty = true
+		}
+		session.WriteError(req.SeqID, msg)
+		Error("%s %s", msg, req.Cmd)
+		return
+	}
+	keys := info.Keys(req.Args)
 	if session.InTransaction {
-		// 最好检查一下，不要无脑入队列，前置检查出错误，整个事务都不要执行了
+		if msg := d.route(req, keys, session, false); msg != "" { // 入队时只检查范围，迁移状态在 exec 加锁后检查
+			session.TxDirty = true
+			session.WriteError(req.SeqID, msg)
+			return
+		}
 		session.ReqQueue = append(session.ReqQueue, req)
-		session.WriteOk(req.SeqID, "EnQueue")
+		session.WriteStatus(req.SeqID, "QUEUED")
 		return
 	}
-	if writeAOF {
-		aof.WriteAOF(req, session.DBIndex)
-	}
 	// 正常指令  get  set  等
-	cmd := cmdMap[strings.ToUpper(req.Cmd)]
-	if cmd == nil {
-		session.WriteError(req.SeqID, "Invalid Cmd")
-		Error("Invalid Cmd %s", req.Cmd)
+	unlock := d.LockKeys(keys, info.Write)
+	defer unlock()
+	if msg := d.route(req, keys, session, true); msg != "" {
+		session.WriteError(req.SeqID, msg)
 		return
 	}
-	// 执行指令
-	cmd.Exec(d, req, session)
+	d.execCmd(info, req, session, writeAOF)
+}
+
+// route 集群模式下检查 key 是否由自己负责，aof 重放、主节点的复制流以及 migrate 本身不需要检查
+// locked 表示已经对 key 加锁，可以判断 key 是否还在本地
+func (d *DB) route(req *Req, keys []string, session *Session, locked bool) string {
+	cmd := strings.ToUpper(req.Cmd)
+	if d.Cluster == nil || d.AOF.Loading || session.Master || cmd == CmdMigrate || len(keys) == 0 {
+		return ""
+	}
+	var exists func(string) bool
+	if locked {
+		exists = func(key string) bool {
+			return d.GetEntry(key) != nil
+		}
+	}
+	// restore-asking 相当于先执行了 asking
+	return d.Cluster.Check(keys, session.Asking || cmd == CmdRestoreAsking, exists)
+}
+
+// execCmd 调用方需要已经对指令涉及的 key 加锁，aof 也在锁内写入保证与执行顺序一致
+func (d *DB) execCmd(info *CmdInfo, req *Req, session *Session, writeAOF bool) {
+	if !info.Write {
+		info.Cmd.Exec(d, req, session)
+		return
+	}
+	// 写指令执行成功后才写入 aof，出错的指令不会被持久化与复制，重放时也就不会再次出错
+	replies := session.Capture(func() {
+		info.Cmd.Exec(d, req, session)
+	})
+	if len(replies) == 0 || replies[len(replies)-1].Reply.Type != ReplyError {
+		if writeAOF {
+			d.writeAOF(session, req)
+		}
+		if !d.AOF.Loading {
+			d.Dirty.Add(1)
+		}
+	}
+	for _, item := range replies {
+		session.WriteReply(item.SeqID, item.Reply)
+	}
+}
+
+// LockKeys 对 key 所在分片加锁并删除其中已经过期的 key，返回解锁函数
+// TTLMap 与 DataMap 的分片规则一致，共用 DataMap 的分片锁
+// 读指令只有存在过期 key 时才短暂加写锁删除，指令执行期间 GetEntry 不会修改数据
+// 加写锁后先替还在进行的快照编码这些分片，之后才能修改
+func (d *DB) LockKeys(keys []string, write bool) func() {
+	if d.Executor != nil {
+		if write || d.hasExpired(keys) {
+			d.copyKeys(keys)
+		}
+		d.expireKeys(keys)
+		return func() {}
+	}
+	if write {
+		unlock := d.DataMap.Lock(keys, nil)
+		d.copyKeys(keys)
+		d.expireKeys(keys)
+		return unlock
+	}
+	unlock := d.DataMap.Lock(nil, keys)
+	if !d.hasExpired(keys) {
+		return unlock
+	}
+	unlock()
+	unlock = d.DataMap.Lock(keys, nil)
+	d.copyKeys(keys)
+	d.expireKeys(keys)
+	unlock()
+	return d.DataMap.Lock(nil, keys)
+}
+
+func (d *DB) hasExpired(keys []string) bool {
+	if !d.canExpire() {
+		return false
+	}
+	for _, key := range keys {
+		if d.IsExpire(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *DB) expireKeys(keys []string) {
+	if !d.canExpire() {
+		return
+	}
+	for _, key := range keys {
+		if d.IsExpire(key) {
+			d.expire(key)
+		}
+	}
+}
+
+// canExpire 重放期间不删除保证与写入时一致
+// 从节点只在读取时隐藏过期的 key，等待主节点的 del，与 redis 一致，否则 aof 与键空间通知会与主节点不一致
+func (d *DB) canExpire() bool {
+	return !d.AOF.Loading && (d.Repl == nil || !d.Repl.IsReplica())
 }
 
 func (d *DB) GetOrPutEntry(key string, entry *Entry) *Entry {
@@ -66,13 +234,27 @@ func (d *DB) GetOrPutEntry(key string, entry *Entry) *Entry {
 	return entry
 }
 
+// GetTypeEntry 获取指定类型的数据，类型不一致时 ok 为 false
+func (d *DB) GetTypeEntry(key string, typ int) (*Entry, bool) {
+	entry := d.GetEntry(key)
+	if entry != nil && entry.Type != typ {
+		return nil, false
+	}
+	return entry, true
+}
+
+// PutEntry 新的数据不会继承原来的过期时间
 func (d *DB) PutEntry(key string, entry *Entry) {
+	if d.DataMap.Get(key) == nil {
+		d.Notify(NotifyNew, "new", key)
+	}
 	d.DataMap.Put(key, entry)
+	d.RemoveTTL(key)
+	d.Touch(key)
 }
 
 func (d *DB) GetEntry(key string) *Entry {
-	if d.IsExpire(key) { // 惰性删除
-		d.DelEntry(key)
+	if !d.AOF.Loading && d.IsExpire(key) { // 主节点过期的 key 已经在加锁时删除，这里只可能是执行期间刚好过期，从节点则一直隐藏到主节点的 del 到达
 		return nil
 	}
 	return d.DataMap.Get(key)
@@ -88,7 +270,87 @@ func (d *DB) IsExpire(key string) bool {
 
 func (d *DB) DelEntry(key string) {
 	d.DataMap.Del(key)
-	d.TTLMap.Del(key)
+	d.RemoveTTL(key)
+	d.Touch(key)
+}
+
+// Flush 清空数据库，时间轮中剩余的过期任务到期后发现没有过期时间会直接忽略
+func (d *DB) Flush() {
+	if d.Executor == nil {
+		unlock := d.DataMap.LockAll()
+		defer unlock()
+	}
+	d.flush()
+	d.Propagate(nil, &Req{Cmd: CmdFlushDB})
+}
+
+// flush 调用方需要持有全部分片的写锁
+func (d *DB) flush() {
+	d.copyAll()
+	d.DataMap.Clear()
+	d.TTLMap.Clear()
+	d.TouchAll()
+}
+
+// expire 删除过期的 key，并以 del 的形式写入 aof，保证重放与重写的结果一致
+func (d *DB) expire(key string) {
+	d.DelEntry(key)
+	d.Propagate(nil, &Req{Cmd: CmdDel, Args: []string{key}})
+	d.Notify(NotifyExpired, "expired", key)
+}
+
+// Notify 发布键空间通知，重放期间不发布
+func (d *DB) Notify(class int, event string, key string) {
+	if d.AOF.Loading {
+		return
+	}
+	d.Pubhub.Notify(class, event, d.Index, key)
+}
+
+// ActiveExpire 时间轮到期后主动删除，不再依赖访问时的惰性删除
+func (d *DB) ActiveExpire(key string) {
+	unlock := d.DataMap.Lock([]string{key}, nil)
+	defer unlock()
+	entry := d.TTLMap.Get(key)
+	if entry == nil {
+		return
+	}
+	if delay := time.Until(entry.Time); delay > 0 { // 时间轮精度有限，还没有到期的重新加入
+		d.addExpireTask(key, delay)
+		return
+	}
+	if !d.canExpire() { // 主节点的 del 到达后取消，成为主节点之后仍然需要删除
+		d.addExpireTask(key, ReplExpireDelay)
+		return
+	}
+	d.copyKeys([]string{key})
+	d.expire(key)
+}
+
+// expireTaskKey 不同数据库的 key 共用一个时间轮需要区分
+func (d *DB) expireTaskKey(key string) string {
+	return "expire-" + strconv.Itoa(d.Index) + "-" + key
+}
+
+func (d *DB) addExpireTask(key string, delay time.Duration) {
+	d.TimeWheel.AddTask(d.expireTaskKey(key), func(string) {
+		if d.Executor != nil {
+			d.Executor.Exec(func() {
+				d.ActiveExpire(key)
+			})
+		} else {
+			d.ActiveExpire(key)
+		}
+	}, delay)
+}
+
+func (d *DB) putTTL(key string, time0 time.Time) {
+	d.TTLMap.Put(key, &Entry{
+		Type: TypeTime,
+		Time: time0,
+	})
+	d.addExpireTask(key, time.Until(time0))
+	d.Touch(key)
 }
 
 func (d *DB) ForEach(callback func(string, *Entry)) {
@@ -110,24 +372,118 @@ func (d *DB) ExecDiscard(req *Req, session *Session) {
 		session.WriteError(req.SeqID, "Not In Transaction")
 		return
 	}
-	session.InTransaction = false
-	session.WriteNum(req.SeqID, len(session.ReqQueue))
+	session.ResetTx()
+	session.WriteOk(req.SeqID)
 }
 
-func (d *DB) ExecExec(req *Req, session *Session, aof *AOF) {
+// ExecExec dbs 为全部数据库，事务中有 flushall 时需要全部加锁
+func (d *DB) ExecExec(req *Req, session *Session, aof *AOF, dbs []*DB) {
 	if !session.InTransaction {
 		session.WriteError(req.SeqID, "Not In Transaction")
 		return
 	}
-	if d.WatchKeyChange(session.WatchKey) {
-		session.InTransaction = false // 需要退出事务
+	defer session.ResetTx()
+	if session.TxDirty {
+		session.WriteError(req.SeqID, "EXECABORT Transaction discarded because of previous errors")
+		return
+	}
+	// 所有指令以及 watch 的 key 一次加锁，执行期间不会穿插其他连接的指令
+	keys := make([]string, 0)
+	for watched := range session.WatchKey {
+		if watched.DB == d {
+			keys = append(keys, watched.Key)
+		}
+	}
+	// 有 flushdb flushall 时需要锁住全部分片的数据库
+	var flushDBs []*DB
+	for _, item := range session.ReqQueue { // 入队时已经检查过指令一定存在
+		switch cmd := strings.ToUpper(item.Cmd); cmd {
+		case CmdFlushDB:
+			if len(flushDBs) == 0 {
+				flushDBs = []*DB{d}
+			}
+		case CmdFlushAll:
+			flushDBs = dbs
+		case CmdPublish:
+		default:
+			keys = append(keys, cmdMap[cmd].Keys(item.Args)...)
+		}
+	}
+	unlock := d.lockExec(keys, flushDBs)
+	defer unlock()
+	if session.WatchDirty.Load() { // 加锁时删除的过期 key 同样会让事务失效
 		session.WriteError(req.SeqID, "Exec Fail WatchKey Change")
 		return
 	}
-	for _, item := range session.ReqQueue { // 队列任务全部执行了
-		d.ExecNormal(item, session, aof, false)
+	for _, item := range session.ReqQueue { // 等待锁期间 key 可能已经迁走
+		info := cmdMap[strings.ToUpper(item.Cmd)]
+		if info == nil {
+			continue
+		}
+		if msg := d.route(item, info.Keys(item.Args), session, true); msg != "" {
+			session.WriteError(req.SeqID, msg)
+			return
+		}
+	}
+	session.InExec = true // 事务中的阻塞指令不能阻塞
+	session.TxAOF = &bytes.Buffer{}
+	// 每条指令的回复合并为一个数组回复
+	replies := session.Capture(func() {
+		for _, item := range session.ReqQueue {
+			if info := cmdMap[strings.ToUpper(item.Cmd)]; info != nil {
+				d.execCmd(info, item, session, true)
+			} else {
+				d.execTxCmd(item, session, dbs)
+			}
+		}
+	})
+	session.InExec = false
+	aof.WriteMulti(session.TxAOF.Bytes(), d.Index)
+	session.TxAOF = nil
+	items := make([]*Reply, 0, len(replies))
+	for _, item := range replies {
+		items = append(items, item.Reply)
+	}
+	session.WriteReply(req.SeqID, NewArrayReply(items))
+}
+
+// lockExec 事务中有 flushdb 或者 flushall 时按数据库的顺序锁住全部分片，与 Handler.LockAll 一致
+func (d *DB) lockExec(keys []string, flushDBs []*DB) func() {
+	if len(flushDBs) == 0 || d.Executor != nil {
+		return d.LockKeys(keys, true)
+	}
+	unlocks := make([]func(), 0, len(flushDBs))
+	for _, db := range flushDBs {
+		unlocks = append(unlocks, db.DataMap.LockAll())
+	}
+	d.copyKeys(keys)
+	d.expireKeys(keys)
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+}
+
+// execTxCmd 执行事务中排队的 flushdb flushall publish，所需的锁已经在 exec 时取得
+func (d *DB) execTxCmd(req *Req, session *Session, dbs []*DB) {
+	switch strings.ToUpper(req.Cmd) {
+	case CmdFlushDB:
+		d.flush()
+		d.Propagate(session, req)
+		session.WriteOk(req.SeqID)
+	case CmdFlushAll: // 与事务中的其他指令一起以一条 flushall 记录在 aof 中
+		for _, db := range dbs {
+			db.flush()
+			if db != d && !db.AOF.Loading {
+				db.Dirty.Add(1)
+			}
+		}
+		d.Propagate(session, req)
+		session.WriteOk(req.SeqID)
+	case CmdPublish:
+		d.Pubhub.Publish(req, session)
 	}
-	session.WriteNum(req.SeqID, len(session.ReqQueue))
 }
 
 func (d *DB) ExecWatch(req *Req, session *Session) {
@@ -139,66 +495,53 @@ func (d *DB) ExecWatch(req *Req, session *Session) {
 		session.WriteError(req.SeqID, "Watch Not Allow In Transaction")
 		return
 	}
-	count := 0
+	// 加锁时已经过期的 key 先被删除，注册之后的过期才会让事务失效
+	unlock := d.LockKeys(req.Args, false)
+	defer unlock()
 	for _, key := range req.Args {
-		entry := d.GetEntry(key)
-		if entry != nil {
-			session.WatchKey[key] = entry.Version
-			count++
-		}
+		d.Watch(session, key)
 	}
-	session.WriteNum(req.SeqID, count)
+	session.WriteOk(req.SeqID)
 }
 
 func (d *DB) ExecUnwatch(req *Req, session *Session) {
-	if len(req.Args) == 0 {
-		session.WriteError(req.SeqID, "Invalid Unwatch Param")
-		return
+	if len(req.Args) == 0 { // 不指定就取消全部
+		session.UnwatchAll()
 	}
-	count := 0
 	for _, key := range req.Args {
-		if _, ok := session.WatchKey[key]; ok {
-			delete(session.WatchKey, key)
-			count++
+		watched := WatchedKey{DB: d, Key: key}
+		if session.WatchKey[watched] {
+			delete(session.WatchKey, watched)
+			d.unwatch(session, key)
 		}
 	}
-	session.WriteNum(req.SeqID, count)
-}
-
-func (d *DB) WatchKeyChange(watchKey map[string]int) bool {
-	for key, version := range watchKey {
-		entry := d.GetEntry(key) // 删除或版本不对都是修改了
-		if entry == nil || entry.Version != version {
-			return true
-		}
-	}
-	return false
+	session.WriteOk(req.SeqID)
 }
 
 func (d *DB) RemoveTTL(key string) {
 	d.TTLMap.Del(key)
+	d.TimeWheel.CancelTask(d.expireTaskKey(key))
 }
 
 func (d *DB) SetTTL(key string, ttl int) {
 	if ttl > 0 {
-		d.TTLMap.Put(key, &Entry{
-			Type: TypeTime,
-			Time: time.Now().Add(time.Duration(ttl) * time.Second),
-		})
+		d.putTTL(key, time.Now().Add(time.Duration(ttl)*time.Second))
+		d.Notify(NotifyGeneric, "expire", key)
 	} else { // 太小直接删除
 		d.DelEntry(key)
+		d.Notify(NotifyGeneric, "del", key)
 	}
 }
 
 func (d *DB) SetAbsTTL(key string, ttl int) {
 	time0 := time.Unix(int64(ttl), 0)
-	if time0.After(time.Now()) {
-		d.TTLMap.Put(key, &Entry{
-			Type: TypeTime,
-			Time: time0,
-		})
+	// 重放时即使已经过期也不能直接删除，后面可能还有 persist 等指令，交给时间轮删除
+	if time0.After(time.Now()) || d.AOF.Loading {
+		d.putTTL(key, time0)
+		d.Notify(NotifyGeneric, "expire", key)
 	} else { // 在之前或者相等直接删除
 		d.DelEntry(key)
+		d.Notify(NotifyGeneric, "del", key)
 	}
 }
 
@@ -210,13 +553,47 @@ func (d *DB) GetTTL(key string) int {
 	return int(entry.Time.Sub(time.Now()) / time.Second)
 }
 
+// GetPTTL 剩余的毫秒数，没有过期时间返回 0，restore 的 ttl 参数同样以 0 表示没有过期时间
+func (d *DB) GetPTTL(key string) int64 {
+	entry := d.TTLMap.Get(key)
+	if entry == nil {
+		return 0
+	}
+	return max(time.Until(entry.Time).Milliseconds(), 1)
+}
+
 func (d *DB) GetSize() int {
 	return d.DataMap.GetSize()
 }
 
-func NewDB(conf *Conf) *DB {
+func NewDB(conf *Conf, index int, aof *AOF, timeWheel *TimeWheel, executor *Executor, pubhub *Pubhub) *DB {
 	return &DB{
-		DataMap: NewMap(conf.ShardCount),
-		TTLMap:  NewMap(conf.ShardCount),
+		DataMap:   NewMap(conf.ShardCount),
+		TTLMap:    NewMap(conf.ShardCount),
+		Index:     index,
+		AOF:       aof,
+		TimeWheel: timeWheel,
+		Executor:  executor,
+		Pubhub:    pubhub,
+		Waiters:   make(map[string][]*Waiter),
+		Watched:   make(map[string]map[*Session]bool),
+		ReadyKeys: make(map[string]bool),
+	}
+}
+
+// Propagate 指令内部产生的写操作需要手动记录，例如阻塞指令唤醒后的弹出，session 为空表示不属于任何连接
+func (d *DB) Propagate(session *Session, req *Req) {
+	d.writeAOF(session, req)
+	if !d.AOF.Loading {
+		d.Dirty.Add(1)
+	}
+}
+
+// writeAOF 事务执行期间先记录到会话中，执行完毕后以 multi exec 包裹一次写入
+func (d *DB) writeAOF(session *Session, req *Req) {
+	if session != nil && session.TxAOF != nil {
+		d.AOF.encode(session.TxAOF, req)
+		return
 	}
+	d.AOF.WriteAOF(req, d.Index)
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"iter"
+	"math/bits"
+)
+
+// Dict 按 hash 值的低位分桶的字典，桶数为 2 的幂，元素个数变化后整体翻倍或者减半
+// 扫描与 redis 的 dict 一致，游标为桶的下标，按高位先递增的顺序推进，扫描期间桶数变化也不会遗漏一直存在的元素，但可能重复返回
+type Dict[V any] struct {
+	Buckets []map[string]V
+	Count   int
+}
+
+func NewDict[V any]() *Dict[V] {
+	return &Dict[V]{Buckets: []map[string]V{{}}}
+}
+
+func (d *Dict[V]) bucket(key string) map[string]V {
+	return d.Buckets[HashStr(key)&uint64(len(d.Buckets)-1)]
+}
+
+func (d *Dict[V]) Get(key string) (V, bool) {
+	val, has := d.bucket(key)[key]
+	return val, has
+}
+
+// Put 返回是否为新增
+func (d *Dict[V]) Put(key string, val V) bool {
+	bucket := d.bucket(key)
+	_, has := bucket[key]
+	bucket[key] = val
+	if has {
+		return false
+	}
+	d.Count++
+	if d.Count > len(d.Buckets)*DictBucketSize {
+		d.resize(len(d.Buckets) * 2)
+	}
+	return true
+}
+
+func (d *Dict[V]) Del(key string) bool {
+	bucket := d.bucket(key)
+	if _, has := bucket[key]; !has {
+		return false
+	}
+	delete(bucket, key)
+	d.Count--
+	if len(d.Buckets) > 1 && d.Count < len(d.Buckets)*DictBucketSize/4 { // 留出余量，避免在边界上反复扩容缩容
+		d.resize(len(d.Buckets) / 2)
+	}
+	return true
+}
+
+func (d *Dict[V]) Len() int {
+	return d.Count
+}
+
+func (d *Dict[V]) resize(size int) {
+	buckets := make([]map[string]V, size)
+	for i := range buckets {
+		buckets[i] = make(map[string]V)
+	}
+	for _, bucket := range d.Buckets {
+		for key, val := range bucket {
+			buckets[HashStr(key)&uint64(size-1)][key] = val
+		}
+	}
+	d.Buckets = buckets
+}
+
+func (d *Dict[V]) All() iter.Seq2[string, V] {
+	return func(yield func(string, V) bool) {
+		for _, bucket := range d.Buckets {
+			for key, val := range bucket {
+				if !yield(key, val) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (d *Dict[V]) Keys() iter.Seq[string] {
+	return func(yield func(string) bool) {
+		for key := range d.All() {
+			if !yield(key) {
+				return
+			}
+		}
+	}
+}
+
+// Scan 从 cursor 对应的桶开始，每次返回整个桶，至少检查 count 个元素或者连续 count*10 个空桶后返回下一个游标，0 表示结束
+func (d *Dict[V]) Scan(cursor uint64, count int, callback func(string, V)) uint64 {
+	mask := uint64(len(d.Buckets) - 1)
+	for empty := count * 10; ; {
+		bucket := d.Buckets[cursor&mask]
+		for key, val := range bucket {
+			callback(key, val)
+		}
+		count -= len(bucket)
+		if len(bucket) == 0 {
+			empty--
+		}
+		// 只对低位递增，把高位全部置 1 之后反转加一再反转回来
+		cursor |= ^mask
+		cursor = bits.Reverse64(bits.Reverse64(cursor) + 1)
+		if cursor == 0 || count <= 0 || empty <= 0 {
+			return cursor
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+// Executor 单线程模式下连接协程只负责读取请求与写出回复，所有指令交给同一个协程顺序执行
+// 指令之间天然串行，不再需要分片锁
+type Executor struct {
+	TaskChan chan func()
+}
+
+func NewExecutor() *Executor {
+	return &Executor{TaskChan: make(chan func())}
+}
+
+func (e *Executor) Start() {
+	go e.loop()
+}
+
+func (e *Executor) loop() {
+	for task := range e.TaskChan {
+		task()
+	}
+}
+
+// Exec 提交任务并等待执行完毕，任务 panic 时在调用方协程重新抛出，不影响执行协程
+func (e *Executor) Exec(task func()) {
+	done := make(chan any, 1)
+	e.TaskChan <- func() {
+		defer func() {
+			done <- recover()
+		}()
+		task()
+	}
+	if err := <-done; err != nil {
+		panic(err)
+	}
+}
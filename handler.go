@@ -1,64 +1,298 @@
 package main
 
 import (
+	"errors"
 	"net"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Handler struct {
-	Conf   *Conf
-	DBs    []*DB
-	AOF    *AOF
-	Pubhub *Pubhub
+	Conf      *Conf
+	DBs       []*DB
+	AOF       *AOF
+	RDB       *RDB
+	Pubhub    *Pubhub
+	Repl      *Repl
+	Cluster   *Cluster // 集群模式才有
+	TimeWheel *TimeWheel
+	Executor  *Executor // 单线程模式才有
 }
 
 func (h *Handler) Handle(conn net.Conn) {
 	session := NewSession(conn) // 记录一次连接的相关信息
+	session.Auth = h.Conf.Passwd == ""
+	defer h.CloseSession(session) // 正常断开与 panic 都需要清理会话
+	if err := session.DetectProto(); err != nil {
+		h.handleReadErr(session, err)
+		return
+	}
 	for {
-		req := session.ReadReq()
+		req, err := session.ReadReq()
+		if err != nil {
+			h.handleReadErr(session, err)
+			return
+		}
 		Info("req %s", ToStr(req))
-		// ping 与 auth 是不需要登录的
+		// ping hello 与 auth 是不需要登录的
 		cmd := strings.ToUpper(req.Cmd)
 		if cmd == CmdPing {
 			h.HandlePing(req, session)
 			continue
 		}
+		if cmd == CmdHello {
+			h.HandleHello(req, session)
+			continue
+		}
 		if cmd == CmdAuth {
 			h.HandleAuth(req, session)
 			continue
 		}
+		if cmd == CmdReset {
+			h.ExecTask(session, func() {
+				h.HandleReset(req, session)
+			})
+			continue
+		}
 		// 检查登录
 		if !session.Auth {
 			session.WriteError(req.SeqID, "Need Auth")
 			continue
 		}
-		h.HandleDBCmd(req, session, true)
+		// RESP2 无法区分推送与回复，订阅期间只能执行订阅相关的指令
+		if session.Proto == ProtoRESP2 && session.SubCount() > 0 && !subscribeCmdSet[cmd] {
+			session.WriteError(req.SeqID, "Can't execute '"+strings.ToLower(req.Cmd)+"': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / RESET are allowed in this context")
+			continue
+		}
+		if cmd == CmdPSync && h.HandlePSync(req, session) { // 连接交给复制使用
+			return
+		}
+		if isWriteCmd(cmd) && h.ReadOnly() {
+			if session.InTransaction {
+				session.TxDirty = true
+			}
+			session.WriteError(req.SeqID, MsgReadOnly)
+			continue
+		}
+		if cmd == CmdAsking {
+			h.HandleAsking(req, session)
+			continue
+		}
+		if cmd == CmdWait {
+			if err = h.HandleWait(req, session); err != nil {
+				h.handleReadErr(session, err)
+				return
+			}
+			continue
+		}
+		h.ExecTask(session, func() {
+			h.HandleDBCmd(req, session, true)
+			h.ServeBlocked()
+		})
+		session.Asking = false // 只对下一条指令生效
+		if session.Migration != nil {
+			h.FinishMigrate(session)
+		}
+		if session.Waiter != nil {
+			if err = h.WaitBlocked(session); err != nil {
+				h.handleReadErr(session, err)
+				return
+			}
+		}
+	}
+}
+
+// ExecTask 单线程模式下交给执行协程执行，回复在当前连接协程写出，慢连接不会拖慢执行协程
+func (h *Handler) ExecTask(session *Session, task func()) {
+	if h.Executor == nil {
+		task()
+		return
+	}
+	var replies []*SeqReply
+	h.Executor.Exec(func() {
+		replies = session.Capture(task)
+	})
+	for _, item := range replies {
+		session.WriteReply(item.SeqID, item.Reply)
+	}
+}
+
+// runTask 执行不属于任何连接的任务，例如定时任务
+func (h *Handler) runTask(task func()) {
+	if h.Executor != nil {
+		h.Executor.Exec(task)
+	} else {
+		task()
+	}
+}
+
+// Cron 每秒检查一次是否需要自动保存快照与自动重写 aof，并定期 ping 从节点
+func (h *Handler) Cron() {
+	timeChan := time.Tick(time.Second)
+	pingChan := time.Tick(ReplPingPeriod)
+	for {
+		select {
+		case <-pingChan:
+			h.Repl.FeedCmd(h.AOF, &Req{Cmd: CmdPing})
+		case <-timeChan:
+			if h.needSave() {
+				h.runTask(func() {
+					if err := h.BGSave(); err != nil {
+						Warn("Auto save err %v", err)
+					}
+				})
+			}
+			if h.needRewrite() {
+				h.runTask(func() {
+					if err := h.BGRewriteAOF(); err != nil {
+						Warn("Auto rewrite aof err %v", err)
+					}
+				})
+			}
+		}
+	}
+}
+
+func (h *Handler) ServeBlocked() {
+	for _, db := range h.DBs {
+		db.ServeBlocked()
 	}
 }
 
+// WaitBlocked 阻塞期间同时探测连接是否断开，断开需要取消等待，防止唤醒时数据被弹出给已经断开的连接
+func (h *Handler) WaitBlocked(session *Session) error {
+	waiter := session.Waiter
+	session.Waiter = nil
+	peekChan := make(chan error, 1)
+	go func() {
+		_, err := session.Reader.Peek(1)
+		peekChan <- err
+	}()
+	select {
+	case reply := <-waiter.Reply:
+		session.WriteReply(waiter.SeqID, reply)
+	case err := <-peekChan:
+		if err != nil && waiter.DB.CancelWaiter(waiter, NewNilReply()) {
+			return err
+		}
+		// 客户端提前发送了后续请求，只能继续等待结果
+		session.WriteReply(waiter.SeqID, <-waiter.Reply)
+		return err
+	}
+	// 等待探测结束后才能继续读取，避免并发使用 Reader
+	return <-peekChan
+}
+
+var (
+	txRejectCmdSet = map[string]bool{ // exec 中无法执行的指令不能在事务中排队，入队时直接报错并放弃整个事务
+		CmdSave:         true,
+		CmdBGSave:       true,
+		CmdBGRewriteAOF: true,
+		CmdSubscribe:    true,
+		CmdUnsubscribe:  true,
+		CmdPSubscribe:   true,
+		CmdPUnsubscribe: true,
+		CmdReplicaOf:    true,
+		CmdCluster:      true,
+		CmdMigrate:      true,
+	}
+	txQueueCmdSet = map[string]int{ // 不经过 DB 的指令 -> 参数个数，在事务中与 DB 指令一样排队，exec 时执行
+		CmdFlushDB:  0,
+		CmdFlushAll: 0,
+		CmdPublish:  2,
+	}
+)
+
 func (h *Handler) HandleDBCmd(req *Req, session *Session, writeAOF bool) {
 	cmd := strings.ToUpper(req.Cmd)
+	if session.InTransaction && txRejectCmdSet[cmd] {
+		session.TxDirty = true
+		session.WriteError(req.SeqID, "Invalid "+strings.ToLower(req.Cmd)+" In Transaction")
+		return
+	}
+	if argc, ok := txQueueCmdSet[cmd]; ok && session.InTransaction {
+		h.queueTxCmd(req, session, argc)
+		return
+	}
 	switch cmd {
 	case CmdSelect:
 		h.HandleSelect(req, session)
 	case CmdDBSize:
 		h.HandleDBSize(req, session)
+	case CmdFlushDB:
+		h.HandleFlushDB(req, session)
+	case CmdFlushAll:
+		h.HandleFlushAll(req, session)
 	case CmdBGRewriteAOF:
 		h.HandleBGRewriteAOF(req, session)
+	case CmdSave:
+		h.HandleSave(req, session)
+	case CmdBGSave:
+		h.HandleBGSave(req, session)
+	case CmdLastSave:
+		h.HandleLastSave(req, session)
+	case CmdServerInfo:
+		h.HandleInfo(req, session)
 	case CmdSubscribe:
 		h.Pubhub.Subscribe(req, session)
 	case CmdUnsubscribe:
 		h.Pubhub.Unsubscribe(req, session)
 	case CmdPublish:
 		h.Pubhub.Publish(req, session)
+	case CmdPSubscribe:
+		h.Pubhub.PSubscribe(req, session)
+	case CmdPUnsubscribe:
+		h.Pubhub.PUnsubscribe(req, session)
+	case CmdPubSub:
+		h.Pubhub.PubSub(req, session)
+	case CmdReplicaOf:
+		h.HandleReplicaOf(req, session)
+	case CmdReplConf:
+		h.HandleReplConf(req, session)
+	case CmdCluster:
+		h.HandleCluster(req, session)
+	case CmdExec:
+		h.DBs[session.DBIndex].ExecExec(req, session, h.AOF, h.DBs)
 	default: // 剩下的就是 DB 命令了
 		h.ExecDB(req, session, writeAOF)
 	}
 }
 
-func (h *Handler) Close() {
+// queueTxCmd 入队时检查参数个数，出错与 DB 指令一样放弃整个事务
+func (h *Handler) queueTxCmd(req *Req, session *Session, argc int) {
+	if len(req.Args) != argc {
+		session.TxDirty = true
+		session.WriteError(req.SeqID, "Invalid Arg Count")
+		return
+	}
+	session.ReqQueue = append(session.ReqQueue, req)
+	session.WriteStatus(req.SeqID, "QUEUED")
+}
+
+func (h *Handler) handleReadErr(session *Session, err error) {
+	if IsClosedErr(err) {
+		Info("Close %s", session.Conn.RemoteAddr())
+		return
+	}
+	if errors.Is(err, ErrProtocol) { // 与 redis 一致先告知客户端再断开
+		session.WriteError("", err.Error())
+	}
+	Warn("Read %s err %v", session.Conn.RemoteAddr(), err)
+}
 
+// CloseSession 连接断开后释放会话持有的订阅等资源
+func (h *Handler) CloseSession(session *Session) {
+	h.Pubhub.UnsubscribeAll(session)
+	session.StopPush()
+	session.UnwatchAll()
+	if waiter := session.Waiter; waiter != nil {
+		waiter.DB.CancelWaiter(waiter, NewNilReply())
+	}
+}
+
+func (h *Handler) Close() {
+	h.Repl.Close()
 }
 
 func (h *Handler) HandlePing(req *Req, session *Session) {
@@ -66,24 +300,117 @@ func (h *Handler) HandlePing(req *Req, session *Session) {
 		session.WriteError(req.SeqID, "Invalid Args")
 		return
 	}
-	session.WriteResp(&Resp{
-		SeqID: req.SeqID,
-		Cmd:   "PONG",
-		Args:  req.Args,
-	})
+	if session.Proto == ProtoRESP2 && session.SubCount() > 0 { // 订阅期间与 redis 一致回复数组
+		msg := ""
+		if len(req.Args) == 1 {
+			msg = req.Args[0]
+		}
+		session.WriteStrs(req.SeqID, []string{"pong", msg})
+		return
+	}
+	if len(req.Args) == 1 {
+		session.WriteBulk(req.SeqID, req.Args[0])
+	} else {
+		session.WriteStatus(req.SeqID, "PONG")
+	}
 }
 
+// HandleReset 恢复到刚建立连接的状态，放弃事务、取消 watch 与全部订阅
+func (h *Handler) HandleReset(req *Req, session *Session) {
+	if len(req.Args) > 0 {
+		session.WriteError(req.SeqID, "Invalid Args")
+		return
+	}
+	session.ResetTx()
+	h.Pubhub.UnsubscribeAll(session)
+	session.DBIndex = 0
+	session.Name = ""
+	session.Auth = h.Conf.Passwd == ""
+	if session.Proto != ProtoJSON {
+		session.Proto = ProtoRESP2
+	}
+	session.WriteStatus(req.SeqID, "RESET")
+}
+
+// auth passwd 或 auth default passwd 只有 default 一个用户
 func (h *Handler) HandleAuth(req *Req, session *Session) {
-	if len(req.Args) != 1 {
+	if len(req.Args) != 1 && len(req.Args) != 2 {
 		session.WriteError(req.SeqID, "Invalid Args")
 		return
 	}
-	if req.Args[0] == h.Conf.Passwd {
+	user := "default"
+	if len(req.Args) == 2 {
+		user = req.Args[0]
+	}
+	if h.login(session, user, req.Args[len(req.Args)-1]) {
 		session.WriteOk(req.SeqID)
-		session.Auth = true
 	} else {
-		session.WriteError(req.SeqID, "Invalid Passwd")
+		session.WriteError(req.SeqID, "WRONGPASS invalid username-password pair")
+	}
+}
+
+func (h *Handler) login(session *Session, user string, passwd string) bool {
+	if user != "default" || passwd != h.Conf.Passwd {
+		return false
+	}
+	session.Auth = true
+	return true
+}
+
+// hello [protover [AUTH user passwd] [SETNAME name]] 一次完成协议协商 登录 与命名
+func (h *Handler) HandleHello(req *Req, session *Session) {
+	proto := session.Proto
+	if len(req.Args) > 0 {
+		ver, err := strconv.ParseInt(req.Args[0], 10, 64)
+		if err != nil || (ver != ProtoRESP2 && ver != ProtoRESP3) {
+			session.WriteError(req.SeqID, "NOPROTO unsupported protocol version")
+			return
+		}
+		if proto != ProtoJSON { // json 协议的连接只借用登录与命名
+			proto = int(ver)
+		}
+	}
+	name := session.Name
+	for i := 1; i < len(req.Args); i++ {
+		switch strings.ToUpper(req.Args[i]) {
+		case CmdAuth:
+			if i+2 >= len(req.Args) {
+				session.WriteError(req.SeqID, "Invalid Hello Param")
+				return
+			}
+			if !h.login(session, req.Args[i+1], req.Args[i+2]) {
+				session.WriteError(req.SeqID, "WRONGPASS invalid username-password pair")
+				return
+			}
+			i += 2
+		case "SETNAME":
+			if i+1 >= len(req.Args) {
+				session.WriteError(req.SeqID, "Invalid Hello Param")
+				return
+			}
+			name = req.Args[i+1]
+			i++
+		default:
+			session.WriteError(req.SeqID, "Invalid Hello Param "+req.Args[i])
+			return
+		}
+	}
+	if !session.Auth {
+		session.WriteError(req.SeqID, "NOAUTH HELLO must be called with the client already authenticated, or use HELLO <proto> AUTH <user> <pass>")
+		return
 	}
+	// 全部校验通过才生效
+	session.Proto = proto
+	session.Name = name
+	session.WriteReply(req.SeqID, NewMapReply([]*Reply{
+		NewBulkReply("server"), NewBulkReply("redis"),
+		NewBulkReply("version"), NewBulkReply("7.0.0"),
+		NewBulkReply("proto"), NewIntReply(int64(max(proto, ProtoRESP2))),
+		NewBulkReply("id"), NewIntReply(session.ID),
+		NewBulkReply("mode"), NewBulkReply(h.Mode()),
+		NewBulkReply("role"), NewBulkReply(h.Repl.Role()),
+		NewBulkReply("modules"), NewArrayReply(make([]*Reply, 0)),
+	}))
 }
 
 func (h *Handler) HandleSelect(req *Req, session *Session) {
@@ -101,7 +428,7 @@ func (h *Handler) HandleSelect(req *Req, session *Session) {
 		Error("Invalid Index %s , err %s", req.Args[0], ToStr(err))
 		return
 	}
-	if index < 0 && index >= int64(h.Conf.MaxDB) {
+	if index < 0 || index >= int64(h.Conf.MaxDB) {
 		session.WriteError(req.SeqID, "Index Out Of Range")
 		return
 	}
@@ -114,30 +441,84 @@ func (h *Handler) ExecDB(req *Req, session *Session, writeAOF bool) {
 	db.Exec(req, session, h.AOF, writeAOF)
 }
 
-func (h *Handler) ForEach(callback func(int, string, *Entry)) {
-	for i := 0; i < len(h.DBs); i++ {
-		h.DBs[i].ForEach(func(key string, entry *Entry) {
-			callback(i, key, entry)
-		})
+func (h *Handler) HandleBGRewriteAOF(req *Req, session *Session) {
+	if err := h.BGRewriteAOF(); err != nil {
+		session.WriteError(req.SeqID, err.Error())
+		return
 	}
+	session.WriteStatus(req.SeqID, "Background append only file rewriting started")
 }
 
-func (h *Handler) HandleBGRewriteAOF(req *Req, session *Session) {
-	go h.AOF.ReWrite(h.Conf.AOFFile, h.Conf)
+func (h *Handler) HandleSave(req *Req, session *Session) {
+	if err := h.Save(); err != nil {
+		session.WriteError(req.SeqID, err.Error())
+		return
+	}
 	session.WriteOk(req.SeqID)
 }
 
+func (h *Handler) HandleBGSave(req *Req, session *Session) {
+	if err := h.BGSave(); err != nil {
+		session.WriteError(req.SeqID, err.Error())
+		return
+	}
+	session.WriteStatus(req.SeqID, "Background saving started")
+}
+
+func (h *Handler) HandleLastSave(req *Req, session *Session) {
+	session.WriteReply(req.SeqID, NewIntReply(h.RDB.GetLastSave().Unix()))
+}
+
 func (h *Handler) HandleDBSize(req *Req, session *Session) {
 	db := h.DBs[session.DBIndex]
 	session.WriteNum(req.SeqID, db.GetSize())
 }
 
+func (h *Handler) HandleFlushDB(req *Req, session *Session) {
+	if len(req.Args) > 0 {
+		session.WriteError(req.SeqID, "Invalid Args")
+		return
+	}
+	h.DBs[session.DBIndex].Flush()
+	session.WriteOk(req.SeqID)
+}
+
+// HandleFlushAll 逐个清空，aof 中记录为每个数据库的 flushdb
+func (h *Handler) HandleFlushAll(req *Req, session *Session) {
+	if len(req.Args) > 0 {
+		session.WriteError(req.SeqID, "Invalid Args")
+		return
+	}
+	for _, db := range h.DBs {
+		db.Flush()
+	}
+	session.WriteOk(req.SeqID)
+}
+
 func NewHandler(conf *Conf) *Handler {
+	aof := NewAOF(conf.AOFFile, conf.AOFFsync)
+	timeWheel := NewTimeWheel(TimeWheelSlots, TimeWheelInterval)
+	var executor *Executor
+	if conf.SingleThread {
+		executor = NewExecutor()
+	}
+	notifyFlags, err := ParseNotifyFlags(conf.NotifyKeyspaceEvents)
+	HandleErr(err)
+	pubhub := NewPubhub(notifyFlags)
+	repl := NewRepl(conf.ReplBacklogSize)
+	aof.Repl = repl
 	dbs := make([]*DB, 0)
 	for i := 0; i < conf.MaxDB; i++ {
-		dbs = append(dbs, NewDB(conf))
+		dbs = append(dbs, NewDB(conf, i, aof, timeWheel, executor, pubhub))
+	}
+	var cluster *Cluster
+	if len(conf.Peers) > 0 {
+		cluster = NewCluster(net.JoinHostPort(conf.Ip, strconv.Itoa(conf.Port)), conf.Peers, conf.ClusterConfigFile)
+	}
+	for _, db := range dbs {
+		db.Cluster, db.Repl = cluster, repl
 	}
-	res := &Handler{Conf: conf, DBs: dbs, Pubhub: NewPubhub(), AOF: NewAOF(conf.AOFFile, conf.AOFFsync)}
-	res.AOF.LoadAOF(res, conf.AOFFile, 0)
+	res := &Handler{Conf: conf, Cluster: cluster, DBs: dbs, Pubhub: pubhub, Repl: repl, AOF: aof, RDB: NewRDB(conf.RDBFile), TimeWheel: timeWheel, Executor: executor}
+	res.Load()
 	return res
 }
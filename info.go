@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+type InfoSection struct {
+	Name  string
+	Title string
+	Lines func(h *Handler) []string
+}
+
+var (
+	infoSections = []*InfoSection{
+		{Name: "server", Title: "Server", Lines: (*Handler).infoServer},
+		{Name: "persistence", Title: "Persistence", Lines: (*Handler).infoPersistence},
+		{Name: "replication", Title: "Replication", Lines: (*Handler).infoReplication},
+		{Name: "cluster", Title: "Cluster", Lines: (*Handler).infoCluster},
+	}
+)
+
+// HandleInfo info [section ...] 不指定或者指定 all default 时返回全部
+func (h *Handler) HandleInfo(req *Req, session *Session) {
+	names := make(map[string]bool)
+	for _, arg := range req.Args {
+		names[strings.ToLower(arg)] = true
+	}
+	all := len(names) == 0 || names["all"] || names["default"] || names["everything"]
+	buff := &strings.Builder{}
+	for _, section := range infoSections {
+		if !all && !names[section.Name] {
+			continue
+		}
+		if buff.Len() > 0 {
+			buff.WriteString("\r\n")
+		}
+		buff.WriteString("# " + section.Title + "\r\n")
+		for _, line := range section.Lines(h) {
+			buff.WriteString(line + "\r\n")
+		}
+	}
+	session.WriteBulk(req.SeqID, buff.String())
+}
+
+func (h *Handler) infoServer() []string {
+	return []string{
+		"redis_version:7.0.0",
+		"redis_mode:" + h.Mode(),
+		fmt.Sprintf("process_id:%d", os.Getpid()),
+		fmt.Sprintf("tcp_port:%d", h.Conf.Port),
+		fmt.Sprintf("single_thread:%d", boolToInt(h.Executor != nil)),
+	}
+}
+
+func (h *Handler) infoPersistence() []string {
+	res := []string{
+		fmt.Sprintf("rdb_changes_since_last_save:%d", h.GetDirty()),
+	}
+	h.RDB.Lock.Lock()
+	res = append(res,
+		fmt.Sprintf("rdb_bgsave_in_progress:%d", boolToInt(h.RDB.Saving)),
+		fmt.Sprintf("rdb_last_save_time:%d", h.RDB.LastSave.Unix()),
+		fmt.Sprintf("rdb_last_bgsave_status:%s", statusStr(h.RDB.LastStatus)),
+	)
+	h.RDB.Lock.Unlock()
+	a := h.AOF
+	a.Lock.Lock()
+	defer a.Lock.Unlock()
+	current, bufferLen := int64(-1), 0
+	if a.Rewriting {
+		current = int64(time.Since(a.RewriteStart) / time.Second)
+		if a.RewriteBuff != nil {
+			bufferLen = a.RewriteBuff.Len()
+		}
+	}
+	last := int64(-1)
+	if a.LastRewriteTime >= 0 {
+		last = int64(a.LastRewriteTime / time.Second)
+	}
+	return append(res,
+		"aof_enabled:1",
+		fmt.Sprintf("aof_rewrite_in_progress:%d", boolToInt(a.Rewriting)),
+		fmt.Sprintf("aof_last_rewrite_time_sec:%d", last),
+		fmt.Sprintf("aof_current_rewrite_time_sec:%d", current),
+		fmt.Sprintf("aof_last_bgrewrite_status:%s", statusStr(a.LastRewriteStatus)),
+		fmt.Sprintf("aof_rewrite_buffer_length:%d", bufferLen),
+		fmt.Sprintf("aof_current_size:%d", a.Size()),
+		fmt.Sprintf("aof_base_size:%d", a.BaseSize),
+	)
+}
+
+func boolToInt(val bool) int {
+	if val {
+		return 1
+	}
+	return 0
+}
+
+func statusStr(ok bool) string {
+	if ok {
+		return "ok"
+	}
+	return "err"
+}
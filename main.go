@@ -9,17 +9,23 @@ import (
 
 // https://github.com/gofish2020/easyredis
 // string set get(支持多个无需mset,mget) incrby(支持负数无需decr) setnx(同样支持多个) setex
-// zset zadd zrem zrange zcard zscore zrank
-// hash 简单 map 暂不支持
-// list 简单双向链表暂不支持
-// set 类似值为 null 的 hash 暂时不支持
-// ping auth select dbsize bgrewriteaof
-// subscribe unsubscribe publish
+// zset zadd zrem zrange zcard zscore zrank zpopmin zpopmax bzpopmin bzpopmax
+// hash hset hsetnx hget hmget hdel hexists hlen hkeys hvals hgetall hincrby hincrbyfloat hstrlen hrandfield hscan
+// list lpush rpush lpushx rpushx lpop rpop lrange lindex lset linsert llen lrem ltrim lpos lmove blpop brpop blmove 分片存储按下标二分定位
+// set sadd srem sismember smismember smembers scard spop srandmember smove sinter sunion sdiff sinterstore sunionstore sdiffstore sintercard sscan 小整数集合使用 intset 编码
+// ping auth hello reset select dbsize flushdb flushall bgrewriteaof save bgsave lastsave info 快照记录对应的 aof 位置，启动时只需要重放之后的部分
+// replicaof replconf psync wait 复制流与 aof 的格式一致，主节点保留积压缓冲用于断线后的部分同步
+// cluster nodes slots keyslot info myid 集群基于 ConsistencyMap 拆分 hash 范围，key 不属于自己时返回 MOVED
+// cluster addnode setrange getkeysinrange asking migrate restore 在线迁移范围，迁移中已经迁走的 key 返回 ASK
+// subscribe unsubscribe publish psubscribe punsubscribe pubsub 模式订阅使用 glob 语法，发布时逐个匹配
 // multi discard exec watch unwatch
-// exists type ttl del expire persist
+// exists type ttl del expire persist 过期 key 由时间轮主动删除
 // scan 是每次扫描，以一个分片 map 下的一个 hash 槽为单位进行扫描 返回数量可能大于 count
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check-aof" { // 离线校验与修复 aof 文件
+		os.Exit(CheckAOF(os.Args[2:]))
+	}
 	// 非阻塞启动服务
 	conf := GetConf()
 	server := NewServer(conf)
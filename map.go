@@ -1,8 +1,9 @@
 package main
 
 import (
-	"hash"
-	"hash/fnv"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -11,12 +12,16 @@ type Entry struct {
 	Str      string    // string  str/int 都存储在这里暂时不单独存储 int 编码
 	Time     time.Time // 过期时间
 	SkipList *SkipList
-	Version  int
+	Hash     *Dict[string]
+	List     *QuickList
+	Set      *Set
 }
 
 type Shard struct {
 	Data map[string]*Entry
-	// 每个分片独立的读写锁
+	Lock sync.RWMutex // 每个分片独立的读写锁，由 Map.Lock 在指令执行前统一加锁
+	// 还没有编码这个分片的快照，持有写锁或者在执行协程中访问，Clear 不会清空
+	Snapshots []*Snapshot
 }
 
 func (s *Shard) Put(key string, entry *Entry) bool {
@@ -38,6 +43,8 @@ func (s *Shard) Del(key string) bool {
 }
 
 func (s *Shard) ForEach(callback func(string, *Entry)) {
+	s.Lock.RLock()
+	defer s.Lock.RUnlock()
 	for key, entry := range s.Data {
 		callback(key, entry)
 	}
@@ -47,24 +54,73 @@ func NewShard() *Shard {
 	return &Shard{Data: make(map[string]*Entry)}
 }
 
+// Map 读写数据前调用方需要先通过 Lock 对 key 所在的分片加锁，ForEach 除外
 type Map struct {
-	Shards   []*Shard    // 分多个加锁，减小锁的粒度
-	Count    int         // 一般会修改 Count 为比原来大的 2 的幂数  这样就可以把 % 换成位运算了
-	AllCount int         // 一般使用原子 Int 记录总数量
-	Hash     hash.Hash64 // hash 函数
+	Shards   []*Shard     // 分多个加锁，减小锁的粒度
+	Count    int          // 一般会修改 Count 为比原来大的 2 的幂数  这样就可以把 % 换成位运算了
+	AllCount atomic.Int64 // 不同分片并发修改
 }
 
 func (m *Map) GetIndex(key string) uint64 {
-	m.Hash.Reset()
-	_, err := m.Hash.Write([]byte(key))
-	HandleErr(err)
-	return m.Hash.Sum64() % uint64(m.Count)
+	return HashStr(key) % uint64(m.Count)
+}
+
+// Lock 按分片下标从小到大加锁，多 key 指令之间不会死锁，同一分片只加一次锁，既有读又有写时加写锁
+func (m *Map) Lock(writeKeys []string, readKeys []string) func() {
+	writes := make(map[uint64]bool)
+	for _, key := range readKeys {
+		writes[m.GetIndex(key)] = false
+	}
+	for _, key := range writeKeys {
+		writes[m.GetIndex(key)] = true
+	}
+	idxes := make([]uint64, 0, len(writes))
+	for idx := range writes {
+		idxes = append(idxes, idx)
+	}
+	slices.Sort(idxes)
+	for _, idx := range idxes {
+		if writes[idx] {
+			m.Shards[idx].Lock.Lock()
+		} else {
+			m.Shards[idx].Lock.RLock()
+		}
+	}
+	return func() {
+		for i := len(idxes) - 1; i >= 0; i-- {
+			if writes[idxes[i]] {
+				m.Shards[idxes[i]].Lock.Unlock()
+			} else {
+				m.Shards[idxes[i]].Lock.RUnlock()
+			}
+		}
+	}
+}
+
+// LockAll 按分片顺序对全部分片加写锁，用于清空数据
+func (m *Map) LockAll() func() {
+	for _, shard := range m.Shards {
+		shard.Lock.Lock()
+	}
+	return func() {
+		for i := len(m.Shards) - 1; i >= 0; i-- {
+			m.Shards[i].Lock.Unlock()
+		}
+	}
+}
+
+// Clear 调用方需要持有全部分片的写锁
+func (m *Map) Clear() {
+	for _, shard := range m.Shards {
+		shard.Data = make(map[string]*Entry)
+	}
+	m.AllCount.Store(0)
 }
 
 func (m *Map) Put(key string, entry *Entry) {
 	idx := m.GetIndex(key)
 	if m.Shards[idx].Put(key, entry) {
-		m.AllCount++
+		m.AllCount.Add(1)
 	}
 }
 
@@ -76,7 +132,7 @@ func (m *Map) Get(key string) *Entry {
 func (m *Map) Del(key string) {
 	idx := m.GetIndex(key)
 	if m.Shards[idx].Del(key) {
-		m.AllCount--
+		m.AllCount.Add(-1)
 	}
 }
 
@@ -87,7 +143,7 @@ func (m *Map) ForEach(callback func(string, *Entry)) {
 }
 
 func (m *Map) GetSize() int {
-	return m.AllCount
+	return int(m.AllCount.Load())
 }
 
 func NewMap(count int) *Map {
@@ -95,5 +151,5 @@ func NewMap(count int) *Map {
 	for i := 0; i < count; i++ {
 		shards = append(shards, NewShard())
 	}
-	return &Map{Count: count, Shards: shards, Hash: fnv.New64()}
+	return &Map{Count: count, Shards: shards}
 }
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrateKeys migrate host port key|"" db timeout ... keys k1 k2，key 为空时使用 keys 之后的全部 key
+func migrateKeys(args []string) []string {
+	if len(args) < 5 {
+		return nil
+	}
+	if args[2] != "" {
+		return []string{args[2]}
+	}
+	for i := 5; i < len(args); i++ {
+		if strings.EqualFold(args[i], "KEYS") {
+			return args[i+1:]
+		}
+	}
+	return nil
+}
+
+//=====================MigrateCmd=====================
+
+type MigrateCmd struct {
+}
+
+// migrate host port key|"" db timeout [copy] [replace] [auth password] [keys key...]
+// 在 key 的锁内编码 key 与剩余的过期时间，连接目标节点与等待回复都在锁外由 Handler.FinishMigrate 完成
+// 目标节点确认后重新加锁删除本地的 key，发送期间被修改过的 key 保留在本地，之后访问时集群检查返回 ASK
+func (m *MigrateCmd) Exec(db *DB, req *Req, session *Session) {
+	args := req.Args
+	index, err := strconv.Atoi(args[3])
+	if err != nil || index < 0 {
+		session.WriteError(req.SeqID, "Invalid DB Index")
+		return
+	}
+	timeout, err := strconv.Atoi(args[4])
+	if err != nil || timeout < 0 {
+		session.WriteError(req.SeqID, "Invalid Timeout")
+		return
+	}
+	if timeout == 0 {
+		timeout = 1000
+	}
+	migration := &Migration{
+		DB:      db,
+		SeqID:   req.SeqID,
+		Addr:    net.JoinHostPort(args[0], args[1]),
+		Index:   index,
+		Timeout: time.Duration(timeout) * time.Millisecond,
+	}
+	for i := 5; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COPY":
+			migration.Copy = true
+		case "REPLACE":
+			migration.Replace = true
+		case "AUTH":
+			if i+1 >= len(args) {
+				session.WriteError(req.SeqID, "Invalid Migrate Param")
+				return
+			}
+			migration.Auth = args[i+1]
+			i++
+		case "KEYS":
+			if args[2] != "" {
+				session.WriteError(req.SeqID, "When using MIGRATE KEYS option, the key argument must be set to the empty string")
+				return
+			}
+			i = len(args)
+		default:
+			session.WriteError(req.SeqID, "Invalid Migrate Param")
+			return
+		}
+	}
+	for _, key := range migrateKeys(args) {
+		entry := db.GetEntry(key)
+		if entry == nil || slices.ContainsFunc(migration.Items, func(item *MigrateItem) bool { return item.Key == key }) {
+			continue
+		}
+		migration.Items = append(migration.Items, &MigrateItem{
+			Key:     key,
+			PTTL:    db.GetPTTL(key),
+			TTL:     db.TTLMap.Get(key),
+			Payload: DumpEntry(key, entry),
+		})
+	}
+	if len(migration.Items) == 0 {
+		session.WriteStatus(req.SeqID, "NOKEY")
+		return
+	}
+	session.Migration = migration
+}
+
+// Migration migrate 在锁内编码好的全部 key 以及目标节点的信息
+type Migration struct {
+	DB      *DB
+	SeqID   string
+	Addr    string
+	Index   int
+	Timeout time.Duration // 连接以及每条指令单独计算
+	Copy    bool
+	Replace bool
+	Auth    string
+	Items   []*MigrateItem
+}
+
+type MigrateItem struct {
+	Key     string
+	PTTL    int64  // 发送给目标节点的剩余毫秒数，0 表示没有过期时间
+	TTL     *Entry // 编码时的过期时间，删除前与当前的比较，设置过期时间总会替换为新的 Entry
+	Payload string
+}
+
+// send 不持有任何锁，返回目标节点确认的 key 的个数，出错之前已经迁移成功的 key 仍然需要删除
+func (m *Migration) send() (int, error) {
+	conn, err := net.DialTimeout("tcp", m.Addr, m.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("IOERR error or timeout connecting to the client %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	call := func(args ...string) error {
+		conn.SetDeadline(time.Now().Add(m.Timeout))
+		if _, err := replCall(conn, reader, args...); err != nil {
+			return errors.New("Target instance replied with error: " + err.Error())
+		}
+		return nil
+	}
+	if m.Auth != "" {
+		if err = call(CmdAuth, m.Auth); err != nil {
+			return 0, err
+		}
+	}
+	if err = call(CmdSelect, strconv.Itoa(m.Index)); err != nil {
+		return 0, err
+	}
+	for i, item := range m.Items {
+		restore := []string{CmdRestoreAsking, item.Key, strconv.FormatInt(item.PTTL, 10), item.Payload}
+		if m.Replace {
+			restore = append(restore, "REPLACE")
+		}
+		if err = call(restore...); err != nil {
+			return i, err
+		}
+	}
+	return len(m.Items), nil
+}
+
+// FinishMigrate 在连接协程中发送 migrate 编码好的数据，之后重新加锁删除本地的 key 并回复
+func (h *Handler) FinishMigrate(session *Session) {
+	migration := session.Migration
+	session.Migration = nil
+	sent, err := migration.send()
+	h.ExecTask(session, func() {
+		migration.DB.finishMigrate(migration, session, sent, err)
+	})
+}
+
+// finishMigrate 只删除内容与过期时间都没有变化的 key，发送期间被修改过的 key 与目标节点不一致，保留在本地并报错
+func (d *DB) finishMigrate(migration *Migration, session *Session, sent int, err error) {
+	changed := make([]string, 0)
+	if !migration.Copy && sent > 0 {
+		keys := make([]string, 0, sent)
+		for _, item := range migration.Items[:sent] {
+			keys = append(keys, item.Key)
+		}
+		unlock := d.LockKeys(keys, true)
+		defer unlock()
+		for _, item := range migration.Items[:sent] {
+			entry := d.GetEntry(item.Key)
+			if entry == nil {
+				continue
+			}
+			if d.TTLMap.Get(item.Key) != item.TTL || DumpEntry(item.Key, entry) != item.Payload {
+				changed = append(changed, item.Key)
+				continue
+			}
+			d.DelEntry(item.Key)
+			d.Propagate(session, &Req{Cmd: CmdDel, Args: []string{item.Key}})
+			d.Notify(NotifyGeneric, "del", item.Key)
+		}
+	}
+	switch {
+	case err != nil:
+		session.WriteError(migration.SeqID, err.Error())
+	case len(changed) > 0:
+		session.WriteError(migration.SeqID, "Keys Changed During Migrate "+strings.Join(changed, " "))
+	default:
+		session.WriteOk(migration.SeqID)
+	}
+}
+
+// DumpEntry 只包含一个 key 的快照，没有过期时间，过期时间由 restore 的参数单独传递
+func DumpEntry(key string, entry *Entry) string {
+	encoder := NewRDBEncoder()
+	encoder.WriteEntry(key, entry, nil)
+	return string(encoder.Finish())
+}
+
+// LoadEntry 解析 DumpEntry 的结果，数据损坏时返回错误
+func LoadEntry(payload string) (res *Entry, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			res, err = nil, fmt.Errorf("%v", r)
+		}
+	}()
+	decoder := NewRDBDecoder(strings.NewReader(payload))
+	decoder.ReadHead()
+	decoder.ReadEntries(func(_ int, _ string, entry *Entry, _ time.Time) {
+		res = entry
+	})
+	if res == nil {
+		return nil, fmt.Errorf("empty payload")
+	}
+	return res, nil
+}
+
+//=====================RestoreCmd=====================
+
+type RestoreCmd struct {
+}
+
+// restore key ttl payload [replace]  ttl 为毫秒，0 表示没有过期时间
+// 快照不能写入 aof，改为记录能够还原这个 key 的普通指令
+func (r *RestoreCmd) Exec(db *DB, req *Req, session *Session) {
+	key := req.Args[0]
+	ttl, err := strconv.ParseInt(req.Args[1], 10, 64)
+	if err != nil || ttl < 0 {
+		session.WriteError(req.SeqID, "Invalid TTL")
+		return
+	}
+	replace := false
+	for _, arg := range req.Args[3:] {
+		if !strings.EqualFold(arg, "REPLACE") {
+			session.WriteError(req.SeqID, "Invalid Restore Param")
+			return
+		}
+		replace = true
+	}
+	exist := db.GetEntry(key) != nil
+	if exist && !replace {
+		session.WriteError(req.SeqID, "BUSYKEY Target key name already exists.")
+		return
+	}
+	entry, err := LoadEntry(req.Args[2])
+	if err != nil {
+		Error("Restore %s Err %v", key, err)
+		session.WriteError(req.SeqID, "Bad Restore Payload")
+		return
+	}
+	if exist {
+		db.DelEntry(key)
+		db.writeAOF(session, &Req{Cmd: CmdDel, Args: []string{key}})
+	}
+	db.PutEntry(key, entry)
+	db.writeAOF(session, entryReq(key, entry))
+	if ttl > 0 {
+		time0 := time.Now().Add(time.Duration(ttl) * time.Millisecond)
+		db.putTTL(key, time0)
+		// absexpire 以秒为单位，向上取整，不足一秒的部分截断会让重放后的 key 提前过期
+		expireAt := (time0.UnixMilli() + 999) / 1000
+		db.writeAOF(session, &Req{Cmd: CmdAbsExpire, Args: []string{key, strconv.FormatInt(expireAt, 10)}})
+	}
+	db.Notify(NotifyGeneric, "restore", key)
+	db.SignalReady(key)
+	session.WriteOk(req.SeqID)
+}
@@ -1,80 +1,192 @@
 package main
 
-import "strconv"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
 
-type SessionNode struct {
-	Session *Session
-	Next    *SessionNode
-}
+var (
+	subscribeCmdSet = map[string]bool{ // RESP2 连接订阅期间只允许的指令，ping 与 reset 在登录检查之前已经处理
+		CmdSubscribe:    true,
+		CmdUnsubscribe:  true,
+		CmdPSubscribe:   true,
+		CmdPUnsubscribe: true,
+	}
+)
+
+// Subscribers 订阅同一个通道或模式的会话集合
+type Subscribers map[*Session]bool
 
 type Pubhub struct {
-	Data map[string]*SessionNode
-	// 注意操作都是需要加锁的  可以根据 通道进行 hash 使用对应的锁 保证同一通道的互斥
+	Data        map[string]Subscribers // 通道 -> 订阅的会话，没有会话订阅时直接删除
+	Patterns    map[string]Subscribers // 模式 -> 订阅的会话，发布时逐个匹配
+	Lock        sync.RWMutex           // 订阅与取消订阅加写锁，发布只需要读锁
+	NotifyFlags int                    // 开启的键空间通知类型
 }
 
-func NewPubhub() *Pubhub {
-	return &Pubhub{Data: make(map[string]*SessionNode)}
+func NewPubhub(notifyFlags int) *Pubhub {
+	return &Pubhub{Data: make(map[string]Subscribers), Patterns: make(map[string]Subscribers), NotifyFlags: notifyFlags}
+}
+
+// ParseNotifyFlags 解析 notify-keyspace-events 配置，K E 都没有时不会发布任何通知
+func ParseNotifyFlags(str string) (int, error) {
+	flags := 0
+	for _, char := range str {
+		switch char {
+		case 'K':
+			flags |= NotifyKeyspace
+		case 'E':
+			flags |= NotifyKeyevent
+		case 'g':
+			flags |= NotifyGeneric
+		case '$':
+			flags |= NotifyString
+		case 'l':
+			flags |= NotifyList
+		case 's':
+			flags |= NotifySet
+		case 'h':
+			flags |= NotifyHash
+		case 'z':
+			flags |= NotifyZSet
+		case 'x':
+			flags |= NotifyExpired
+		case 'e':
+			flags |= NotifyEvicted
+		case 'n':
+			flags |= NotifyNew
+		case 'A':
+			flags |= NotifyAll
+		default:
+			return 0, fmt.Errorf("invalid notify keyspace event %q", char)
+		}
+	}
+	return flags, nil
+}
+
+// Notify 发布键空间通知，class 为事件所属的类型，修改 key 的连接订阅了也会收到
+func (p *Pubhub) Notify(class int, event string, index int, key string) {
+	if p.NotifyFlags&class == 0 || p.NotifyFlags&(NotifyKeyspace|NotifyKeyevent) == 0 {
+		return
+	}
+	p.Lock.RLock()
+	defer p.Lock.RUnlock()
+	if len(p.Data) == 0 && len(p.Patterns) == 0 {
+		return
+	}
+	db := strconv.Itoa(index)
+	if p.NotifyFlags&NotifyKeyspace != 0 {
+		p.publish("__keyspace@"+db+"__:"+key, event, nil)
+	}
+	if p.NotifyFlags&NotifyKeyevent != 0 {
+		p.publish("__keyevent@"+db+"__:"+event, key, nil)
+	}
+}
+
+func (p *Pubhub) table(pattern bool) map[string]Subscribers {
+	if pattern {
+		return p.Patterns
+	}
+	return p.Data
 }
 
 // Subscribe ch1 ch2
 func (p *Pubhub) Subscribe(req *Req, session *Session) {
+	p.subscribe(req, session, false)
+}
+
+// PSubscribe pattern1 pattern2  模式与 scan 的 match 一样使用 glob 语法
+func (p *Pubhub) PSubscribe(req *Req, session *Session) {
+	p.subscribe(req, session, true)
+}
+
+func (p *Pubhub) subscribe(req *Req, session *Session, pattern bool) {
 	if len(req.Args) == 0 {
 		session.WriteError(req.SeqID, "Invalid Arg Count")
 		return
 	}
-	args := make([]string, 0)
+	kind := "subscribe"
+	if pattern {
+		kind = "psubscribe"
+	}
+	session.StartPush()
+	p.Lock.Lock()
+	defer p.Lock.Unlock()
+	table := p.table(pattern)
 	for _, channel := range req.Args {
-		if session.Subscribe(channel) { // 订阅成功了 是本次新增的
-			p.Data[channel] = p.addNode(p.Data[channel], session)
-			args = append(args, channel)
+		if session.Subscribe(channel, pattern) { // 订阅成功了 是本次新增的
+			if table[channel] == nil {
+				table[channel] = make(Subscribers)
+			}
+			table[channel][session] = true
 		}
+		// 每个通道单独回复一次，附带当前订阅总数，持有锁时入队不能等待，否则跟不上的订阅者会阻塞所有发布者
+		session.WriteSubReply(req.SeqID, p.subReply(kind, channel, session.SubCount()))
 	}
-	args = append(args, strconv.FormatInt(int64(len(args)), 10))
-	session.WriteOk(req.SeqID, args...)
 }
 
 // Unsubscribe ch1 ch2
 func (p *Pubhub) Unsubscribe(req *Req, session *Session) {
+	p.unsubscribe(req, session, false)
+}
+
+// PUnsubscribe pattern1 pattern2
+func (p *Pubhub) PUnsubscribe(req *Req, session *Session) {
+	p.unsubscribe(req, session, true)
+}
+
+func (p *Pubhub) unsubscribe(req *Req, session *Session, pattern bool) {
+	kind := "unsubscribe"
+	if pattern {
+		kind = "punsubscribe"
+	}
 	channels := req.Args
 	if len(channels) == 0 { // 没有选择就取消全部
-		channels = session.GetChannels()
+		channels = session.GetChannels(pattern)
+	}
+	if len(channels) == 0 { // 没有任何订阅也需要回复
+		session.WriteReply(req.SeqID, &Reply{Type: ReplyPush, Items: []*Reply{NewBulkReply(kind), NewNilReply(), NewIntReply(int64(session.SubCount()))}})
+		return
 	}
-	args := make([]string, 0)
+	replies := make([]*Reply, 0, len(channels))
+	p.Lock.Lock()
 	for _, channel := range channels {
-		if session.Unsubscribe(channel) {
-			p.Data[channel] = p.delNode(p.Data[channel], session)
-			// 也可以在空的时间进行删除
-			args = append(args, channel)
+		if session.Unsubscribe(channel, pattern) {
+			p.delSession(p.table(pattern), channel, session)
 		}
+		replies = append(replies, p.subReply(kind, channel, session.SubCount()))
+	}
+	p.Lock.Unlock()
+	// 回复可能等待推送队列，释放锁之后再写出，之后不会再有这些通道的消息
+	for _, reply := range replies {
+		session.WriteReply(req.SeqID, reply)
 	}
-	args = append(args, strconv.FormatInt(int64(len(args)), 10))
-	session.WriteOk(req.SeqID, args...)
 }
 
-func (p *Pubhub) addNode(root *SessionNode, session *Session) *SessionNode {
-	if root == nil {
-		return &SessionNode{Session: session}
-	}
-	temp := root
-	for temp.Next != nil {
-		temp = temp.Next
+// UnsubscribeAll 连接断开时调用，不需要回复
+func (p *Pubhub) UnsubscribeAll(session *Session) {
+	p.Lock.Lock()
+	defer p.Lock.Unlock()
+	for _, pattern := range []bool{false, true} {
+		for _, channel := range session.GetChannels(pattern) {
+			session.Unsubscribe(channel, pattern)
+			p.delSession(p.table(pattern), channel, session)
+		}
 	}
-	temp.Next = &SessionNode{Session: session}
-	return root
 }
 
-func (p *Pubhub) delNode(node *SessionNode, session *Session) *SessionNode {
-	res := &SessionNode{}
-	temp := res
-	if node != nil {
-		if node.Session != session {
-			temp.Next = node
-			temp = temp.Next
-		}
-		node = node.Next
+// delSession 没有会话订阅的通道直接删除，pubsub channels 只返回活跃的通道
+func (p *Pubhub) delSession(table map[string]Subscribers, channel string, session *Session) {
+	delete(table[channel], session)
+	if len(table[channel]) == 0 {
+		delete(table, channel)
 	}
-	temp.Next = nil // 最后注意断开
-	return res.Next
+}
+
+func (p *Pubhub) subReply(kind string, channel string, count int) *Reply {
+	return &Reply{Type: ReplyPush, Items: []*Reply{NewBulkReply(kind), NewBulkReply(channel), NewIntReply(int64(count))}}
 }
 
 func (p *Pubhub) Publish(req *Req, session *Session) {
@@ -82,19 +194,75 @@ func (p *Pubhub) Publish(req *Req, session *Session) {
 		session.WriteError(req.SeqID, "Invalid Arg Count")
 		return
 	}
+	p.Lock.RLock()
+	count := p.publish(req.Args[0], req.Args[1], session)
+	p.Lock.RUnlock()
+	session.WriteNum(req.SeqID, count) // 发布者自己也可能是推送队列已满的订阅者
+}
+
+// publish 调用方需要持有读锁，返回收到消息的会话数，skip 为发布者自己
+func (p *Pubhub) publish(channel string, msg string, skip *Session) int {
 	count := 0
-	node := p.Data[req.Args[0]]
-	for node != nil {
+	for item := range p.Data[channel] {
 		/// 不要给自己发
-		if node.Session != session {
-			node.Session.WriteResp(&Resp{
-				SeqID: req.SeqID,
-				Cmd:   "MESSAGE",
-				Args:  req.Args,
-			})
+		if item != skip {
+			item.WritePush("message", channel, msg)
 			count++
 		}
-		node = node.Next
 	}
-	session.WriteNum(req.SeqID, count)
+	// 匹配的模式订阅者额外收到带有模式的 pmessage
+	for pattern, subscribers := range p.Patterns {
+		if !MatchGlob(pattern, channel) {
+			continue
+		}
+		for item := range subscribers {
+			if item != skip {
+				item.WritePush("pmessage", pattern, channel, msg)
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// PubSub channels [pattern] | numsub [ch1 ch2] | numpat
+func (p *Pubhub) PubSub(req *Req, session *Session) {
+	if len(req.Args) == 0 {
+		session.WriteError(req.SeqID, "Invalid Arg Count")
+		return
+	}
+	p.Lock.RLock()
+	reply := p.pubSub(req.Args)
+	p.Lock.RUnlock()
+	session.WriteReply(req.SeqID, reply) // 释放锁之后再写出，原因与 Publish 相同
+}
+
+// pubSub 调用方需要持有读锁
+func (p *Pubhub) pubSub(args []string) *Reply {
+	switch strings.ToUpper(args[0]) {
+	case "CHANNELS":
+		if len(args) > 2 {
+			return NewErrorReply("Invalid Arg Count")
+		}
+		res := make([]string, 0)
+		for channel := range p.Data {
+			if len(args) == 1 || MatchGlob(args[1], channel) {
+				res = append(res, channel)
+			}
+		}
+		return NewStrsReply(res)
+	case "NUMSUB":
+		items := make([]*Reply, 0)
+		for _, channel := range args[1:] {
+			items = append(items, NewBulkReply(channel), NewIntReply(int64(len(p.Data[channel]))))
+		}
+		return NewMapReply(items)
+	case "NUMPAT":
+		if len(args) != 1 {
+			return NewErrorReply("Invalid Arg Count")
+		}
+		return NewIntReply(int64(len(p.Patterns)))
+	default:
+		return NewErrorReply("Unknown PubSub Subcommand")
+	}
 }
@@ -0,0 +1,232 @@
+package main
+
+import "sort"
+
+type ListChunk struct {
+	Start int // 首个元素的虚拟下标  分片按 Start 递增，可以二分定位
+	Items []string
+}
+
+// QuickList 分片存储的双端链表，两端增删只修改首尾分片的 Start 不需要整体重建下标
+// 按下标访问时二分定位到分片 O(log(n/QuickListChunkSize))，中间插入删除才需要重建下标
+type QuickList struct {
+	Chunks []*ListChunk
+	Head   int // 第 0 个元素的虚拟下标
+	Count  int
+}
+
+func NewQuickList() *QuickList {
+	return &QuickList{Chunks: make([]*ListChunk, 0)}
+}
+
+func (q *QuickList) GetCount() int {
+	return q.Count
+}
+
+func (q *QuickList) PushHead(val string) {
+	if len(q.Chunks) == 0 || len(q.Chunks[0].Items) >= QuickListChunkSize {
+		chunk := &ListChunk{Start: q.Head, Items: make([]string, 0, 1)}
+		q.Chunks = append([]*ListChunk{chunk}, q.Chunks...)
+	}
+	chunk := q.Chunks[0]
+	chunk.Items = append([]string{val}, chunk.Items...)
+	chunk.Start--
+	q.Head--
+	q.Count++
+}
+
+func (q *QuickList) PushTail(val string) {
+	if len(q.Chunks) == 0 || len(q.Chunks[len(q.Chunks)-1].Items) >= QuickListChunkSize {
+		q.Chunks = append(q.Chunks, &ListChunk{Start: q.Head + q.Count, Items: make([]string, 0, QuickListChunkSize)})
+	}
+	chunk := q.Chunks[len(q.Chunks)-1]
+	chunk.Items = append(chunk.Items, val)
+	q.Count++
+}
+
+func (q *QuickList) PopHead() (string, bool) {
+	if q.Count == 0 {
+		return "", false
+	}
+	chunk := q.Chunks[0]
+	res := chunk.Items[0]
+	chunk.Items = chunk.Items[1:]
+	chunk.Start++
+	q.Head++
+	q.Count--
+	if len(chunk.Items) == 0 {
+		q.Chunks = q.Chunks[1:]
+	}
+	return res, true
+}
+
+func (q *QuickList) PopTail() (string, bool) {
+	if q.Count == 0 {
+		return "", false
+	}
+	chunk := q.Chunks[len(q.Chunks)-1]
+	res := chunk.Items[len(chunk.Items)-1]
+	chunk.Items = chunk.Items[:len(chunk.Items)-1]
+	q.Count--
+	if len(chunk.Items) == 0 {
+		q.Chunks = q.Chunks[:len(q.Chunks)-1]
+	}
+	return res, true
+}
+
+// locate 下标必须合法，返回分片位置与分片内的偏移
+func (q *QuickList) locate(idx int) (int, int) {
+	target := q.Head + idx
+	i := sort.Search(len(q.Chunks), func(i int) bool {
+		return q.Chunks[i].Start > target
+	}) - 1
+	return i, target - q.Chunks[i].Start
+}
+
+func (q *QuickList) Get(idx int) (string, bool) {
+	if idx < 0 || idx >= q.Count {
+		return "", false
+	}
+	i, offset := q.locate(idx)
+	return q.Chunks[i].Items[offset], true
+}
+
+func (q *QuickList) Set(idx int, val string) bool {
+	if idx < 0 || idx >= q.Count {
+		return false
+	}
+	i, offset := q.locate(idx)
+	q.Chunks[i].Items[offset] = val
+	return true
+}
+
+// Range 闭区间，下标需要调用方处理合法
+func (q *QuickList) Range(start int, end int) []string {
+	res := make([]string, 0, end-start+1)
+	if start > end {
+		return res
+	}
+	i, offset := q.locate(start)
+	for ; i < len(q.Chunks) && len(res) < end-start+1; i++ {
+		items := q.Chunks[i].Items[offset:]
+		res = append(res, items[:min(len(items), end-start+1-len(res))]...)
+		offset = 0
+	}
+	return res
+}
+
+func (q *QuickList) ForEach(callback func(int, string) bool) {
+	idx := 0
+	for _, chunk := range q.Chunks {
+		for _, item := range chunk.Items {
+			if !callback(idx, item) {
+				return
+			}
+			idx++
+		}
+	}
+}
+
+// ForEachReverse 从尾部开始遍历
+func (q *QuickList) ForEachReverse(callback func(int, string) bool) {
+	idx := q.Count - 1
+	for i := len(q.Chunks) - 1; i >= 0; i-- {
+		items := q.Chunks[i].Items
+		for j := len(items) - 1; j >= 0; j-- {
+			if !callback(idx, items[j]) {
+				return
+			}
+			idx--
+		}
+	}
+}
+
+// Insert 插入到 idx 之前，idx == Count 时追加到末尾
+func (q *QuickList) Insert(idx int, val string) {
+	if idx == 0 {
+		q.PushHead(val)
+		return
+	}
+	if idx == q.Count {
+		q.PushTail(val)
+		return
+	}
+	i, offset := q.locate(idx)
+	chunk := q.Chunks[i]
+	if len(chunk.Items) >= QuickListChunkSize { // 分片已满 拆分为两半
+		half := len(chunk.Items) / 2
+		next := &ListChunk{Items: append(make([]string, 0, QuickListChunkSize), chunk.Items[half:]...)}
+		chunk.Items = chunk.Items[:half:half]
+		q.Chunks = append(q.Chunks[:i+1], append([]*ListChunk{next}, q.Chunks[i+1:]...)...)
+		if offset >= half {
+			chunk = next
+			offset -= half
+		}
+	}
+	chunk.Items = append(chunk.Items[:offset], append([]string{val}, chunk.Items[offset:]...)...)
+	q.Count++
+	q.reindex()
+}
+
+// RemoveIf 按顺序删除满足条件的元素 limit <= 0 不限制数量 reverse 从尾部开始
+func (q *QuickList) RemoveIf(match func(string) bool, limit int, reverse bool) int {
+	removed := make(map[int]bool)
+	callback := func(idx int, item string) bool {
+		if match(item) {
+			removed[idx] = true
+		}
+		return limit <= 0 || len(removed) < limit
+	}
+	if reverse {
+		q.ForEachReverse(callback)
+	} else {
+		q.ForEach(callback)
+	}
+	if len(removed) == 0 {
+		return 0
+	}
+	idx := 0
+	for _, chunk := range q.Chunks {
+		items := chunk.Items[:0]
+		for _, item := range chunk.Items {
+			if !removed[idx] {
+				items = append(items, item)
+			}
+			idx++
+		}
+		chunk.Items = items
+	}
+	q.Count -= len(removed)
+	q.reindex()
+	return len(removed)
+}
+
+// Trim 只保留闭区间内的元素，下标需要调用方处理合法，start > end 时清空
+func (q *QuickList) Trim(start int, end int) {
+	if start > end {
+		q.Chunks, q.Head, q.Count = make([]*ListChunk, 0), 0, 0
+		return
+	}
+	si, so := q.locate(start)
+	ei, eo := q.locate(end)
+	q.Chunks[ei].Items = q.Chunks[ei].Items[:eo+1]
+	q.Chunks[si].Items = q.Chunks[si].Items[so:]
+	q.Chunks = q.Chunks[si : ei+1]
+	q.Count = end - start + 1
+	q.reindex()
+}
+
+// reindex 中间增删后重建分片下标，同时移除空的分片
+func (q *QuickList) reindex() {
+	chunks := q.Chunks[:0]
+	start := q.Head
+	for _, chunk := range q.Chunks {
+		if len(chunk.Items) == 0 {
+			continue
+		}
+		chunk.Start = start
+		start += len(chunk.Items)
+		chunks = append(chunks, chunk)
+	}
+	q.Chunks = chunks
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RDB 二进制快照，长度都使用 uvarint 编码，字符串为长度加内容，格式如下
+// 魔数 版本 | 辅助字段... | 选择数据库 下标 | [过期时间] 类型 key value ... | 结束标记 crc64 校验和
+type RDB struct {
+	FileName   string
+	Saving     bool      // 同一时间只能有一个快照在保存
+	LastSave   time.Time // 上次成功保存的时间
+	LastStatus bool      // 上次保存是否成功
+	LastTry    time.Time // 上次开始保存的时间，失败后自动保存需要间隔一段时间再重试
+	Lock       sync.Mutex
+}
+
+var (
+	crcTable = crc64.MakeTable(crc64.ECMA)
+)
+
+func NewRDB(fileName string) *RDB {
+	return &RDB{FileName: fileName, LastSave: time.Now(), LastStatus: true}
+}
+
+func (r *RDB) begin() error {
+	r.Lock.Lock()
+	defer r.Lock.Unlock()
+	if r.FileName == "" {
+		return errors.New("RDB File Not Configured")
+	}
+	if r.Saving {
+		return errors.New("Background save already in progress")
+	}
+	r.Saving = true
+	r.LastTry = time.Now()
+	return nil
+}
+
+func (r *RDB) end(ok bool) {
+	r.Lock.Lock()
+	defer r.Lock.Unlock()
+	r.Saving = false
+	r.LastStatus = ok
+	if ok {
+		r.LastSave = time.Now()
+	}
+}
+
+func (r *RDB) GetLastSave() time.Time {
+	r.Lock.Lock()
+	defer r.Lock.Unlock()
+	return r.LastSave
+}
+
+type RDBEncoder struct {
+	Buff *bytes.Buffer
+}
+
+func NewRDBEncoder() *RDBEncoder {
+	res := &RDBEncoder{Buff: &bytes.Buffer{}}
+	res.Buff.WriteString(RDBMagic)
+	res.Buff.WriteByte(RDBVersion)
+	return res
+}
+
+func (e *RDBEncoder) writeLen(count int) {
+	e.Buff.Write(binary.AppendUvarint(nil, uint64(count)))
+}
+
+func (e *RDBEncoder) writeStr(str string) {
+	e.writeLen(len(str))
+	e.Buff.WriteString(str)
+}
+
+func (e *RDBEncoder) writeUint64(val uint64) {
+	e.Buff.Write(binary.LittleEndian.AppendUint64(nil, val))
+}
+
+func (e *RDBEncoder) WriteAux(key string, val string) {
+	e.Buff.WriteByte(RDBOpAux)
+	e.writeStr(key)
+	e.writeStr(val)
+}
+
+func (e *RDBEncoder) WriteSelect(index int) {
+	e.Buff.WriteByte(RDBOpSelectDB)
+	e.writeLen(index)
+}
+
+// WriteEntry ttl 为 nil 表示没有过期时间
+func (e *RDBEncoder) WriteEntry(key string, entry *Entry, ttl *Entry) {
+	if ttl != nil {
+		e.Buff.WriteByte(RDBOpExpireMs)
+		e.writeUint64(uint64(ttl.Time.UnixMilli()))
+	}
+	e.Buff.WriteByte(byte(entry.Type))
+	e.writeStr(key)
+	switch entry.Type {
+	case TypeStr:
+		e.writeStr(entry.Str)
+	case TypeZSet:
+		m := entry.SkipList.GetMap()
+		e.writeLen(len(m))
+		for member, score := range m {
+			e.writeStr(member)
+			e.writeUint64(math.Float64bits(score))
+		}
+	case TypeHash:
+		e.writeLen(entry.Hash.Len())
+		for field, val := range entry.Hash.All() {
+			e.writeStr(field)
+			e.writeStr(val)
+		}
+	case TypeList:
+		e.writeLen(entry.List.GetCount())
+		entry.List.ForEach(func(_ int, item string) bool {
+			e.writeStr(item)
+			return true
+		})
+	case TypeSet:
+		e.writeLen(entry.Set.GetCount())
+		for member := range entry.Set.All() {
+			e.writeStr(member)
+		}
+	default:
+		panic(fmt.Sprintf("unkown type %v", entry.Type))
+	}
+}
+
+// Finish 写入结束标记与整个文件的校验和
+func (e *RDBEncoder) Finish() []byte {
+	e.Buff.WriteByte(RDBOpEOF)
+	e.writeUint64(crc64.Checksum(e.Buff.Bytes(), crcTable))
+	return e.Buff.Bytes()
+}
+
+// RDBDecoder 边读取边计算校验和，数据损坏时直接 panic
+type RDBDecoder struct {
+	Reader *bufio.Reader
+	Hash   hash.Hash64
+	Offset int64 // 已经读取的字节数，混合 aof 中快照之后就是指令部分
+}
+
+func NewRDBDecoder(reader io.Reader) *RDBDecoder {
+	return &RDBDecoder{Reader: bufio.NewReader(reader), Hash: crc64.New(crcTable)}
+}
+
+// ReadByte 实现 io.ByteReader 用于读取 uvarint
+func (d *RDBDecoder) ReadByte() (byte, error) {
+	res, err := d.Reader.ReadByte()
+	if err == nil {
+		d.Hash.Write([]byte{res})
+		d.Offset++
+	}
+	return res, err
+}
+
+func (d *RDBDecoder) read(count int) []byte {
+	res := make([]byte, count)
+	_, err := io.ReadFull(d.Reader, res)
+	HandleErr(err)
+	d.Hash.Write(res)
+	d.Offset += int64(count)
+	return res
+}
+
+func (d *RDBDecoder) readByte() byte {
+	res, err := d.ReadByte()
+	HandleErr(err)
+	return res
+}
+
+func (d *RDBDecoder) readLen() int {
+	res, err := binary.ReadUvarint(d)
+	HandleErr(err)
+	return int(res)
+}
+
+func (d *RDBDecoder) readStr() string {
+	return string(d.read(d.readLen()))
+}
+
+func (d *RDBDecoder) readUint64() uint64 {
+	return binary.LittleEndian.Uint64(d.read(8))
+}
+
+// HasRDBHead 混合 aof 以快照开头
+func HasRDBHead(bs []byte) bool {
+	return bytes.HasPrefix(bs, []byte(RDBMagic))
+}
+
+// ReadHead 校验魔数与版本，返回全部辅助字段
+func (d *RDBDecoder) ReadHead() map[string]string {
+	if string(d.read(len(RDBMagic))) != RDBMagic {
+		panic(errors.New("invalid rdb magic"))
+	}
+	if version := d.readByte(); version > RDBVersion {
+		panic(fmt.Errorf("unsupported rdb version %d", version))
+	}
+	res := make(map[string]string)
+	for {
+		bs, err := d.Reader.Peek(1)
+		HandleErr(err)
+		if bs[0] != RDBOpAux {
+			return res
+		}
+		d.readByte()
+		key := d.readStr()
+		res[key] = d.readStr()
+	}
+}
+
+// ReadEntries 依次回调每个 key，没有过期时间的 ttl 为零值，读取到结束标记后校验整个文件
+func (d *RDBDecoder) ReadEntries(callback func(index int, key string, entry *Entry, ttl time.Time)) {
+	index := 0
+	for {
+		op := d.readByte()
+		switch op {
+		case RDBOpEOF:
+			d.checkSum()
+			return
+		case RDBOpSelectDB:
+			index = d.readLen()
+			continue
+		}
+		var ttl time.Time
+		if op == RDBOpExpireMs {
+			ttl = time.UnixMilli(int64(d.readUint64()))
+			op = d.readByte()
+		}
+		key := d.readStr()
+		callback(index, key, d.readValue(int(op)), ttl)
+	}
+}
+
+func (d *RDBDecoder) readValue(typ int) *Entry {
+	switch typ {
+	case TypeStr:
+		return &Entry{Type: TypeStr, Str: d.readStr()}
+	case TypeZSet:
+		res := &Entry{Type: TypeZSet, SkipList: NewSkipList(4)}
+		for count := d.readLen(); count > 0; count-- {
+			member := d.readStr()
+			res.SkipList.Add(member, math.Float64frombits(d.readUint64()))
+		}
+		return res
+	case TypeHash:
+		res := &Entry{Type: TypeHash, Hash: NewDict[string]()}
+		for count := d.readLen(); count > 0; count-- {
+			field := d.readStr()
+			res.Hash.Put(field, d.readStr())
+		}
+		return res
+	case TypeList:
+		res := &Entry{Type: TypeList, List: NewQuickList()}
+		for count := d.readLen(); count > 0; count-- {
+			res.List.PushTail(d.readStr())
+		}
+		return res
+	case TypeSet:
+		res := &Entry{Type: TypeSet, Set: NewSet()}
+		for count := d.readLen(); count > 0; count-- {
+			res.Set.Add(d.readStr())
+		}
+		return res
+	default:
+		panic(fmt.Sprintf("unkown type %v", typ))
+	}
+}
+
+// checkSum 校验和本身不参与计算
+func (d *RDBDecoder) checkSum() {
+	sum := d.Hash.Sum64()
+	bs := make([]byte, 8)
+	_, err := io.ReadFull(d.Reader, bs)
+	HandleErr(err)
+	d.Offset += int64(len(bs))
+	if binary.LittleEndian.Uint64(bs) != sum {
+		panic(errors.New("rdb checksum mismatch"))
+	}
+}
+
+// LockAll 按数据库与分片的顺序对全部数据加写锁，用于替换全部数据
+func (h *Handler) LockAll() func() {
+	if h.Executor != nil {
+		return func() {}
+	}
+	unlocks := make([]func(), 0, len(h.DBs))
+	for _, db := range h.DBs {
+		unlocks = append(unlocks, db.DataMap.LockAll())
+	}
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+}
+
+// dumpRDB 登记快照的同时记录 aof 的位置，保证快照与 aof 严格对应，数据由 finishSnapshot 逐个分片编码
+// 同时返回各个数据库参与本次快照的修改次数
+func (h *Handler) dumpRDB() (*Snapshot, []int64) {
+	encoder := NewRDBEncoder()
+	snap := NewRDBSnapshot(encoder)
+	dirty := make([]int64, len(h.DBs))
+	h.beginSnapshot(snap, func() {
+		h.AOF.Lock.Lock()
+		encoder.WriteAux(RDBAuxCTime, strconv.FormatInt(time.Now().Unix(), 10))
+		encoder.WriteAux(RDBAuxAOFID, h.AOF.ID)
+		encoder.WriteAux(RDBAuxAOFOffset, strconv.FormatInt(h.AOF.Size(), 10))
+		encoder.WriteAux(RDBAuxAOFIndex, strconv.Itoa(h.AOF.LastIndex))
+		h.AOF.Lock.Unlock()
+		for i, db := range h.DBs {
+			dirty[i] = db.Dirty.Load()
+		}
+	})
+	return snap, dirty
+}
+
+func (h *Handler) writeRDB(bs []byte, dirty []int64) error {
+	err := WriteFileAtomic(h.RDB.FileName, bs)
+	h.RDB.end(err == nil)
+	if err != nil {
+		Error("Save RDB %s err %v", h.RDB.FileName, err)
+		return err
+	}
+	for i, db := range h.DBs {
+		db.Dirty.Add(-dirty[i])
+	}
+	Info("DB saved on disk %s", h.RDB.FileName)
+	return nil
+}
+
+// Save 同步保存，返回时快照已经写入文件，单线程模式下期间所有指令都会被阻塞
+func (h *Handler) Save() error {
+	if err := h.RDB.begin(); err != nil {
+		return err
+	}
+	snap, dirty := h.dumpRDB()
+	return h.writeRDB(h.finishSnapshot(snap, true), dirty)
+}
+
+// BGSave 只有登记快照期间阻塞写指令，编码、写文件与刷盘交给后台协程
+func (h *Handler) BGSave() error {
+	if err := h.RDB.begin(); err != nil {
+		return err
+	}
+	snap, dirty := h.dumpRDB()
+	go func() {
+		h.writeRDB(h.finishSnapshot(snap, false), dirty)
+	}()
+	return nil
+}
+
+func (h *Handler) GetDirty() int64 {
+	res := int64(0)
+	for _, db := range h.DBs {
+		res += db.Dirty.Load()
+	}
+	return res
+}
+
+// needSave 任意一条规则满足即可，上次失败的需要间隔 RDBRetryDelay 再重试
+func (h *Handler) needSave() bool {
+	dirty := h.GetDirty()
+	h.RDB.Lock.Lock()
+	defer h.RDB.Lock.Unlock()
+	if h.RDB.FileName == "" || h.RDB.Saving || (!h.RDB.LastStatus && time.Since(h.RDB.LastTry) < RDBRetryDelay) {
+		return false
+	}
+	for _, rule := range h.Conf.Save {
+		if rule.Changes > 0 && dirty >= int64(rule.Changes) && time.Since(h.RDB.LastSave) >= time.Duration(rule.Seconds)*time.Second {
+			Info("%d changes in %d seconds. Saving...", rule.Changes, rule.Seconds)
+			return true
+		}
+	}
+	return false
+}
+
+// Load 启动时优先加载快照再重放快照之后追加的 aof，快照与 aof 不对应时 aof 的数据更完整以 aof 为准
+// aof 是新建的只能从快照加载，加载后立即重新保存使两者重新对应
+func (h *Handler) Load() {
+	aofFile := h.Conf.AOFFile
+	if h.RDB.FileName == "" || !FileExist(h.RDB.FileName) {
+		h.AOF.LoadAOF(h, aofFile)
+		return
+	}
+	file, err := os.Open(h.RDB.FileName)
+	HandleErr(err)
+	defer file.Close()
+	decoder := NewRDBDecoder(file)
+	aux := decoder.ReadHead()
+	offset, err := strconv.ParseInt(aux[RDBAuxAOFOffset], 10, 64)
+	match := err == nil && aux[RDBAuxAOFID] == h.AOF.ID && offset <= h.AOF.Size()
+	if !match && !h.AOF.Created {
+		Warn("RDB %s does not match AOF %s, load AOF only", h.RDB.FileName, aofFile)
+		h.AOF.LoadAOF(h, aofFile)
+		return
+	}
+	start := time.Now()
+	h.loadRDB(decoder)
+	Info("DB loaded from disk: %.3f seconds", time.Since(start).Seconds())
+	if !match {
+		HandleErr(h.Save())
+		return
+	}
+	index, err := strconv.Atoi(aux[RDBAuxAOFIndex])
+	HandleErr(err)
+	h.AOF.LoadTail(h, aofFile, offset, index)
+}
+
+func (h *Handler) loadRDB(decoder *RDBDecoder) {
+	decoder.ReadEntries(func(index int, key string, entry *Entry, ttl time.Time) {
+		if index >= len(h.DBs) {
+			panic(fmt.Errorf("rdb db index %d out of range", index))
+		}
+		db := h.DBs[index]
+		db.DataMap.Put(key, entry)
+		if !ttl.IsZero() { // 已经过期的也先保留交给时间轮删除，与 aof 重放一致
+			db.putTTL(key, ttl)
+		}
+	})
+}
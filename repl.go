@@ -0,0 +1,753 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Repl 主从复制，复制流就是 aof 的写入，偏移量为复制流的字节数
+// 主节点保留最近的一段复制流作为积压缓冲，从节点断线重连后可以从自己的偏移量继续同步
+type Repl struct {
+	ID          string // 复制流的标识，从节点使用主节点的标识
+	Offset      int64  // 复制流的总字节数，从节点为已经执行的字节数
+	Backlog     []byte // 第一个从节点连接后才开始记录
+	BacklogSize int
+	Replicas    map[*Replica]bool
+	AckSignal   chan struct{} // 从节点确认偏移量后关闭并替换，唤醒等待中的 wait
+	// 从节点相关，MasterHost 为空表示当前是主节点
+	MasterHost     string
+	MasterPort     int
+	MasterConn     net.Conn // 当前与主节点的连接，切换主节点时关闭
+	Epoch          int      // 每次切换主节点加一，旧的同步协程发现后退出
+	LinkUp         bool
+	LinkDownSince  time.Time
+	LastIO         time.Time // 上次收到主节点数据的时间
+	SyncInProgress bool
+	Lock           sync.Mutex
+}
+
+// Replica 主节点上的一个从节点，复制流先追加到 Pending 再由发送协程写出，慢的从节点不会阻塞写指令
+type Replica struct {
+	Session *Session
+	Port    int    // 从节点通过 replconf listening-port 告知
+	State   string // send_bulk online
+	Pending []byte
+	Ack     int64     // 从节点通过 replconf ack 确认已经执行的偏移量
+	AckTime time.Time // 上次确认的时间
+	Signal  chan struct{}
+	Closed  bool
+}
+
+func NewRepl(backlogSize int) *Repl {
+	if backlogSize <= 0 {
+		backlogSize = ReplBacklogSize
+	}
+	return &Repl{ID: GenRunID(), BacklogSize: backlogSize, Replicas: make(map[*Replica]bool), AckSignal: make(chan struct{}), LinkDownSince: time.Now()}
+}
+
+func NewReplica(session *Session) *Replica {
+	return &Replica{Session: session, Port: session.ListeningPort, State: "send_bulk", AckTime: time.Now(), Signal: make(chan struct{}, 1)}
+}
+
+// Feed 由 AOF.write 在 aof 锁内调用，与 aof 的写入顺序一致，从节点的复制流只来自主节点
+func (r *Repl) Feed(bs []byte) {
+	r.Lock.Lock()
+	defer r.Lock.Unlock()
+	if r.MasterHost != "" {
+		return
+	}
+	r.Offset += int64(len(bs))
+	if r.Backlog == nil {
+		return
+	}
+	r.Backlog = append(r.Backlog, bs...)
+	if over := len(r.Backlog) - r.BacklogSize; over > r.BacklogSize { // 超出一倍后再整体前移，均摊拷贝的开销
+		r.Backlog = append(r.Backlog[:0], r.Backlog[over:]...)
+	}
+	for replica := range r.Replicas {
+		r.send(replica, bs)
+	}
+}
+
+// FeedCmd 只发送给从节点而不写入 aof 的指令，例如定期的 ping 与 wait 发出的 replconf getack
+func (r *Repl) FeedCmd(aof *AOF, req *Req) {
+	r.Lock.Lock()
+	empty := len(r.Replicas) == 0
+	r.Lock.Unlock()
+	if empty {
+		return
+	}
+	buff := &bytes.Buffer{}
+	aof.writeReq(buff, req)
+	r.Feed(buff.Bytes())
+}
+
+// send 调用方需要持有锁，积压超过上限的从节点直接断开，之后重新同步
+func (r *Repl) send(replica *Replica, bs []byte) {
+	replica.Pending = append(replica.Pending, bs...)
+	if len(replica.Pending) > ReplOutputLimit {
+		Warn("Replica %s output buffer overflow, disconnect", replica.Session.Conn.RemoteAddr())
+		r.dropReplica(replica)
+		return
+	}
+	select {
+	case replica.Signal <- struct{}{}:
+	default:
+	}
+}
+
+// backlogStart 积压缓冲中第一个字节的偏移量，调用方需要持有锁
+func (r *Repl) backlogStart() int64 {
+	return r.Offset - int64(min(len(r.Backlog), r.BacklogSize))
+}
+
+// addReplica 调用方需要持有锁，第一个从节点连接时开始记录积压缓冲
+func (r *Repl) addReplica(replica *Replica) {
+	if r.Backlog == nil {
+		r.Backlog = make([]byte, 0)
+	}
+	r.Replicas[replica] = true
+}
+
+// AddReplica 全量同步时在 aof 锁内调用，返回复制流的标识与快照对应的偏移量，之后的复制流都会发送给该从节点
+func (r *Repl) AddReplica(replica *Replica) (string, int64) {
+	r.Lock.Lock()
+	defer r.Lock.Unlock()
+	r.addReplica(replica)
+	return r.ID, r.Offset
+}
+
+// TryPartial 标识一致且偏移量仍在积压缓冲中时从该位置继续发送
+func (r *Repl) TryPartial(replica *Replica, id string, offset int64) bool {
+	r.Lock.Lock()
+	defer r.Lock.Unlock()
+	if r.MasterHost != "" || r.Backlog == nil || id != r.ID || offset < r.backlogStart() || offset > r.Offset {
+		return false
+	}
+	r.addReplica(replica)
+	replica.Pending = append(replica.Pending, r.Backlog[len(r.Backlog)-int(r.Offset-offset):]...)
+	replica.State = "online"
+	return true
+}
+
+// dropReplica 调用方需要持有锁，关闭连接后读协程退出，发送协程随之退出
+func (r *Repl) dropReplica(replica *Replica) {
+	if replica.Closed {
+		return
+	}
+	replica.Closed = true
+	delete(r.Replicas, replica)
+	_ = replica.Session.Conn.Close()
+	select {
+	case replica.Signal <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Repl) DropReplica(replica *Replica) {
+	r.Lock.Lock()
+	defer r.Lock.Unlock()
+	r.dropReplica(replica)
+}
+
+// sendLoop 把积压的复制流写出给从节点，写出失败时断开
+func (r *Repl) sendLoop(replica *Replica) {
+	for range replica.Signal {
+		r.Lock.Lock()
+		if replica.Closed {
+			r.Lock.Unlock()
+			return
+		}
+		bs := replica.Pending
+		replica.Pending = nil
+		r.Lock.Unlock()
+		if len(bs) == 0 {
+			continue
+		}
+		if err := replica.Session.WriteRaw(bs); err != nil {
+			r.DropReplica(replica)
+			return
+		}
+		r.Lock.Lock()
+		replica.State = "online"
+		r.Lock.Unlock()
+	}
+}
+
+// Ack 记录从节点确认的偏移量并唤醒全部 wait
+func (r *Repl) Ack(replica *Replica, offset int64) {
+	r.Lock.Lock()
+	defer r.Lock.Unlock()
+	replica.Ack = offset
+	replica.AckTime = time.Now()
+	close(r.AckSignal)
+	r.AckSignal = make(chan struct{})
+}
+
+// AckCount 已经确认到 offset 的从节点数量，同时返回之后有新的确认时会被关闭的通道
+func (r *Repl) AckCount(offset int64) (int, chan struct{}) {
+	r.Lock.Lock()
+	defer r.Lock.Unlock()
+	count := 0
+	for replica := range r.Replicas {
+		if replica.Ack >= offset {
+			count++
+		}
+	}
+	return count, r.AckSignal
+}
+
+func (r *Repl) GetOffset() int64 {
+	r.Lock.Lock()
+	defer r.Lock.Unlock()
+	return r.Offset
+}
+
+// IsReplica 当前是否是从节点
+func (r *Repl) IsReplica() bool {
+	r.Lock.Lock()
+	defer r.Lock.Unlock()
+	return r.MasterHost != ""
+}
+
+// Role hello 中的角色
+func (r *Repl) Role() string {
+	if r.IsReplica() {
+		return "replica"
+	}
+	return "master"
+}
+
+// HandlePSync psync replid offset 由从节点发起，之后该连接只用于发送复制流，返回 false 表示没有进入复制
+func (h *Handler) HandlePSync(req *Req, session *Session) bool {
+	if len(req.Args) != 2 {
+		session.WriteError(req.SeqID, "Invalid Args")
+		return false
+	}
+	if h.Repl.IsReplica() {
+		session.WriteError(req.SeqID, "Can't PSync From A Replica")
+		return false
+	}
+	offset, err := strconv.ParseInt(req.Args[1], 10, 64)
+	if err != nil {
+		offset = -1
+	}
+	replica := NewReplica(session)
+	if h.Repl.TryPartial(replica, req.Args[0], offset) {
+		Info("Partial resynchronization request from %s accepted, offset %d", session.Conn.RemoteAddr(), offset)
+		err = session.WriteRaw([]byte("+CONTINUE " + req.Args[0] + "\r\n"))
+	} else {
+		var snap *Snapshot
+		var id string
+		h.runTask(func() {
+			snap, id, offset = h.dumpSync(replica)
+		})
+		bs := h.finishSnapshot(snap, false) // 编码期间其他连接的指令照常执行，复制流在注册后开始积压
+		Info("Full resync requested by replica %s, snapshot %d bytes at offset %d", session.Conn.RemoteAddr(), len(bs), offset)
+		buff := &bytes.Buffer{}
+		fmt.Fprintf(buff, "+FULLRESYNC %s %d\r\n$%d\r\n", id, offset, len(bs))
+		buff.Write(bs)
+		err = session.WriteRaw(buff.Bytes())
+	}
+	if err != nil {
+		h.Repl.DropReplica(replica)
+		h.handleReadErr(session, err)
+		return true
+	}
+	go h.Repl.sendLoop(replica)
+	select { // 等待期间积压的复制流
+	case replica.Signal <- struct{}{}:
+	default:
+	}
+	h.serveReplica(replica)
+	return true
+}
+
+// serveReplica 读取从节点之后发送的 replconf ack，连接断开后移除该从节点
+func (h *Handler) serveReplica(replica *Replica) {
+	session := replica.Session
+	defer h.Repl.DropReplica(replica)
+	for {
+		req, err := session.ReadReq()
+		if err != nil {
+			h.handleReadErr(session, err)
+			Info("Connection with replica %s lost", session.Conn.RemoteAddr())
+			return
+		}
+		if strings.ToUpper(req.Cmd) != CmdReplConf || len(req.Args) != 2 || !strings.EqualFold(req.Args[0], "ack") {
+			continue
+		}
+		if offset, err := strconv.ParseInt(req.Args[1], 10, 64); err == nil {
+			h.Repl.Ack(replica, offset)
+		}
+	}
+}
+
+// HandleWait wait numreplicas timeout 阻塞到足够多的从节点确认了当前的复制偏移量，超时后返回已经确认的数量
+// 与 WaitBlocked 一样在等待期间探测连接是否断开，返回读取错误
+func (h *Handler) HandleWait(req *Req, session *Session) error {
+	if len(req.Args) != 2 {
+		session.WriteError(req.SeqID, "Invalid Args")
+		return nil
+	}
+	if session.InTransaction {
+		session.TxDirty = true
+		session.WriteError(req.SeqID, "Invalid Wait In Transaction")
+		return nil
+	}
+	if h.Repl.IsReplica() {
+		session.WriteError(req.SeqID, "Invalid Wait On Replica")
+		return nil
+	}
+	num, err := strconv.Atoi(req.Args[0])
+	if err != nil || num < 0 {
+		session.WriteError(req.SeqID, "Invalid Num")
+		return nil
+	}
+	timeout, err := strconv.ParseInt(req.Args[1], 10, 64)
+	if err != nil || timeout < 0 {
+		session.WriteError(req.SeqID, "Invalid Timeout")
+		return nil
+	}
+	offset := h.Repl.GetOffset() // 之前的写指令都已经进入复制流
+	count, signal := h.Repl.AckCount(offset)
+	if count >= num {
+		session.WriteNum(req.SeqID, count)
+		return nil
+	}
+	h.Repl.FeedCmd(h.AOF, &Req{Cmd: CmdReplConf, Args: []string{"GETACK", "*"}}) // 让从节点立即确认
+	var timer <-chan time.Time
+	if timeout > 0 { // 为 0 时一直等待
+		timer = time.After(time.Duration(timeout) * time.Millisecond)
+	}
+	peekChan := make(chan error, 1)
+	go func() {
+		_, err := session.Reader.Peek(1)
+		peekChan <- err
+	}()
+	timeoutReached := false
+	for count < num && !timeoutReached {
+		select {
+		case <-signal:
+			count, signal = h.Repl.AckCount(offset)
+		case <-timer:
+			count, _ = h.Repl.AckCount(offset)
+			timeoutReached = true
+		case err = <-peekChan:
+			if err != nil {
+				return err
+			}
+			peekChan = nil // 客户端提前发送了后续请求，继续等待
+		}
+	}
+	session.WriteNum(req.SeqID, count)
+	if peekChan == nil {
+		return nil
+	}
+	return <-peekChan
+}
+
+// dumpSync 全量同步的快照，注册从节点与登记快照以同一时刻为界，数据由 finishSnapshot 逐个分片编码
+// 快照记录 aof 最后选择的数据库，之后的复制流在没有 select 前基于这个数据库
+func (h *Handler) dumpSync(replica *Replica) (*Snapshot, string, int64) {
+	encoder := NewRDBEncoder()
+	snap := NewRDBSnapshot(encoder)
+	var id string
+	var offset int64
+	h.beginSnapshot(snap, func() {
+		h.AOF.Lock.Lock()
+		defer h.AOF.Lock.Unlock()
+		encoder.WriteAux(RDBAuxCTime, strconv.FormatInt(time.Now().Unix(), 10))
+		encoder.WriteAux(RDBAuxReplStreamDB, strconv.Itoa(h.AOF.LastIndex))
+		id, offset = h.Repl.AddReplica(replica)
+	})
+	return snap, id, offset
+}
+
+// HandleReplConf replconf listening-port port 从节点在 psync 前告知自己的端口，其余选项直接忽略
+func (h *Handler) HandleReplConf(req *Req, session *Session) {
+	if len(req.Args)%2 != 0 {
+		session.WriteError(req.SeqID, "Invalid Args")
+		return
+	}
+	for i := 0; i < len(req.Args); i += 2 {
+		if strings.ToLower(req.Args[i]) != "listening-port" {
+			continue
+		}
+		port, err := strconv.Atoi(req.Args[i+1])
+		if err != nil {
+			session.WriteError(req.SeqID, "Invalid Port")
+			return
+		}
+		session.ListeningPort = port
+	}
+	session.WriteOk(req.SeqID)
+}
+
+// HandleReplicaOf replicaof host port 成为从节点，replicaof no one 恢复为主节点
+func (h *Handler) HandleReplicaOf(req *Req, session *Session) {
+	if len(req.Args) != 2 {
+		session.WriteError(req.SeqID, "Invalid Args")
+		return
+	}
+	if strings.EqualFold(req.Args[0], "no") && strings.EqualFold(req.Args[1], "one") {
+		h.ReplicaOf("", 0)
+		session.WriteOk(req.SeqID)
+		return
+	}
+	port, err := strconv.Atoi(req.Args[1])
+	if err != nil || port <= 0 || port > 65535 {
+		session.WriteError(req.SeqID, "Invalid Port")
+		return
+	}
+	h.ReplicaOf(req.Args[0], port)
+	session.WriteOk(req.SeqID)
+}
+
+// ReplicaOf 切换主节点，原来的从节点全部断开，复制流不再连续
+// 恢复为主节点时使用新的标识，之前的偏移量保留
+func (h *Handler) ReplicaOf(host string, port int) {
+	r := h.Repl
+	r.Lock.Lock()
+	defer r.Lock.Unlock()
+	if r.MasterHost == host && r.MasterPort == port {
+		return
+	}
+	r.closeLinks()
+	r.MasterHost, r.MasterPort = host, port
+	r.Backlog = nil
+	if host == "" {
+		r.ID = GenRunID()
+		Info("MASTER MODE enabled")
+		return
+	}
+	r.LinkUp = false
+	r.LinkDownSince = time.Now()
+	Info("REPLICAOF %s:%d enabled", host, port)
+	go h.replicaLoop(r.Epoch)
+}
+
+// closeLinks 调用方需要持有锁，断开与主节点以及全部从节点的连接
+func (r *Repl) closeLinks() {
+	r.Epoch++
+	if r.MasterConn != nil {
+		_ = r.MasterConn.Close()
+		r.MasterConn = nil
+	}
+	for replica := range r.Replicas {
+		r.dropReplica(replica)
+	}
+}
+
+// Close 关闭服务时断开复制相关的连接，否则服务会一直等待这些连接结束
+func (r *Repl) Close() {
+	r.Lock.Lock()
+	defer r.Lock.Unlock()
+	r.closeLinks()
+}
+
+func (r *Repl) isEpoch(epoch int) bool {
+	r.Lock.Lock()
+	defer r.Lock.Unlock()
+	return r.Epoch == epoch
+}
+
+// replicaLoop 从节点的同步协程，连接断开后间隔一段时间重连，切换主节点后退出
+// 执行复制流的会话在重连之间保留，部分同步时选择的数据库与未完成的事务仍然有效
+func (h *Handler) replicaLoop(epoch int) {
+	session := NewSession(NewFakeConn())
+	session.Master = true
+	for h.Repl.isEpoch(epoch) {
+		err := h.syncWithMaster(epoch, session)
+		h.Repl.Lock.Lock()
+		if h.Repl.LinkUp {
+			h.Repl.LinkUp = false
+			h.Repl.LinkDownSince = time.Now()
+		}
+		h.Repl.SyncInProgress = false
+		h.Repl.Lock.Unlock()
+		if !h.Repl.isEpoch(epoch) {
+			return
+		}
+		Warn("Sync with master err %v", err)
+		time.Sleep(ReplRetryDelay)
+	}
+}
+
+// syncWithMaster 握手 同步快照 然后持续执行复制流，只在出错时返回
+func (h *Handler) syncWithMaster(epoch int, session *Session) (err error) {
+	defer func() {
+		if e := recover(); e != nil { // 快照损坏等
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+	r := h.Repl
+	r.Lock.Lock()
+	addr := net.JoinHostPort(r.MasterHost, strconv.Itoa(r.MasterPort))
+	r.Lock.Unlock()
+	conn, err := net.DialTimeout("tcp", addr, ReplTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	r.Lock.Lock()
+	if r.Epoch != epoch {
+		r.Lock.Unlock()
+		return net.ErrClosed
+	}
+	r.MasterConn = conn
+	id, offset := r.ID, r.Offset
+	r.Lock.Unlock()
+	Info("Connected to MASTER %s", addr)
+	reader := bufio.NewReaderSize(conn, ReadBuffSize)
+	_ = conn.SetDeadline(time.Now().Add(ReplTimeout))
+	if h.Conf.MasterAuth != "" {
+		if _, err = replCall(conn, reader, CmdAuth, h.Conf.MasterAuth); err != nil {
+			return err
+		}
+	}
+	if _, err = replCall(conn, reader, CmdReplConf, "listening-port", strconv.Itoa(h.Conf.Port)); err != nil {
+		return err
+	}
+	line, err := replCall(conn, reader, CmdPSync, id, strconv.FormatInt(offset, 10))
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 3 && fields[0] == "FULLRESYNC":
+		offset, err = strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrProtocol, line)
+		}
+		if err = h.fullSync(reader, session); err != nil {
+			return err
+		}
+		r.Lock.Lock()
+		r.ID, r.Offset = fields[1], offset
+		r.Lock.Unlock()
+	case len(fields) == 2 && fields[0] == "CONTINUE":
+		Info("Successful partial resynchronization with master at offset %d", offset)
+	default:
+		return fmt.Errorf("%w: %s", ErrProtocol, line)
+	}
+	r.Lock.Lock()
+	r.LinkUp = true
+	r.LastIO = time.Now()
+	r.Lock.Unlock()
+	_ = conn.SetDeadline(time.Time{})
+	ackChan := make(chan struct{}, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go h.ackLoop(conn, ackChan, done)
+	return h.streamFromMaster(conn, reader, epoch, session, ackChan)
+}
+
+// ackLoop 每秒以及收到 replconf getack 时向主节点确认已经执行的偏移量，只有这个协程写连接
+func (h *Handler) ackLoop(conn net.Conn, ackChan chan struct{}, done chan struct{}) {
+	ticker := time.NewTicker(ReplAckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		case <-ackChan:
+		}
+		buff := &bytes.Buffer{}
+		NewStrsReply([]string{CmdReplConf, "ACK", strconv.FormatInt(h.Repl.GetOffset(), 10)}).Encode(buff, ProtoRESP2)
+		if _, err := conn.Write(buff.Bytes()); err != nil {
+			_ = conn.Close() // 读取复制流的协程随之退出
+			return
+		}
+	}
+}
+
+// replCall 握手阶段发送一条指令并读取单行回复
+func replCall(conn net.Conn, reader *bufio.Reader, args ...string) (string, error) {
+	buff := &bytes.Buffer{}
+	NewStrsReply(args).Encode(buff, ProtoRESP2)
+	if _, err := conn.Write(buff.Bytes()); err != nil {
+		return "", err
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "-") {
+		return "", fmt.Errorf("%s reply %s", args[0], line[1:])
+	}
+	return strings.TrimPrefix(line, "+"), nil
+}
+
+// fullSync 读取快照替换全部数据，之后重写 aof 使其与新的数据对应
+func (h *Handler) fullSync(reader *bufio.Reader, session *Session) error {
+	h.Repl.Lock.Lock()
+	h.Repl.SyncInProgress = true
+	h.Repl.Lock.Unlock()
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	size, err := strconv.Atoi(strings.TrimRight(strings.TrimPrefix(line, "$"), "\r\n"))
+	if err != nil || !strings.HasPrefix(line, "$") {
+		return fmt.Errorf("%w: bad snapshot size %q", ErrProtocol, line)
+	}
+	bs := make([]byte, size)
+	if _, err = io.ReadFull(reader, bs); err != nil {
+		return err
+	}
+	h.runTask(func() {
+		h.loadSync(bs, session)
+	})
+	Info("MASTER <-> REPLICA sync: Finished with success, %d bytes", size)
+	h.Repl.Lock.Lock()
+	h.Repl.SyncInProgress = false
+	h.Repl.Lock.Unlock()
+	h.runTask(func() {
+		if err := h.BGRewriteAOF(); err != nil { // 正在重写时等当前的结束后再重写
+			h.AOF.ScheduleRewrite()
+		}
+	})
+	return nil
+}
+
+// loadSync 清空全部数据后加载快照，执行复制流的会话从快照记录的数据库开始
+func (h *Handler) loadSync(bs []byte, session *Session) {
+	decoder := NewRDBDecoder(bytes.NewReader(bs))
+	aux := decoder.ReadHead()
+	unlock := h.LockAll()
+	defer unlock()
+	for _, db := range h.DBs {
+		db.copyAll()
+		db.DataMap.Clear()
+		db.TTLMap.Clear()
+		db.TouchAll()
+	}
+	h.loadRDB(decoder)
+	session.ResetTx()
+	session.DBIndex = 0
+	if index, err := strconv.Atoi(aux[RDBAuxReplStreamDB]); err == nil && index >= 0 {
+		session.DBIndex = index
+	}
+}
+
+// streamFromMaster 逐条执行复制流，与执行客户端的写指令相同，同样写入自己的 aof
+func (h *Handler) streamFromMaster(conn net.Conn, reader *bufio.Reader, epoch int, session *Session, ackChan chan struct{}) error {
+	r := h.Repl
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(ReplTimeout))
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		req, n, err := readRecord(line)
+		if err != nil {
+			return err
+		}
+		switch req.Cmd {
+		case CmdPing:
+		case CmdReplConf: // getack 本身也计入偏移量
+		default:
+			h.runTask(func() {
+				session.Capture(func() {
+					h.HandleDBCmd(req, session, true)
+					h.ServeBlocked()
+				})
+			})
+		}
+		r.Lock.Lock()
+		if r.Epoch != epoch {
+			r.Lock.Unlock()
+			return net.ErrClosed
+		}
+		r.Offset += int64(n)
+		r.LastIO = time.Now()
+		r.Lock.Unlock()
+		if req.Cmd == CmdReplConf {
+			select {
+			case ackChan <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// ReadOnly 从节点默认只读，数据只能来自主节点
+func (h *Handler) ReadOnly() bool {
+	return !h.Conf.ReplicaWritable && h.Repl.IsReplica()
+}
+
+// isWriteCmd 只读的从节点需要拒绝的指令
+func isWriteCmd(cmd string) bool {
+	info := cmdMap[cmd]
+	return (info != nil && info.Write) || cmd == CmdFlushDB || cmd == CmdFlushAll
+}
+
+// StartRepl 配置了 replica_of 时启动后立即开始同步
+func (h *Handler) StartRepl() {
+	if h.Conf.ReplicaOf == "" {
+		return
+	}
+	host, port, err := net.SplitHostPort(h.Conf.ReplicaOf)
+	HandleErr(err)
+	portNum, err := strconv.Atoi(port)
+	HandleErr(err)
+	h.ReplicaOf(host, portNum)
+}
+
+func (h *Handler) infoReplication() []string {
+	r := h.Repl
+	r.Lock.Lock()
+	defer r.Lock.Unlock()
+	res := make([]string, 0)
+	if r.MasterHost == "" {
+		res = append(res, "role:master")
+	} else {
+		lastIO, status := int64(-1), "down"
+		if r.LinkUp {
+			status = "up"
+		}
+		if !r.LastIO.IsZero() {
+			lastIO = int64(time.Since(r.LastIO) / time.Second)
+		}
+		res = append(res,
+			"role:slave",
+			"master_host:"+r.MasterHost,
+			fmt.Sprintf("master_port:%d", r.MasterPort),
+			"master_link_status:"+status,
+			fmt.Sprintf("master_last_io_seconds_ago:%d", lastIO),
+			fmt.Sprintf("master_sync_in_progress:%d", boolToInt(r.SyncInProgress)),
+			fmt.Sprintf("slave_repl_offset:%d", r.Offset),
+			fmt.Sprintf("slave_read_only:%d", boolToInt(!h.Conf.ReplicaWritable)),
+		)
+		if !r.LinkUp {
+			res = append(res, fmt.Sprintf("master_link_down_since_seconds:%d", int64(time.Since(r.LinkDownSince)/time.Second)))
+		}
+	}
+	res = append(res, fmt.Sprintf("connected_slaves:%d", len(r.Replicas)))
+	i := 0
+	for replica := range r.Replicas {
+		host, _, _ := net.SplitHostPort(replica.Session.Conn.RemoteAddr().String())
+		res = append(res, fmt.Sprintf("slave%d:ip=%s,port=%d,state=%s,offset=%d,lag=%d",
+			i, host, replica.Port, replica.State, replica.Ack, int64(time.Since(replica.AckTime)/time.Second)))
+		i++
+	}
+	start := r.backlogStart()
+	return append(res,
+		"master_replid:"+r.ID,
+		fmt.Sprintf("master_repl_offset:%d", r.Offset),
+		fmt.Sprintf("repl_backlog_active:%d", boolToInt(r.Backlog != nil)),
+		fmt.Sprintf("repl_backlog_size:%d", r.BacklogSize),
+		fmt.Sprintf("repl_backlog_first_byte_offset:%d", start+1),
+		fmt.Sprintf("repl_backlog_histlen:%d", r.Offset-start),
+	)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// RESP 协议 https://redis.io/docs/latest/develop/reference/protocol-spec/
+// 请求只支持 bulk string 数组与 inline 指令，响应先统一构造成 Reply 再按连接协议编码
+
+type Reply struct {
+	Type  byte
+	Str   string
+	Num   int64
+	Float float64
+	Items []*Reply // map 类型按 key value 交替存放
+}
+
+func NewStatusReply(status string) *Reply {
+	return &Reply{Type: ReplyStatus, Str: status}
+}
+
+func NewOkReply() *Reply {
+	return NewStatusReply("OK")
+}
+
+func NewErrorReply(msg string) *Reply {
+	return &Reply{Type: ReplyError, Str: msg}
+}
+
+func NewIntReply(num int64) *Reply {
+	return &Reply{Type: ReplyInt, Num: num}
+}
+
+func NewBulkReply(str string) *Reply {
+	return &Reply{Type: ReplyBulk, Str: str}
+}
+
+func NewNilReply() *Reply {
+	return &Reply{Type: ReplyNil}
+}
+
+func NewArrayReply(items []*Reply) *Reply {
+	return &Reply{Type: ReplyArray, Items: items}
+}
+
+func NewDoubleReply(val float64) *Reply {
+	return &Reply{Type: ReplyDouble, Float: val}
+}
+
+func NewBoolReply(val bool) *Reply {
+	if val {
+		return &Reply{Type: ReplyBool, Num: 1}
+	}
+	return &Reply{Type: ReplyBool, Num: 0}
+}
+
+func NewMapReply(items []*Reply) *Reply {
+	return &Reply{Type: ReplyMap, Items: items}
+}
+
+func NewSetReply(items []*Reply) *Reply {
+	return &Reply{Type: ReplySet, Items: items}
+}
+
+func NewPushReply(strs []string) *Reply {
+	res := NewStrsReply(strs)
+	res.Type = ReplyPush
+	return res
+}
+
+func NewStrsReply(strs []string) *Reply {
+	items := make([]*Reply, 0, len(strs))
+	for _, str := range strs {
+		items = append(items, NewBulkReply(str))
+	}
+	return NewArrayReply(items)
+}
+
+// ToResp 转换为 json 协议的响应，结构化的数据全部打平
+func (r *Reply) ToResp(seqID string) *Resp {
+	if r.Type == ReplyError {
+		return &Resp{SeqID: seqID, Cmd: "ERROR", Args: []string{r.Str}}
+	}
+	if r.Type == ReplyStatus && r.Str == "OK" {
+		return &Resp{SeqID: seqID, Cmd: "OK"}
+	}
+	if r.Type == ReplyPush { // 推送消息沿用 MESSAGE 这种指令名
+		args := make([]string, 0)
+		for _, item := range r.Items[1:] {
+			args = item.flatten(args)
+		}
+		return &Resp{SeqID: seqID, Cmd: strings.ToUpper(r.Items[0].Str), Args: args}
+	}
+	return &Resp{SeqID: seqID, Cmd: "OK", Args: r.flatten(make([]string, 0))}
+}
+
+func (r *Reply) flatten(res []string) []string {
+	switch r.Type {
+	case ReplyInt, ReplyBool:
+		return append(res, strconv.FormatInt(r.Num, 10))
+	case ReplyDouble:
+		return append(res, formatDouble(r.Float))
+	case ReplyNil:
+		return append(res, "NIL")
+	case ReplyArray, ReplyMap, ReplySet, ReplyPush:
+		for _, item := range r.Items {
+			res = item.flatten(res)
+		}
+		return res
+	default:
+		return append(res, r.Str)
+	}
+}
+
+// Encode 按协议版本编码，RESP2 不认识的类型做降级处理
+func (r *Reply) Encode(buff *bytes.Buffer, proto int) {
+	switch r.Type {
+	case ReplyStatus:
+		buff.WriteString("+" + r.Str + "\r\n")
+	case ReplyError:
+		buff.WriteString("-" + errorWithCode(r.Str) + "\r\n")
+	case ReplyInt:
+		buff.WriteString(":" + strconv.FormatInt(r.Num, 10) + "\r\n")
+	case ReplyBulk:
+		buff.WriteString("$" + strconv.Itoa(len(r.Str)) + "\r\n" + r.Str + "\r\n")
+	case ReplyNil:
+		if proto == ProtoRESP3 {
+			buff.WriteString("_\r\n")
+		} else {
+			buff.WriteString("$-1\r\n")
+		}
+	case ReplyDouble:
+		if proto == ProtoRESP3 {
+			buff.WriteString("," + formatDouble(r.Float) + "\r\n")
+		} else {
+			NewBulkReply(formatDouble(r.Float)).Encode(buff, proto)
+		}
+	case ReplyBool:
+		if proto == ProtoRESP3 && r.Num != 0 {
+			buff.WriteString("#t\r\n")
+		} else if proto == ProtoRESP3 {
+			buff.WriteString("#f\r\n")
+		} else {
+			NewIntReply(r.Num).Encode(buff, proto)
+		}
+	case ReplyMap:
+		if proto == ProtoRESP3 {
+			buff.WriteString("%" + strconv.Itoa(len(r.Items)/2) + "\r\n")
+		} else { // 打平为 key value 交替的数组
+			buff.WriteString("*" + strconv.Itoa(len(r.Items)) + "\r\n")
+		}
+		r.encodeItems(buff, proto)
+	case ReplySet, ReplyPush, ReplyArray:
+		typ := r.Type
+		if proto != ProtoRESP3 {
+			typ = ReplyArray
+		}
+		buff.WriteString(string(typ) + strconv.Itoa(len(r.Items)) + "\r\n")
+		r.encodeItems(buff, proto)
+	}
+}
+
+func (r *Reply) encodeItems(buff *bytes.Buffer, proto int) {
+	for _, item := range r.Items {
+		item.Encode(buff, proto)
+	}
+}
+
+func formatDouble(val float64) string {
+	if math.IsInf(val, 1) {
+		return "inf"
+	}
+	if math.IsInf(val, -1) {
+		return "-inf"
+	}
+	return strconv.FormatFloat(val, 'f', -1, 64)
+}
+
+// 客户端依据第一个单词区分错误类型，没有全大写错误码的统一补上 ERR
+func errorWithCode(msg string) string {
+	code, _, _ := strings.Cut(msg, " ")
+	if len(code) > 0 && strings.ToUpper(code) == code && strings.Trim(code, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") == "" {
+		return msg
+	}
+	return "ERR " + msg
+}
+
+// IsRESP 根据连接前 4 个字节判断协议，json 帧以小端长度开头，请求不会超过 MaxReqSize 第 4 个字节必定为 0
+// 而 RESP 无论是数组还是 inline 指令都是可见字符，不足 4 个字节就已经换行的只能是 inline 指令
+func IsRESP(header []byte) bool {
+	return len(header) < 4 || header[3] != 0
+}
+
+func ReadRESP(reader *bufio.Reader) ([]string, error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' { // inline 指令 例如 telnet 直接输入
+		return strings.Fields(line), nil
+	}
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count < 0 || count > MaxBulkCount {
+		return nil, fmt.Errorf("%w: invalid multibulk length", ErrProtocol)
+	}
+	res := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		line, err = readLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$', got '%s'", ErrProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > MaxReqSize {
+			return nil, fmt.Errorf("%w: invalid bulk length", ErrProtocol)
+		}
+		bs := make([]byte, size+2) // 带上结尾的 \r\n
+		if _, err = io.ReadFull(reader, bs); err != nil {
+			return nil, err
+		}
+		res = append(res, string(bs[:size]))
+	}
+	return res, nil
+}
+
+// readLine 单行不能超过读缓冲区的大小，防止恶意客户端一直不发送换行
+func readLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", fmt.Errorf("%w: too big inline request", ErrProtocol)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"runtime/debug"
 	"sync"
+	"time"
 )
 
 type Server struct {
@@ -21,6 +24,12 @@ func (s *Server) Start() {
 	s.Listener, err = net.Listen("tcp", fmt.Sprintf("%s:%d", s.Conf.Ip, s.Conf.Port))
 	HandleErr(err)
 	Info("Listen %s", s.Listener.Addr().String())
+	s.Handler.TimeWheel.Start()
+	if s.Handler.Executor != nil {
+		s.Handler.Executor.Start()
+	}
+	go s.Handler.Cron()
+	s.Handler.StartRepl()
 	go s.accept()
 	// 阻塞处理信号
 	//signal.Notify(s.Quit, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
@@ -28,30 +37,41 @@ func (s *Server) Start() {
 }
 
 func (s *Server) accept() {
+	listener := s.Listener
 	for {
-		if s.Listener == nil {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) { // 服务关闭
 			break
 		}
-		conn, err := s.Listener.Accept()
-		HandleErr(err)
+		if err != nil { // 例如文件描述符耗尽，稍等重试即可
+			Error("Accept err %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
 		Info("Accept %s", conn.RemoteAddr().String())
+		s.Wait.Add(1)
 		go s.handleConn(conn)
 	}
 }
 
 func (s *Server) handleConn(conn net.Conn) {
-	s.Wait.Add(1)
 	defer s.Wait.Done()
+	defer func() {
+		// 单个连接出错只关闭该连接，不影响整个服务
+		if err := recover(); err != nil {
+			Error("Conn %s panic %v\n%s", conn.RemoteAddr().String(), err, debug.Stack())
+		}
+		if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			Warn("Close %s err %v", conn.RemoteAddr().String(), err)
+		}
+	}()
 	s.Handler.Handle(conn)
-	err := conn.Close()
-	HandleErr(err)
 }
 
 func (s *Server) Close() {
 	// 关闭监听
 	err := s.Listener.Close()
 	HandleErr(err)
-	s.Listener = nil
 	// 关闭处理对象
 	s.Handler.Close()
 	// 已经创建的链接还是要处理完毕的
@@ -1,70 +1,276 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
 	"net"
 	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	sessionID = &atomic.Int64{}
 )
 
 type Session struct {
 	Conn          net.Conn
+	Reader        *bufio.Reader
+	ID            int64
+	Name          string
+	Proto         int        // 连接使用的协议 首次请求时识别
+	WriteLock     sync.Mutex // 订阅之后由推送协程写出，复制时由复制协程写出
 	Auth          bool
 	DBIndex       int
 	Channels      map[string]bool
-	InTransaction bool   // 是否在事务中
-	ReqQueue      []*Req // 事务队列
-	WatchKey      map[string]int
+	Patterns      map[string]bool // psubscribe 订阅的模式
+	InTransaction bool            // 是否在事务中
+	TxDirty       bool            // 入队时出错，exec 时直接放弃
+	ReqQueue      []*Req          // 事务队列
+	InExec        bool            // 正在执行事务队列
+	TxAOF         *bytes.Buffer   // 事务执行期间的 aof 记录，执行完毕后一次写入
+	Waiter        *Waiter
+	Migration     *Migration // migrate 在锁内编码好的数据，由连接协程在锁外发送
+	WatchKey      map[WatchedKey]bool
+	WatchDirty    atomic.Bool // watch 的 key 被修改过，由修改 key 的连接设置
+	Captured      []*SeqReply // Capture 期间回复先缓存不写出
+	Capturing     bool
+	ListeningPort int  // 从节点通过 replconf 告知的端口
+	Master        bool // 从节点执行复制流的会话，不受集群检查限制
+	Asking        bool // asking 之后的下一条指令可以访问迁入中的范围
+	// 首次订阅后创建，之后的回复与推送都经过队列由推送协程写出，发布者只入队不会被慢连接阻塞
+	PushQueue    chan *SeqReply
+	PushOverflow atomic.Bool // 队列已满被断开，只记录一次日志
+}
+
+type SeqReply struct {
+	SeqID string
+	Reply *Reply
 }
 
-func (s *Session) ReadReq() *Req {
-	req := &Req{}
-	ReadObj(s.Conn, req)
-	return req
+// Capture 执行 fn 并返回期间产生的回复，推送消息不受影响，支持嵌套调用
+func (s *Session) Capture(fn func()) []*SeqReply {
+	capturing, captured := s.Capturing, s.Captured
+	s.Capturing = true
+	s.Captured = make([]*SeqReply, 0)
+	defer func() {
+		s.Capturing = capturing
+		s.Captured = captured
+	}()
+	fn()
+	return s.Captured
 }
 
-func (s *Session) WriteResp(resp *Resp) {
-	WriteObj(s.Conn, resp)
+// ResetTx exec 或 discard 之后退出事务，同时取消所有 watch
+func (s *Session) ResetTx() {
+	s.InTransaction = false
+	s.TxDirty = false
+	s.ReqQueue = nil
+	s.UnwatchAll()
 }
 
-func (s *Session) WriteError(seqID string, args ...string) {
-	s.WriteResp(&Resp{
-		SeqID: seqID,
-		Cmd:   "ERROR",
-		Args:  args,
-	})
+// DetectProto 等到 4 个字节或者一个换行再识别，json 帧的长度与数据一次写入，很短的 inline 指令不会凑够 4 个字节
+func (s *Session) DetectProto() error {
+	if _, err := s.Reader.Peek(1); err != nil {
+		return err
+	}
+	header, _ := s.Reader.Peek(min(s.Reader.Buffered(), 4))
+	for len(header) < 4 && bytes.IndexByte(header, '\n') < 0 {
+		var err error
+		if header, err = s.Reader.Peek(len(header) + 1); err != nil {
+			return err
+		}
+	}
+	if IsRESP(header) {
+		s.Proto = ProtoRESP2 // 默认 RESP2 通过 HELLO 协商升级
+	} else {
+		s.Proto = ProtoJSON
+	}
+	return nil
 }
 
-func (s *Session) WriteOk(seqID string, args ...string) {
-	s.WriteResp(&Resp{
-		SeqID: seqID,
-		Cmd:   "OK",
-		Args:  args,
-	})
+func (s *Session) ReadReq() (*Req, error) {
+	if s.Proto == ProtoJSON {
+		req := &Req{}
+		if err := ReadObj(s.Reader, req); err != nil {
+			return nil, err
+		}
+		if len(req.Cmd) == 0 {
+			return nil, fmt.Errorf("%w: empty cmd", ErrProtocol)
+		}
+		return req, nil
+	}
+	for {
+		args, err := ReadRESP(s.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) > 0 { // 空行直接忽略
+			return &Req{Cmd: args[0], Args: args[1:]}, nil
+		}
+	}
+}
+
+// WriteReply 写入失败只关闭当前连接，读循环会随之退出并清理会话
+func (s *Session) WriteReply(seqID string, reply *Reply) {
+	if s.Capturing {
+		s.Captured = append(s.Captured, &SeqReply{SeqID: seqID, Reply: reply})
+		return
+	}
+	s.writeReply(seqID, reply)
+}
+
+// writeReply 订阅之后自己的回复也需要入队，保证与推送的顺序一致，队列满时等待推送协程写出
+func (s *Session) writeReply(seqID string, reply *Reply) {
+	if s.PushQueue != nil {
+		s.PushQueue <- &SeqReply{SeqID: seqID, Reply: reply}
+		return
+	}
+	s.write(seqID, reply)
 }
 
-func (s *Session) Subscribe(channel string) bool {
-	has := s.Channels[channel]
-	s.Channels[channel] = true
+func (s *Session) write(seqID string, reply *Reply) {
+	s.WriteLock.Lock()
+	defer s.WriteLock.Unlock()
+	var err error
+	if s.Proto == ProtoJSON {
+		err = WriteObj(s.Conn, reply.ToResp(seqID))
+	} else {
+		buff := &bytes.Buffer{}
+		reply.Encode(buff, s.Proto)
+		_, err = s.Conn.Write(buff.Bytes())
+	}
+	if err != nil {
+		if !IsClosedErr(err) {
+			Warn("Write %s err %v", s.Conn.RemoteAddr(), err)
+		}
+		_ = s.Conn.Close()
+	}
+}
+
+// WriteRaw 直接写出已经编码的数据，用于向从节点发送快照与复制流
+func (s *Session) WriteRaw(bs []byte) error {
+	s.WriteLock.Lock()
+	defer s.WriteLock.Unlock()
+	_, err := s.Conn.Write(bs)
+	return err
+}
+
+func (s *Session) WriteError(seqID string, msg string) {
+	s.WriteReply(seqID, NewErrorReply(msg))
+}
+
+func (s *Session) WriteOk(seqID string) {
+	s.WriteReply(seqID, NewOkReply())
+}
+
+func (s *Session) WriteStatus(seqID string, status string) {
+	s.WriteReply(seqID, NewStatusReply(status))
+}
+
+func (s *Session) WriteNum(seqID string, count int) {
+	s.WriteReply(seqID, NewIntReply(int64(count)))
+}
+
+func (s *Session) WriteBulk(seqID string, str string) {
+	s.WriteReply(seqID, NewBulkReply(str))
+}
+
+func (s *Session) WriteNil(seqID string) {
+	s.WriteReply(seqID, NewNilReply())
+}
+
+func (s *Session) WriteStrs(seqID string, strs []string) {
+	s.WriteReply(seqID, NewStrsReply(strs))
+}
+
+func (s *Session) WriteDouble(seqID string, val float64) {
+	s.WriteReply(seqID, NewDoubleReply(val))
+}
+
+// WriteScan 扫描类指令的回复 [cursor [item...]]
+func (s *Session) WriteScan(seqID string, cursor uint64, items []string) {
+	s.WriteReply(seqID, NewArrayReply([]*Reply{NewBulkReply(strconv.FormatUint(cursor, 10)), NewStrsReply(items)}))
+}
+
+// WritePush 带外推送，不对应任何请求所以没有 SeqID，来自其他连接所以只入队不等待
+// 与 redis 的 client-output-buffer-limit pubsub 一致，跟不上的订阅者直接断开，读循环随之退出并清理会话
+func (s *Session) WritePush(strs ...string) {
+	s.push(&SeqReply{Reply: NewPushReply(strs)})
+}
+
+// WriteSubReply 订阅的确认在持有 Pubhub 锁时入队，保证先于之后发布的消息，同样不能等待
+func (s *Session) WriteSubReply(seqID string, reply *Reply) {
+	s.push(&SeqReply{SeqID: seqID, Reply: reply})
+}
+
+func (s *Session) push(item *SeqReply) {
+	select {
+	case s.PushQueue <- item:
+	default:
+		if s.PushOverflow.CompareAndSwap(false, true) {
+			Warn("Push queue of %s is full, close connection", s.Conn.RemoteAddr())
+		}
+		_ = s.Conn.Close()
+	}
+}
+
+// StartPush 首次订阅时调用，调用方是会话自己的协程
+func (s *Session) StartPush() {
+	if s.PushQueue != nil {
+		return
+	}
+	s.PushQueue = make(chan *SeqReply, PushQueueSize)
+	go func() {
+		for item := range s.PushQueue { // 连接关闭后写入直接失败，继续取出防止入队的一方阻塞
+			s.write(item.SeqID, item.Reply)
+		}
+	}()
+}
+
+// StopPush 取消全部订阅后调用，之后不会再有发布者入队
+func (s *Session) StopPush() {
+	if s.PushQueue != nil {
+		close(s.PushQueue)
+	}
+}
+
+// subs 精确订阅的通道与模式订阅分开记录
+func (s *Session) subs(pattern bool) map[string]bool {
+	if pattern {
+		return s.Patterns
+	}
+	return s.Channels
+}
+
+func (s *Session) Subscribe(channel string, pattern bool) bool {
+	subs := s.subs(pattern)
+	has := subs[channel]
+	subs[channel] = true
 	return !has
 }
 
-func (s *Session) GetChannels() []string {
+func (s *Session) GetChannels(pattern bool) []string {
 	res := make([]string, 0)
-	for channel := range s.Channels {
+	for channel := range s.subs(pattern) {
 		res = append(res, channel)
 	}
 	return res
 }
 
-func (s *Session) Unsubscribe(channel string) bool {
-	has := s.Channels[channel]
-	delete(s.Channels, channel)
+func (s *Session) Unsubscribe(channel string, pattern bool) bool {
+	subs := s.subs(pattern)
+	has := subs[channel]
+	delete(subs, channel)
 	return has
 }
 
-func (s *Session) WriteNum(seqID string, count int) {
-	s.WriteOk(seqID, strconv.FormatInt(int64(count), 10))
+// SubCount 订阅回复中的订阅总数，通道与模式一起计算
+func (s *Session) SubCount() int {
+	return len(s.Channels) + len(s.Patterns)
 }
 
 func NewSession(conn net.Conn) *Session {
-	return &Session{Conn: conn, DBIndex: 0, Channels: make(map[string]bool), WatchKey: make(map[string]int)} // 默认选择 0 号
+	return &Session{ID: sessionID.Add(1), Conn: conn, Reader: bufio.NewReaderSize(conn, ReadBuffSize), DBIndex: 0, Channels: make(map[string]bool), Patterns: make(map[string]bool), WatchKey: make(map[WatchedKey]bool)} // 默认选择 0 号
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"iter"
+	"slices"
+	"strconv"
+)
+
+// Set 元素全部是整数且数量较少时使用有序的 int64 数组存储(intset)，二分查找，节省内存
+// 加入非整数元素或者数量超过 SetMaxIntSetEntries 后转换为 map 存储，不会再转换回来
+type Set struct {
+	Ints []int64
+	Dict *Dict[struct{}]
+}
+
+func NewSet() *Set {
+	return &Set{Ints: make([]int64, 0)}
+}
+
+// parseSetInt 只有规范的整数才能使用 intset 编码，避免 "01" "+1" 之类的转换后丢失原始值
+func parseSetInt(member string) (int64, bool) {
+	val, err := strconv.ParseInt(member, 10, 64)
+	if err != nil || strconv.FormatInt(val, 10) != member {
+		return 0, false
+	}
+	return val, true
+}
+
+func (s *Set) IsIntSet() bool {
+	return s.Dict == nil
+}
+
+func (s *Set) Encoding() string {
+	if s.IsIntSet() {
+		return "intset"
+	}
+	return "hashtable"
+}
+
+func (s *Set) toDict() {
+	s.Dict = NewDict[struct{}]()
+	for _, val := range s.Ints {
+		s.Dict.Put(strconv.FormatInt(val, 10), struct{}{})
+	}
+	s.Ints = nil
+}
+
+func (s *Set) Add(member string) bool {
+	if s.IsIntSet() {
+		val, ok := parseSetInt(member)
+		if ok {
+			idx, has := slices.BinarySearch(s.Ints, val)
+			if has {
+				return false
+			}
+			if len(s.Ints) < SetMaxIntSetEntries {
+				s.Ints = slices.Insert(s.Ints, idx, val)
+				return true
+			}
+		}
+		s.toDict()
+	}
+	return s.Dict.Put(member, struct{}{})
+}
+
+func (s *Set) Remove(member string) bool {
+	if s.IsIntSet() {
+		val, ok := parseSetInt(member)
+		if !ok {
+			return false
+		}
+		idx, has := slices.BinarySearch(s.Ints, val)
+		if has {
+			s.Ints = slices.Delete(s.Ints, idx, idx+1)
+		}
+		return has
+	}
+	return s.Dict.Del(member)
+}
+
+func (s *Set) Contains(member string) bool {
+	if s.IsIntSet() {
+		val, ok := parseSetInt(member)
+		if !ok {
+			return false
+		}
+		_, has := slices.BinarySearch(s.Ints, val)
+		return has
+	}
+	_, has := s.Dict.Get(member)
+	return has
+}
+
+func (s *Set) GetCount() int {
+	if s.IsIntSet() {
+		return len(s.Ints)
+	}
+	return s.Dict.Len()
+}
+
+func (s *Set) All() iter.Seq[string] {
+	return func(yield func(string) bool) {
+		if s.IsIntSet() {
+			for _, val := range s.Ints {
+				if !yield(strconv.FormatInt(val, 10)) {
+					return
+				}
+			}
+			return
+		}
+		for member := range s.Dict.Keys() {
+			if !yield(member) {
+				return
+			}
+		}
+	}
+}
+
+// Scan intset 最多 SetMaxIntSetEntries 个元素，一次全部返回
+func (s *Set) Scan(cursor uint64, count int, callback func(string)) uint64 {
+	if s.IsIntSet() {
+		for member := range s.All() {
+			callback(member)
+		}
+		return 0
+	}
+	return s.Dict.Scan(cursor, count, func(member string, _ struct{}) {
+		callback(member)
+	})
+}
+
+func (s *Set) Members() []string {
+	return slices.Collect(s.All())
+}
@@ -74,7 +74,9 @@ func (s *SkipList) Del(key string) bool {
 	}
 	node := s.Root
 	for i := 0; i < s.Height; i++ { // 最底层 100% 链接，每上一层有一半的概率建立链接，一旦不再建立就直接结束
-		for node.Nexts[i].Next != nil && node.Nexts[i].Next.Score < score {
+		// 分数相同的节点需要继续向后找到 key 本身
+		for node.Nexts[i].Next != nil && (node.Nexts[i].Next.Score < score ||
+			(node.Nexts[i].Next.Score == score && node.Nexts[i].Next.Key != key)) {
 			node = node.Nexts[i].Next
 		}
 		if node.Nexts[i].Next != nil && node.Nexts[i].Next.Key == key {
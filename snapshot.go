@@ -0,0 +1,107 @@
+package main
+
+import "bytes"
+
+// Snapshot 分片粒度的写时复制快照，开始时只在全部分片上登记，之后逐个分片编码
+// 写操作修改一个还没有编码的分片前先替快照编码这个分片，快照因此与登记时刻严格一致，编码期间不阻塞其他分片
+type Snapshot struct {
+	Buff   *bytes.Buffer                                              // 登记时写入头部，全部分片编码完成后依次拼接
+	Select func(index int)                                            // 写入切换数据库
+	Encode func(buff *bytes.Buffer, db *DB, key string, entry *Entry) // 编码一个 key，调用方持有分片的写锁
+	Finish func() []byte                                              // 写入结尾返回完整的快照
+	Chunks [][][]byte                                                 // 数据库 -> 分片 -> 编码结果
+}
+
+// NewRDBSnapshot 快照格式的头部由调用方写入 encoder
+func NewRDBSnapshot(encoder *RDBEncoder) *Snapshot {
+	return &Snapshot{
+		Buff:   encoder.Buff,
+		Select: encoder.WriteSelect,
+		Encode: func(buff *bytes.Buffer, db *DB, key string, entry *Entry) {
+			(&RDBEncoder{Buff: buff}).WriteEntry(key, entry, db.TTLMap.Get(key))
+		},
+		Finish: encoder.Finish,
+	}
+}
+
+func (s *Snapshot) copy(db *DB, idx int) {
+	buff := &bytes.Buffer{}
+	for key, entry := range db.DataMap.Shards[idx].Data {
+		s.Encode(buff, db, key, entry)
+	}
+	s.Chunks[db.Index][idx] = buff.Bytes()
+}
+
+// copyShard 为还在等待这个分片的快照编码，调用方持有分片的写锁或者处于执行协程
+func (d *DB) copyShard(idx int) {
+	shard := d.DataMap.Shards[idx]
+	for _, snap := range shard.Snapshots {
+		snap.copy(d, idx)
+	}
+	shard.Snapshots = nil
+}
+
+// copyKeys 修改 key 之前调用，调用方已经持有 key 所在分片的写锁
+func (d *DB) copyKeys(keys []string) {
+	for _, key := range keys {
+		if idx := int(d.DataMap.GetIndex(key)); len(d.DataMap.Shards[idx].Snapshots) > 0 {
+			d.copyShard(idx)
+		}
+	}
+}
+
+// copyAll 清空数据库之前调用，调用方已经持有全部分片的写锁
+func (d *DB) copyAll() {
+	for idx := range d.DataMap.Shards {
+		d.copyShard(idx)
+	}
+}
+
+// beginSnapshot 短暂对全部分片加写锁并登记快照，record 在同一时刻记录快照对应的 aof 或复制位置
+func (h *Handler) beginSnapshot(snap *Snapshot, record func()) {
+	unlock := h.LockAll()
+	defer unlock()
+	snap.Chunks = make([][][]byte, len(h.DBs))
+	for i, db := range h.DBs {
+		snap.Chunks[i] = make([][]byte, len(db.DataMap.Shards))
+		for _, shard := range db.DataMap.Shards {
+			shard.Snapshots = append(shard.Snapshots, snap)
+		}
+	}
+	record()
+}
+
+// finishSnapshot 逐个分片编码还没有被写操作提前编码的分片，每次只锁一个分片
+// 单线程模式下 inline 表示已经处于执行协程，否则每个分片单独提交给执行协程
+func (h *Handler) finishSnapshot(snap *Snapshot, inline bool) []byte {
+	for _, db := range h.DBs {
+		for idx, shard := range db.DataMap.Shards {
+			switch {
+			case h.Executor == nil:
+				shard.Lock.Lock()
+				db.copyShard(idx)
+				shard.Lock.Unlock()
+			case inline:
+				db.copyShard(idx)
+			default:
+				h.Executor.Exec(func() {
+					db.copyShard(idx)
+				})
+			}
+		}
+	}
+	for i, chunks := range snap.Chunks { // 没有数据的数据库不需要切换
+		size := 0
+		for _, chunk := range chunks {
+			size += len(chunk)
+		}
+		if size == 0 {
+			continue
+		}
+		snap.Select(i)
+		for _, chunk := range chunks {
+			snap.Buff.Write(chunk)
+		}
+	}
+	return snap.Finish()
+}
@@ -1,10 +1,20 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"hash/fnv"
+	"io"
+	"math"
 	"math/rand"
+	"net"
+	"os"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -18,6 +28,9 @@ import (
 //}
 
 func TestSelect(t *testing.T) {
+	if testing.Short() {
+		t.Skip("需要手动停止")
+	}
 	stopChan := make(chan struct{})
 	timeChan := time.Tick(time.Second)
 	count := 10
@@ -37,6 +50,9 @@ func TestSelect(t *testing.T) {
 }
 
 func TestTimeWheel(t *testing.T) {
+	if testing.Short() {
+		t.Skip("需要手动停止")
+	}
 	tw := NewTimeWheel(8, time.Second)
 	for i := 0; i < 16; i++ {
 		tw.AddTask(strconv.FormatInt(int64(i), 10), func(key string) {
@@ -54,6 +70,9 @@ var (
 )
 
 func TestChan(t *testing.T) {
+	if testing.Short() {
+		t.Skip("需要手动停止")
+	}
 	chan1 := make(chan []byte, 1024)
 	chan2 := make(chan []byte, 1024)
 	go func() {
@@ -107,6 +126,9 @@ func TestMap(t *testing.T) {
 }
 
 func TestClient(t *testing.T) {
+	if testing.Short() {
+		t.Skip("需要从标准输入读取")
+	}
 	//client := NewClient("127.0.0.1:3000")
 	var line string
 	for {
@@ -142,3 +164,1383 @@ func TestRead(t *testing.T) {
 	//fmt.Println(buff.String())
 	fmt.Println(strconv.FormatFloat(23.232323, 'f', -1, 64))
 }
+
+// respClient 测试用的 RESP 客户端，回复转换为便于比较的字符串
+// 状态、错误、整数与空值保留类型前缀，bulk 只保留内容，聚合类型为 前缀[元素 元素]
+type respClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialRESP(t *testing.T, conf *Conf) *respClient {
+	conn, err := net.Dial("tcp", net.JoinHostPort(conf.Ip, strconv.Itoa(conf.Port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &respClient{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// send 只发送不读取，用于阻塞指令与流水线
+func (c *respClient) send(args ...string) {
+	buff := &bytes.Buffer{}
+	fmt.Fprintf(buff, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(buff, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, _ = c.conn.Write(buff.Bytes())
+}
+
+func (c *respClient) do(args ...string) string {
+	c.send(args...)
+	return c.read()
+}
+
+// read 读取一个回复，超时或者连接关闭时返回 <错误>
+func (c *respClient) read() string {
+	_ = c.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	res, err := c.readReply()
+	if err != nil {
+		return "<" + err.Error() + ">"
+	}
+	return res
+}
+
+func (c *respClient) readReply() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	switch line[0] {
+	case '*', '%', '~', '>':
+		count, _ := strconv.Atoi(line[1:])
+		if line[0] == '%' {
+			count *= 2
+		}
+		items := make([]string, 0, count)
+		for i := 0; i < count; i++ {
+			item, err := c.readReply()
+			if err != nil {
+				return "", err
+			}
+			items = append(items, item)
+		}
+		return line[:1] + "[" + strings.Join(items, " ") + "]", nil
+	case '$':
+		size, _ := strconv.Atoi(line[1:])
+		if size < 0 {
+			return line, nil
+		}
+		bs := make([]byte, size+2)
+		if _, err = io.ReadFull(c.reader, bs); err != nil {
+			return "", err
+		}
+		return string(bs[:size]), nil
+	default:
+		return line, nil
+	}
+}
+
+func startServer(t *testing.T, conf *Conf) *Server {
+	if conf.AOFFile == "" {
+		conf.AOFFile = t.TempDir() + "/aof.log"
+	}
+	server := NewServer(conf)
+	server.Start()
+	return server
+}
+
+// TestRESP 数组与 inline 两种请求格式、流水线以及协议错误，协议错误先回复再断开连接
+// 不足 4 个字节的 inline 指令也能识别协议
+func TestRESP(t *testing.T) {
+	conf := &Conf{Ip: "127.0.0.1", Port: 3196, MaxDB: 2, ShardCount: 4, AOFFsync: FsyncNo}
+	server := startServer(t, conf)
+	defer server.Close()
+	c := dialRESP(t, conf)
+	defer c.conn.Close()
+	for _, item := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{CmdSet, "k", "hello world"}, "+OK"},
+		{[]string{CmdGet, "k"}, "hello world"},
+		{[]string{CmdGet, "none"}, "$-1"},
+		{[]string{CmdZAdd, "z", "1", "a", "2", ""}, ":2"},
+		{[]string{CmdZRange, "z", "0", "-1"}, "*[a ]"},
+		{[]string{CmdHSet, "k", "f", "v"}, "-" + MsgWrongType},
+		{[]string{"NOPE"}, "-ERR Invalid Cmd"},
+	} {
+		if got := c.do(item.args...); got != item.want {
+			t.Fatalf("%v got %q want %q", item.args, got, item.want)
+		}
+	}
+	// inline 指令与流水线，回复按请求的顺序返回
+	_, _ = c.conn.Write([]byte("PING\r\nSET inline v\r\n\r\n*2\r\n$3\r\nGET\r\n$6\r\ninline\r\n"))
+	for _, want := range []string{"+PONG", "+OK", "v"} {
+		if got := c.read(); got != want {
+			t.Fatalf("pipeline got %q want %q", got, want)
+		}
+	}
+	_, _ = c.conn.Write([]byte("*1\r\n+PING\r\n"))
+	if got := c.read(); !strings.HasPrefix(got, "-ERR Protocol error") {
+		t.Fatalf("protocol error %q", got)
+	}
+	if got := c.read(); got != "<EOF>" {
+		t.Fatalf("not closed %q", got)
+	}
+	short := dialRESP(t, conf)
+	defer short.conn.Close()
+	_, _ = short.conn.Write([]byte("X\r\n"))
+	if got := short.read(); got != "-ERR Invalid Cmd" {
+		t.Fatalf("short inline %q", got)
+	}
+}
+
+// TestRESP3 HELLO 协商协议版本，同一个指令在两种协议下回复不同的类型
+func TestRESP3(t *testing.T) {
+	conf := &Conf{Ip: "127.0.0.1", Port: 3195, MaxDB: 2, ShardCount: 4, AOFFsync: FsyncNo}
+	server := startServer(t, conf)
+	defer server.Close()
+	c := dialRESP(t, conf)
+	defer c.conn.Close()
+	c.do(CmdZAdd, "z", "1.5", "m")
+	c.do(CmdHSet, "h", "f", "v")
+	c.do(CmdSAdd, "s", "m")
+	cases := []struct {
+		args  []string
+		resp2 string
+		resp3 string
+	}{
+		{[]string{CmdGet, "none"}, "$-1", "_"},
+		{[]string{CmdZScore, "z", "m"}, "1.5", ",1.5"},
+		{[]string{CmdHGetAll, "h"}, "*[f v]", "%[f v]"},
+		{[]string{CmdSMembers, "s"}, "*[m]", "~[m]"},
+		{[]string{CmdZRange, "z", "0", "-1", "WITHSCORES"}, "*[m 1.5]", "*[*[m ,1.5]]"},
+	}
+	check := func(resp3 bool) {
+		for _, item := range cases {
+			want := item.resp2
+			if resp3 {
+				want = item.resp3
+			}
+			if got := c.do(item.args...); got != want {
+				t.Fatalf("resp3 %v %v got %q want %q", resp3, item.args, got, want)
+			}
+		}
+	}
+	check(false)
+	if got := c.do(CmdHello, "4"); !strings.HasPrefix(got, "-NOPROTO") {
+		t.Fatalf("hello 4 %q", got)
+	}
+	got := c.do(CmdHello, "3", "SETNAME", "conn")
+	if !strings.HasPrefix(got, "%[server redis version 7.0.0 proto :3 id :") || !strings.HasSuffix(got, "mode standalone role master modules *[]]") {
+		t.Fatalf("hello 3 %q", got)
+	}
+	check(true)
+	if got := c.do(CmdSubscribe, "ch"); got != ">[subscribe ch :1]" { // 订阅期间仍然可以执行普通指令
+		t.Fatalf("subscribe %q", got)
+	}
+	if got := c.do(CmdGet, "none"); got != "_" {
+		t.Fatalf("get in subscribe %q", got)
+	}
+	c.do(CmdUnsubscribe)
+	if got := c.do(CmdHello, "2"); !strings.HasPrefix(got, "*[server redis") {
+		t.Fatalf("hello 2 %q", got)
+	}
+	check(false)
+}
+
+func TestQuickList(t *testing.T) {
+	list := NewQuickList()
+	res := make([]string, 0) // 使用切片对照
+	for i := 0; i < 20000; i++ {
+		val := strconv.FormatInt(int64(i), 10)
+		switch rand.Intn(8) {
+		case 0, 1:
+			list.PushHead(val)
+			res = append([]string{val}, res...)
+		case 2, 3:
+			list.PushTail(val)
+			res = append(res, val)
+		case 4:
+			if item, ok := list.PopHead(); ok {
+				if item != res[0] {
+					t.Fatalf("PopHead %s != %s", item, res[0])
+				}
+				res = res[1:]
+			}
+		case 5:
+			if item, ok := list.PopTail(); ok {
+				if item != res[len(res)-1] {
+					t.Fatalf("PopTail %s != %s", item, res[len(res)-1])
+				}
+				res = res[:len(res)-1]
+			}
+		case 6:
+			idx := rand.Intn(len(res) + 1)
+			list.Insert(idx, val)
+			res = append(res[:idx], append([]string{val}, res[idx:]...)...)
+		case 7:
+			if len(res) > 0 {
+				idx := rand.Intn(len(res))
+				target := res[idx]
+				list.RemoveIf(func(item string) bool { return item == target }, 1, false)
+				res = append(res[:idx], res[idx+1:]...)
+			}
+		}
+		if list.GetCount() != len(res) {
+			t.Fatalf("count %d != %d", list.GetCount(), len(res))
+		}
+		if len(res) > 0 {
+			idx := rand.Intn(len(res))
+			if item, _ := list.Get(idx); item != res[idx] {
+				t.Fatalf("Get %d %s != %s", idx, item, res[idx])
+			}
+		}
+	}
+	start, end := normalizeRange(10, -10, list.GetCount())
+	if fmt.Sprint(list.Range(start, end)) != fmt.Sprint(res[start:end+1]) {
+		t.Fatalf("Range err")
+	}
+	list.Trim(start, end)
+	if fmt.Sprint(list.Range(0, list.GetCount()-1)) != fmt.Sprint(res[start:end+1]) {
+		t.Fatalf("Trim err")
+	}
+}
+
+// TestBlockingPop 阻塞弹出按阻塞顺序唤醒、超时返回空、事务中不阻塞、数据库之间隔离，断开的连接不会拿走数据
+func TestBlockingPop(t *testing.T) {
+	t.Run("lock", func(t *testing.T) {
+		testBlockingPop(t, &Conf{Ip: "127.0.0.1", Port: 3194, MaxDB: 2, ShardCount: 4, AOFFsync: FsyncNo})
+	})
+	t.Run("single", func(t *testing.T) {
+		testBlockingPop(t, &Conf{Ip: "127.0.0.1", Port: 3193, MaxDB: 2, ShardCount: 4, AOFFsync: FsyncNo})
+	})
+}
+
+func testBlockingPop(t *testing.T, conf *Conf) {
+	server := startServer(t, conf)
+	defer server.Close()
+	a, b, c := dialRESP(t, conf), dialRESP(t, conf), dialRESP(t, conf)
+	defer a.conn.Close()
+	defer b.conn.Close()
+	defer c.conn.Close()
+	expect := func(name string, got string, want string) {
+		if got != want {
+			t.Fatalf("%s got %q want %q", name, got, want)
+		}
+	}
+	block := func(client *respClient, args ...string) { // 等待服务端处理完阻塞指令
+		client.send(args...)
+		time.Sleep(50 * time.Millisecond)
+	}
+	block(a, CmdBLPop, "q", "0")
+	block(b, CmdBLPop, "q", "0")
+	expect("push", c.do(CmdRPush, "q", "x", "y", "z"), ":3")
+	expect("first", a.read(), "*[q x]")
+	expect("second", b.read(), "*[q y]")
+	expect("left", c.do(CmdLRange, "q", "0", "-1"), "*[z]")
+
+	start := time.Now()
+	expect("timeout", a.do(CmdBRPop, "none", "0.3"), "$-1")
+	if cost := time.Since(start); cost < 250*time.Millisecond { // 时间轮的精度有限
+		t.Fatalf("timeout after %v", cost)
+	}
+	expect("multi", a.do(CmdMulti), "+OK")
+	expect("queued", a.do(CmdBLPop, "none", "0"), "+QUEUED")
+	expect("exec", a.do(CmdExec), "*[$-1]")
+
+	a.do(CmdSelect, "1")
+	block(a, CmdBLPop, "k", "0.5")
+	expect("other db push", c.do(CmdLPush, "k", "v"), ":1")
+	expect("other db", a.read(), "$-1")
+	a.do(CmdSelect, "0")
+
+	block(b, CmdBZPopMin, "z1", "z2", "0")
+	expect("zadd", c.do(CmdZAdd, "z2", "3", "m3", "1", "m1"), ":2")
+	expect("bzpopmin", b.read(), "*[z2 m1 1]")
+	block(a, CmdBLMove, "src", "dst", "LEFT", "RIGHT", "0")
+	c.do(CmdLPush, "src", "mv")
+	expect("blmove", a.read(), "mv")
+	expect("dst", c.do(CmdLRange, "dst", "0", "-1"), "*[mv]")
+
+	block(b, CmdBLPop, "gone", "0")
+	b.conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	c.do(CmdLPush, "gone", "v")
+	expect("closed waiter", c.do(CmdLLen, "gone"), ":1")
+	c.do(CmdSet, "str", "v")
+	expect("wrong type", c.do(CmdBLPop, "str", "0"), "-"+MsgWrongType)
+}
+
+func TestSet(t *testing.T) {
+	set := NewSet()
+	for i := 0; i < 10; i++ {
+		set.Add(strconv.Itoa(10 - i))
+	}
+	if !set.IsIntSet() || set.Add("5") || !set.Contains("10") || set.Contains("010") {
+		t.Fatalf("intset %v", set.Ints)
+	}
+	set.Add("010") // 不是规范的整数需要转换
+	if set.IsIntSet() || set.GetCount() != 11 || !set.Contains("1") || !set.Contains("010") {
+		t.Fatalf("hashtable %v", set.Dict)
+	}
+	set = NewSet()
+	for i := 0; i <= SetMaxIntSetEntries; i++ {
+		set.Add(strconv.Itoa(i))
+	}
+	if set.IsIntSet() || set.GetCount() != SetMaxIntSetEntries+1 {
+		t.Fatalf("intset overflow %s %d", set.Encoding(), set.GetCount())
+	}
+}
+
+func TestRDB(t *testing.T) {
+	list := NewQuickList()
+	list.PushTail("a")
+	list.PushTail("b")
+	set := NewSet()
+	set.Add("1")
+	set.Add("x")
+	ttl := &Entry{Type: TypeTime, Time: time.UnixMilli(time.Now().Add(time.Hour).UnixMilli())}
+	encoder := NewRDBEncoder()
+	encoder.WriteAux(RDBAuxAOFOffset, "100")
+	encoder.WriteSelect(3)
+	encoder.WriteEntry("str", &Entry{Type: TypeStr, Str: "val"}, ttl)
+	encoder.WriteEntry("list", &Entry{Type: TypeList, List: list}, nil)
+	encoder.WriteEntry("set", &Entry{Type: TypeSet, Set: set}, nil)
+	bs := encoder.Finish()
+
+	decoder := NewRDBDecoder(bytes.NewReader(bs))
+	if aux := decoder.ReadHead(); aux[RDBAuxAOFOffset] != "100" {
+		t.Fatalf("aux %v", aux)
+	}
+	entries := make(map[string]*Entry)
+	decoder.ReadEntries(func(index int, key string, entry *Entry, time0 time.Time) {
+		if index != 3 || (key == "str") != time0.Equal(ttl.Time) {
+			t.Fatalf("key %s index %d ttl %v", key, index, time0)
+		}
+		entries[key] = entry
+	})
+	if entries["str"].Str != "val" || entries["list"].List.GetCount() != 2 || !entries["set"].Set.Contains("x") {
+		t.Fatalf("entries %v", entries)
+	}
+
+	bs[len(bs)-10] ^= 0xff // 校验和不一致
+	defer func() {
+		if recover() == nil {
+			t.Fatal("corrupted rdb loaded")
+		}
+	}()
+	decoder = NewRDBDecoder(bytes.NewReader(bs))
+	decoder.ReadHead()
+	decoder.ReadEntries(func(int, string, *Entry, time.Time) {})
+}
+
+func TestAOFRecord(t *testing.T) {
+	aof := &AOF{}
+	buff := &bytes.Buffer{}
+	aof.writeReq(buff, &Req{Cmd: CmdSet, Args: []string{"a", "hello world"}})
+	buff.WriteString(`{"SeqID":"","Cmd":"DEL","Args":["b"]}` + "\r\n") // 没有校验和的旧格式
+	aof.writeReq(buff, &Req{Cmd: CmdDel, Args: []string{"a"}})
+	bs := buff.Bytes()
+	count := 0
+	if err := scanAOF(bs, 0, func(reqs []*Req) { count += len(reqs) }); err != nil || count != 3 {
+		t.Fatalf("scan %d %v", count, err)
+	}
+	if offset, err := checkAOF(bs[:len(bs)-3]); !errors.Is(err, ErrAOFTruncated) || offset <= 0 {
+		t.Fatalf("truncated %d %v", offset, err)
+	}
+	bs[10] ^= 1
+	if offset, err := checkAOF(bs); !errors.Is(err, ErrAOFChecksum) || offset != 0 {
+		t.Fatalf("checksum %d %v", offset, err)
+	}
+}
+
+func TestLookupCmd(t *testing.T) {
+	cases := []struct {
+		req *Req
+		ok  bool
+	}{
+		{&Req{Cmd: "get", Args: []string{"a", "b"}}, true},
+		{&Req{Cmd: CmdGet}, false},
+		{&Req{Cmd: CmdIncrBy, Args: []string{"a"}}, false},
+		{&Req{Cmd: CmdIncrBy, Args: []string{"a", "1"}}, true},
+		{&Req{Cmd: "nope"}, false},
+	}
+	for _, item := range cases {
+		if info, msg := LookupCmd(item.req); (info != nil) != item.ok {
+			t.Fatalf("%s %v %s", item.req.Cmd, item.req.Args, msg)
+		}
+	}
+}
+
+func TestParseNotifyFlags(t *testing.T) {
+	if flags, err := ParseNotifyFlags("KEA"); err != nil || flags != NotifyKeyspace|NotifyKeyevent|NotifyAll {
+		t.Fatalf("KEA %b %v", flags, err)
+	}
+	if flags, err := ParseNotifyFlags("Ex"); err != nil || flags != NotifyKeyevent|NotifyExpired {
+		t.Fatalf("Ex %b %v", flags, err)
+	}
+	if _, err := ParseNotifyFlags("Kq"); err == nil {
+		t.Fatal("Kq should be invalid")
+	}
+}
+
+func TestReplBacklog(t *testing.T) {
+	repl := NewRepl(16)
+	repl.Feed([]byte("0123456789")) // 没有从节点时只增加偏移量
+	if repl.TryPartial(NewReplica(NewSession(NewFakeConn())), repl.ID, 10) {
+		t.Fatal("backlog should be inactive")
+	}
+	id, offset := repl.AddReplica(NewReplica(NewSession(NewFakeConn())))
+	repl.Feed([]byte("abcdefghijklmnopqrst"))
+	if id != repl.ID || offset != 10 || repl.Offset != 30 {
+		t.Fatalf("offset %d %d", offset, repl.Offset)
+	}
+	if repl.TryPartial(NewReplica(NewSession(NewFakeConn())), repl.ID, 13) {
+		t.Fatal("offset 13 should be out of backlog")
+	}
+	replica := NewReplica(NewSession(NewFakeConn()))
+	if !repl.TryPartial(replica, repl.ID, 14) || string(replica.Pending) != "efghijklmnopqrst" {
+		t.Fatalf("pending %q", replica.Pending)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	if KeyHash("{user}:a") != KeyHash("{user}:b") || KeyHash("{}a") == KeyHash("{}b") {
+		t.Fatal("hash tag")
+	}
+	peers := []string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"}
+	cluster := NewCluster(peers[0], peers, "")
+	ranges := cluster.Ranges()
+	if len(ranges) != 3 || ranges[0].Start != 0 || ranges[2].End != math.MaxUint64 {
+		t.Fatalf("ranges %d", len(ranges))
+	}
+	for i := 1; i < len(ranges); i++ {
+		if ranges[i].Start != ranges[i-1].End+1 {
+			t.Fatalf("gap at %d", i)
+		}
+	}
+	moved, crossed := 0, 0
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		msg := cluster.Check([]string{key, "{" + key + "}:other"}, false, nil)
+		if strings.HasPrefix(msg, "MOVED") {
+			moved++
+		} else if msg != "" {
+			t.Fatalf("same tag %s", msg)
+		}
+		if cluster.Check([]string{key, key + "x"}, false, nil) == MsgCrossSlot {
+			crossed++
+		}
+	}
+	if moved == 0 || moved == 100 || crossed == 0 {
+		t.Fatalf("moved %d crossed %d", moved, crossed)
+	}
+	// 迁移中的范围：迁出方 key 不在本地时 ASK，迁入方只接受 asking
+	start, _ := cluster.AddNode("127.0.0.1:4")
+	key := ""
+	for i := 0; key == ""; i++ {
+		if sub := cluster.findRange(start); inRange(sub, strconv.Itoa(i)) {
+			key = strconv.Itoa(i)
+		}
+	}
+	sub := cluster.findRange(start)
+	if order, _ := cluster.nodes(); len(order) != 3 || !slices.Contains(peers, sub.Node) { // 交接前新节点没有范围
+		t.Fatalf("split owner %s", sub.Node)
+	}
+	sub.Node, sub.Migrating = peers[0], "127.0.0.1:4"
+	exists := func(k string) bool { return k == key }
+	if cluster.Check([]string{key}, false, exists) != "" ||
+		!strings.HasPrefix(cluster.Check([]string{key + "{" + key + "}"}, false, exists), "ASK") {
+		t.Fatal("migrating")
+	}
+	sub.Node, sub.Migrating, sub.Importing = "127.0.0.1:4", "", peers[1]
+	if cluster.Check([]string{key}, true, nil) != "" || !strings.HasSuffix(cluster.Check([]string{key}, false, nil), peers[1]) {
+		t.Fatal("importing")
+	}
+	entry, err := LoadEntry(DumpEntry(key, &Entry{Type: TypeStr, Str: "val"}))
+	if err != nil || entry.Str != "val" {
+		t.Fatalf("dump %v %v", entry, err)
+	}
+	if _, err = LoadEntry("bad"); err == nil {
+		t.Fatal("bad payload")
+	}
+}
+
+// TestClusterHandoff 源节点还有 key 时拒绝交接，交接后的范围表保存到文件，重启后仍然生效且之后拆分的范围不变
+func TestClusterHandoff(t *testing.T) {
+	self, peers := "127.0.0.1:1", []string{"127.0.0.1:1"}
+	conf := &Conf{Ip: "127.0.0.1", Port: 1, Peers: peers, ClusterConfigFile: t.TempDir() + "/nodes.json", MaxDB: 2, ShardCount: 4, AOFFile: t.TempDir() + "/aof.log", AOFFsync: FsyncNo}
+	h := NewHandler(conf)
+	session := NewSession(NewFakeConn())
+	reply := execLocal(h, session, CmdCluster, "addnode", "127.0.0.1:2")
+	start, _ := strconv.ParseUint(reply.Str, 10, 64)
+	key := ""
+	for i := 0; key == ""; i++ {
+		if sub := h.Cluster.findRange(start); inRange(sub, strconv.Itoa(i)) {
+			key = strconv.Itoa(i)
+		}
+	}
+	execLocal(h, session, CmdSelect, "1")
+	execLocal(h, session, CmdSet, key, "v")
+	handoff := []string{"setrange", reply.Str, "node", "127.0.0.1:2"}
+	if reply := execLocal(h, session, CmdCluster, handoff...); reply.Type != ReplyError {
+		t.Fatalf("handoff with keys %v", reply)
+	}
+	execLocal(h, session, CmdDel, key)
+	if reply := execLocal(h, session, CmdCluster, handoff...); reply.Type == ReplyError {
+		t.Fatalf("handoff %v", reply)
+	}
+	h.Close()
+
+	h = NewHandler(conf)
+	defer h.Close()
+	if sub := h.Cluster.findRange(start); sub == nil || sub.Node != "127.0.0.1:2" {
+		t.Fatalf("reload range %v", sub)
+	}
+	expect := NewCluster(self, peers, "")
+	expect.AddNode("127.0.0.1:2")
+	want, _ := expect.AddNode("127.0.0.1:3")
+	if got, _ := h.Cluster.AddNode("127.0.0.1:3"); got != want {
+		t.Fatalf("split after reload %d want %d", got, want)
+	}
+}
+
+// TestSelectRange 超出范围的数据库下标返回错误，不能让连接崩溃
+func TestSelectRange(t *testing.T) {
+	h := NewHandler(&Conf{MaxDB: 2, ShardCount: 4, AOFFile: t.TempDir() + "/aof.log", AOFFsync: FsyncNo})
+	defer h.Close()
+	session := NewSession(NewFakeConn())
+	for _, index := range []string{"-1", "2", "99"} {
+		if reply := execLocal(h, session, CmdSelect, index); reply.Type != ReplyError {
+			t.Fatalf("select %s %v", index, reply)
+		}
+	}
+	if reply := execLocal(h, session, CmdSelect, "1"); reply.Type == ReplyError || session.DBIndex != 1 {
+		t.Fatalf("select 1 %v", reply)
+	}
+}
+
+// TestMultiRejectCmd exec 中无法执行的指令以及参数个数不对的 flushdb publish 在事务中直接报错，exec 放弃整个事务，指令本身也没有执行
+func TestMultiRejectCmd(t *testing.T) {
+	h := NewHandler(&Conf{MaxDB: 1, ShardCount: 4, AOFFile: t.TempDir() + "/aof.log", AOFFsync: FsyncNo})
+	defer h.Close()
+	session := NewSession(NewFakeConn())
+	for _, args := range [][]string{
+		{CmdSave}, {CmdBGSave}, {CmdBGRewriteAOF}, {CmdSubscribe, "ch"}, {CmdPSubscribe, "ch*"},
+		{CmdReplicaOf, "no", "one"}, {CmdCluster, "info"}, {CmdMigrate, "127.0.0.1", "1", "a", "0", "0"},
+		{CmdFlushDB, "async"}, {CmdPublish, "ch"},
+	} {
+		execLocal(h, session, CmdSet, "a", "1")
+		execLocal(h, session, CmdMulti)
+		if reply := execLocal(h, session, CmdSet, "b", "1"); reply.Str != "QUEUED" {
+			t.Fatalf("%v queue %v", args, reply)
+		}
+		if reply := execLocal(h, session, args[0], args[1:]...); reply.Type != ReplyError {
+			t.Fatalf("%v %v", args, reply)
+		}
+		if reply := execLocal(h, session, CmdExec); reply.Type != ReplyError {
+			t.Fatalf("%v exec %v", args, reply)
+		}
+		if h.DBs[0].GetEntry("a") == nil || h.DBs[0].GetEntry("b") != nil {
+			t.Fatalf("%v executed", args)
+		}
+	}
+}
+
+// TestMultiServerCmd flushdb flushall publish 在事务中排队，exec 时按顺序执行，flushall 以一条记录写入事务，重放结果一致
+func TestMultiServerCmd(t *testing.T) {
+	conf := &Conf{MaxDB: 2, ShardCount: 4, AOFFile: t.TempDir() + "/aof.log", AOFFsync: FsyncNo}
+	h := NewHandler(conf)
+	session, sub := NewSession(NewFakeConn()), NewSession(NewFakeConn())
+	execLocal(h, sub, CmdSubscribe, "ch")
+	execLocal(h, session, CmdSet, "a", "1")
+	execLocal(h, session, CmdMulti)
+	for _, args := range [][]string{{CmdPublish, "ch", "msg"}, {CmdFlushDB}, {CmdSet, "b", "1"}} {
+		if reply := execLocal(h, session, args[0], args[1:]...); reply.Str != "QUEUED" {
+			t.Fatalf("%v queue %v", args, reply)
+		}
+	}
+	if h.DBs[0].GetEntry("a") == nil {
+		t.Fatal("flushdb executed before exec")
+	}
+	reply := execLocal(h, session, CmdExec)
+	if len(reply.Items) != 3 || reply.Items[0].Num != 1 || reply.Items[1].Str != "OK" || reply.Items[2].Str != "OK" {
+		t.Fatalf("exec %v", reply)
+	}
+	if h.DBs[0].GetEntry("a") != nil || h.DBs[0].GetEntry("b") == nil {
+		t.Fatal("flushdb in transaction")
+	}
+	execLocal(h, session, CmdSelect, "1")
+	execLocal(h, session, CmdSet, "x", "1")
+	execLocal(h, session, CmdSelect, "0")
+	execLocal(h, session, CmdMulti)
+	execLocal(h, session, CmdFlushAll)
+	execLocal(h, session, CmdSet, "c", "1")
+	if reply := execLocal(h, session, CmdExec); len(reply.Items) != 2 || reply.Items[0].Str != "OK" {
+		t.Fatalf("exec flushall %v", reply)
+	}
+	check := func(name string) {
+		if h.DBs[1].GetSize() != 0 || h.DBs[0].GetSize() != 1 || h.DBs[0].GetEntry("c") == nil {
+			t.Fatalf("%s flushall in transaction", name)
+		}
+	}
+	check("exec")
+	h.CloseSession(sub)
+	h.Close()
+	h = NewHandler(conf)
+	defer h.Close()
+	check("reload")
+}
+
+// blockConn 写入一直阻塞到连接关闭，模拟不读取数据的订阅者
+type blockConn struct {
+	*FakeConn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *blockConn) Write([]byte) (int, error) {
+	<-c.closed
+	return 0, net.ErrClosed
+}
+
+func (c *blockConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+// TestSlowSubscriber 发布只入队不会被不读取的订阅者阻塞，队列满后订阅者被断开
+func TestSlowSubscriber(t *testing.T) {
+	h := NewHandler(&Conf{MaxDB: 1, ShardCount: 4, AOFFile: t.TempDir() + "/aof.log", AOFFsync: FsyncNo})
+	defer h.Close()
+	conn := &blockConn{FakeConn: NewFakeConn(), closed: make(chan struct{})}
+	sub := NewSession(conn)
+	execLocal(h, sub, CmdSubscribe, "ch")
+	pub := NewSession(NewFakeConn())
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < PushQueueSize+10; i++ {
+			execLocal(h, pub, CmdPublish, "ch", "msg")
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publish blocked by slow subscriber")
+	}
+	select {
+	case <-conn.closed:
+	default:
+		t.Fatal("slow subscriber not closed")
+	}
+	h.CloseSession(sub)
+}
+
+// TestFullPushQueue 推送队列已满的订阅者再次订阅时不能持有 Pubhub 的锁等待，发布与键空间通知照常返回，订阅者被断开
+func TestFullPushQueue(t *testing.T) {
+	h := NewHandler(&Conf{MaxDB: 1, ShardCount: 4, AOFFile: t.TempDir() + "/aof.log", AOFFsync: FsyncNo, NotifyKeyspaceEvents: "KEA"})
+	defer h.Close()
+	conn := &blockConn{FakeConn: NewFakeConn(), closed: make(chan struct{})}
+	sub := NewSession(conn)
+	execLocal(h, sub, CmdSubscribe, "ch")
+	time.Sleep(50 * time.Millisecond) // 写出协程取出订阅的回复后一直卡在写出上
+	pub := NewSession(NewFakeConn())
+	for len(sub.PushQueue) < PushQueueSize {
+		execLocal(h, pub, CmdPublish, "ch", "msg")
+	}
+	done := make(chan struct{})
+	go func() {
+		h.HandleDBCmd(&Req{Cmd: CmdSubscribe, Args: []string{"other"}}, sub, true) // 不捕获回复，与连接协程直接执行一致
+		execLocal(h, pub, CmdPublish, "ch", "msg")
+		execLocal(h, pub, CmdSet, "k", "v")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pubhub blocked by a full subscriber")
+	}
+	select {
+	case <-conn.closed:
+	default:
+		t.Fatal("full subscriber not closed")
+	}
+	h.CloseSession(sub)
+}
+
+// TestRestoreTTL restore 记录到 aof 的过期时间向上取整到秒，重放后不会提前过期
+func TestRestoreTTL(t *testing.T) {
+	conf := &Conf{MaxDB: 1, ShardCount: 4, AOFFile: t.TempDir() + "/aof.log", AOFFsync: FsyncNo}
+	h := NewHandler(conf)
+	session := NewSession(NewFakeConn())
+	payload := DumpEntry("k", &Entry{Type: TypeStr, Str: "v"})
+	expireAt := time.Now().Add(1500 * time.Millisecond).UnixMilli()
+	if reply := execLocal(h, session, CmdRestore, "k", "1500", payload); reply.Type == ReplyError {
+		t.Fatalf("restore %v", reply)
+	}
+	h.Close()
+	bs, err := os.ReadFile(conf.AOFFile)
+	HandleErr(err)
+	req, _, err := readRecord(bs[bytes.LastIndexByte(bs[:len(bs)-1], '\n')+1:])
+	HandleErr(err)
+	if sec, _ := strconv.ParseInt(req.Args[1], 10, 64); req.Cmd != CmdAbsExpire || sec*1000 < expireAt {
+		t.Fatalf("aof %v expire at %d", req, expireAt)
+	}
+}
+
+// TestWrongType 对其他类型的 key 执行 string 与 zset 指令返回 WRONGTYPE，出错的写指令不写入 aof，重启后正常重放
+func TestWrongType(t *testing.T) {
+	conf := &Conf{MaxDB: 1, ShardCount: 4, AOFFile: t.TempDir() + "/aof.log", AOFFsync: FsyncNo}
+	h := NewHandler(conf)
+	session := NewSession(NewFakeConn())
+	execLocal(h, session, CmdHSet, "h", "f", "v")
+	execLocal(h, session, CmdZAdd, "z", "1", "a")
+	for _, args := range [][]string{
+		{CmdZAdd, "h", "1", "a"}, {CmdZRem, "h", "a"}, {CmdZRange, "h", "0", "-1"}, {CmdZCard, "h"},
+		{CmdZScore, "h", "a"}, {CmdZRank, "h", "a"}, {CmdGet, "z"}, {CmdIncrBy, "z", "1"},
+	} {
+		if reply := execLocal(h, session, args[0], args[1:]...); reply.Type != ReplyError || reply.Str != MsgWrongType {
+			t.Fatalf("%v %v", args, reply)
+		}
+	}
+	if reply := execLocal(h, session, CmdGet, "z", "h"); reply.Type != ReplyArray || reply.Items[0].Type != ReplyNil {
+		t.Fatalf("get many %v", reply)
+	}
+	bs, err := os.ReadFile(conf.AOFFile)
+	HandleErr(err)
+	if bytes.Count(bs, []byte(CmdZAdd)) != 1 || bytes.Contains(bs, []byte(CmdIncrBy)) {
+		t.Fatalf("aof %s", bs)
+	}
+	h.Close()
+	h = NewHandler(conf)
+	defer h.Close()
+	if reply := execLocal(h, session, CmdHGet, "h", "f"); reply.Str != "v" {
+		t.Fatalf("reload %v", reply)
+	}
+}
+
+// TestSnapshot 登记快照之后的修改不影响快照，写入前先编码被修改的分片，两种执行模式结果需要一致
+func TestSnapshot(t *testing.T) {
+	for _, single := range []bool{false, true} {
+		h := NewHandler(&Conf{MaxDB: 2, ShardCount: 4, AOFFile: t.TempDir() + "/aof.log", AOFFsync: FsyncNo, SingleThread: single})
+		if single {
+			h.Executor.Start()
+		}
+		session := NewSession(NewFakeConn())
+		execLocal(h, session, CmdSet, "a", "1")
+		execLocal(h, session, CmdRPush, "list", "x")
+		var snap *Snapshot
+		h.runTask(func() {
+			snap, _ = h.dumpRDB()
+		})
+		execLocal(h, session, CmdSet, "a", "2")
+		execLocal(h, session, CmdRPush, "list", "y")
+		execLocal(h, session, CmdSet, "b", "new")
+		execLocal(h, session, CmdSelect, "1")
+		execLocal(h, session, CmdSet, "c", "new")
+		bs := h.finishSnapshot(snap, false)
+		execLocal(h, session, CmdFlushAll)
+
+		decoder := NewRDBDecoder(bytes.NewReader(bs))
+		decoder.ReadHead()
+		entries := make(map[string]*Entry)
+		decoder.ReadEntries(func(index int, key string, entry *Entry, _ time.Time) {
+			entries[key] = entry
+		})
+		if len(entries) != 2 || entries["a"].Str != "1" || entries["list"].List.GetCount() != 1 {
+			t.Fatalf("single %v entries %v", single, entries)
+		}
+		h.Close()
+	}
+}
+
+// TestRewriteAOF 重写后的 aof 重放得到相同的数据，覆盖每种类型与过期时间，分别使用指令与快照两种格式
+func TestRewriteAOF(t *testing.T) {
+	for _, preamble := range []bool{false, true} {
+		conf := &Conf{MaxDB: 2, ShardCount: 4, AOFFile: t.TempDir() + "/aof.log", AOFFsync: FsyncNo, AOFUseRDBPreamble: preamble}
+		h := NewHandler(conf)
+		session := NewSession(NewFakeConn())
+		execLocal(h, session, CmdSet, "str", "v")
+		execLocal(h, session, CmdSetEX, "ttl", "v", "100")
+		execLocal(h, session, CmdZAdd, "zset", "1.5", "a", "-2", "b")
+		execLocal(h, session, CmdHSet, "hash", "f", "v")
+		execLocal(h, session, CmdRPush, "list", "x", "y", "z")
+		execLocal(h, session, CmdSAdd, "set", "1", "m")
+		execLocal(h, session, CmdSelect, "1")
+		execLocal(h, session, CmdSet, "db1", "v")
+		execLocal(h, session, CmdSelect, "0")
+		HandleErr(h.BGRewriteAOF())
+		execLocal(h, session, CmdRPush, "list", "after") // 重写期间的写入记录在重写缓冲中
+		for {
+			h.AOF.Lock.Lock()
+			rewriting := h.AOF.Rewriting
+			h.AOF.Lock.Unlock()
+			if !rewriting {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		h.Close()
+
+		h = NewHandler(conf)
+		session = NewSession(NewFakeConn())
+		for _, item := range []struct {
+			args []string
+			want string
+		}{
+			{[]string{CmdGet, "str"}, "v"},
+			{[]string{CmdZScore, "zset", "a"}, "1.5"},
+			{[]string{CmdZScore, "zset", "b"}, "-2"},
+			{[]string{CmdHGet, "hash", "f"}, "v"},
+			{[]string{CmdLIndex, "list", "-1"}, "after"},
+			{[]string{CmdLLen, "list"}, "4"},
+			{[]string{CmdSIsMember, "set", "m"}, "1"},
+			{[]string{CmdSCard, "set"}, "2"},
+		} {
+			reply := execLocal(h, session, item.args[0], item.args[1:]...)
+			if got := strings.Join(reply.flatten(nil), ","); got != item.want {
+				t.Fatalf("preamble %v %v got %s want %s", preamble, item.args, got, item.want)
+			}
+		}
+		if ttl := h.DBs[0].GetTTL("ttl"); ttl <= 0 || ttl > 100 {
+			t.Fatalf("preamble %v ttl %d", preamble, ttl)
+		}
+		if h.DBs[1].GetEntry("db1") == nil {
+			t.Fatalf("preamble %v db1", preamble)
+		}
+		h.Close()
+	}
+}
+
+// TestConcurrent 多个连接并发读写相同的 key，配合 go test -race 检查数据竞争，两种执行模式结果需要一致
+func TestConcurrent(t *testing.T) {
+	t.Run("lock", func(t *testing.T) {
+		testConcurrent(t, &Conf{Ip: "127.0.0.1", Port: 3199, MaxDB: 4, ShardCount: 16, AOFFile: t.TempDir() + "/aof.log", AOFFsync: FsyncEverySec})
+	})
+	t.Run("single", func(t *testing.T) {
+		testConcurrent(t, &Conf{Ip: "127.0.0.1", Port: 3198, MaxDB: 4, ShardCount: 16, AOFFile: t.TempDir() + "/aof.log", AOFFsync: FsyncEverySec})
+	})
+}
+
+func testConcurrent(t *testing.T, conf *Conf) {
+	server := NewServer(conf)
+	server.Start()
+	defer server.Close()
+	addr := net.JoinHostPort(conf.Ip, strconv.Itoa(conf.Port))
+	send := func(conn net.Conn, cmd string, args ...string) *Resp {
+		if err := WriteObj(conn, &Req{Cmd: cmd, Args: args}); err != nil {
+			t.Error(err)
+			return &Resp{}
+		}
+		resp := &Resp{}
+		if err := ReadObj(conn, resp); err != nil {
+			t.Error(err)
+		}
+		return resp
+	}
+	// 订阅者同时接收发布的消息
+	sub, err := net.Dial("tcp", addr)
+	HandleErr(err)
+	send(sub, CmdSet, "count", "0") // incrby 要求 key 已经存在
+	send(sub, CmdSubscribe, "ch")
+	go func() {
+		for ReadObj(sub, &Resp{}) == nil {
+		}
+	}()
+	clients, times := 8, 200
+	wait := &sync.WaitGroup{}
+	for i := 0; i < clients; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			conn, err := net.Dial("tcp", addr)
+			HandleErr(err)
+			defer conn.Close()
+			for j := 0; j < times; j++ {
+				val := fmt.Sprintf("%d-%d", i, j)
+				send(conn, CmdIncrBy, "count", "1")
+				send(conn, CmdRPush, "list", val)
+				send(conn, CmdHIncrBy, "hash", "field", "1")
+				send(conn, CmdSAdd, "set"+strconv.Itoa(i%2), val)
+				send(conn, CmdSUnionStore, "union", "set0", "set1")
+				send(conn, CmdZAdd, "zset", strconv.Itoa(j), val)
+				send(conn, CmdSetEX, "tmp"+val, val, "1")
+				send(conn, CmdGet, "tmp"+strconv.Itoa(i)+"-0")
+				send(conn, CmdPublish, "ch", val)
+			}
+		}()
+	}
+	wait.Wait()
+	sub.Close()
+	conn, err := net.Dial("tcp", addr)
+	HandleErr(err)
+	defer conn.Close()
+	total := strconv.Itoa(clients * times)
+	if resp := send(conn, CmdGet, "count"); resp.Args[0] != total {
+		t.Fatalf("count %v", resp.Args)
+	}
+	if resp := send(conn, CmdLLen, "list"); resp.Args[0] != total {
+		t.Fatalf("list %v", resp.Args)
+	}
+	if resp := send(conn, CmdHGet, "hash", "field"); resp.Args[0] != total {
+		t.Fatalf("hash %v", resp.Args)
+	}
+	if resp := send(conn, CmdSCard, "union"); resp.Args[0] != total {
+		t.Fatalf("union %v", resp.Args)
+	}
+}
+
+// BenchmarkExecMode 对比分片锁与单线程执行两种模式  go test -bench ExecMode -run ^$
+func BenchmarkExecMode(b *testing.B) {
+	LogLevel = LogWarn // 每个请求的日志会影响结果
+	for i, single := range []bool{false, true} {
+		b.Run(fmt.Sprintf("single=%v", single), func(b *testing.B) {
+			conf := &Conf{Ip: "127.0.0.1", Port: 3197 - i, MaxDB: 1, ShardCount: 256, AOFFile: b.TempDir() + "/aof.log", AOFFsync: FsyncNo, SingleThread: single}
+			server := NewServer(conf)
+			server.Start()
+			defer server.Close()
+			addr := net.JoinHostPort(conf.Ip, strconv.Itoa(conf.Port))
+			b.RunParallel(func(pb *testing.PB) {
+				conn, err := net.Dial("tcp", addr)
+				HandleErr(err)
+				defer conn.Close()
+				for pb.Next() {
+					key := strconv.Itoa(rand.Intn(1000))
+					HandleErr(WriteObj(conn, &Req{Cmd: CmdSet, Args: []string{key, key}}))
+					HandleErr(ReadObj(conn, &Resp{}))
+					HandleErr(WriteObj(conn, &Req{Cmd: CmdGet, Args: []string{key}}))
+					HandleErr(ReadObj(conn, &Resp{}))
+				}
+			})
+		})
+	}
+}
+
+// execLocal 在当前协程直接执行数据库指令并返回回复，不经过网络
+func execLocal(h *Handler, session *Session, cmd string, args ...string) *Reply {
+	replies := session.Capture(func() {
+		h.HandleDBCmd(&Req{Cmd: cmd, Args: args}, session, true)
+	})
+	if len(replies) == 0 {
+		return nil
+	}
+	return replies[0].Reply
+}
+
+// TestMultiAOF 事务在 aof 中以 multi exec 包裹一次写入，只读事务不写入，结尾不完整的事务整个丢弃
+func TestMultiAOF(t *testing.T) {
+	conf := &Conf{MaxDB: 2, ShardCount: 4, AOFFile: t.TempDir() + "/aof.log", AOFFsync: FsyncNo}
+	h := NewHandler(conf)
+	session := NewSession(NewFakeConn())
+	execLocal(h, session, CmdSet, "n", "1")
+	execLocal(h, session, CmdSelect, "1")
+	for _, args := range [][]string{
+		{CmdMulti}, {CmdSet, "n", "10"}, {CmdIncrBy, "n", "5"}, {CmdRPush, "l", "x", "y"}, {CmdGet, "n"}, {CmdExec},
+		{CmdMulti}, {CmdGet, "n"}, {CmdExec},
+	} {
+		if reply := execLocal(h, session, args[0], args[1:]...); reply.Type == ReplyError {
+			t.Fatalf("%v %v", args, reply)
+		}
+	}
+	h.Close()
+	bs, err := os.ReadFile(conf.AOFFile)
+	HandleErr(err)
+	blocks := make([]string, 0)
+	HandleErr(scanAOF(bs, 0, func(reqs []*Req) {
+		cmds := make([]string, 0, len(reqs))
+		for _, req := range reqs {
+			cmds = append(cmds, req.Cmd)
+		}
+		blocks = append(blocks, strings.Join(cmds, " "))
+	}))
+	if got := strings.Join(blocks, ","); got != "AOFID,SELECT,SET,SELECT,SET INCRBY RPUSH" {
+		t.Fatalf("aof blocks %s", got)
+	}
+
+	h = NewHandler(conf)
+	if h.DBs[1].GetEntry("n").Str != "15" || h.DBs[1].GetEntry("l").List.GetCount() != 2 {
+		t.Fatal("reload transaction")
+	}
+	h.Close()
+	// 截断在事务中间，整个事务都不会加载
+	idx := bytes.LastIndex(bs, []byte(`"RPUSH"`))
+	cut := bs[:bytes.LastIndex(bs[:idx], []byte("\r\n"))+2]
+	HandleErr(os.WriteFile(conf.AOFFile, cut, 0600))
+	offset, err := checkAOF(cut)
+	multi := bytes.LastIndex(cut, []byte(CmdMulti))
+	if err == nil || offset != int64(bytes.LastIndexByte(cut[:multi], '\n')+1) {
+		t.Fatalf("check %d %v", offset, err)
+	}
+	conf.AOFLoadTruncated = true
+	h = NewHandler(conf)
+	defer h.Close()
+	if h.DBs[1].GetSize() != 0 || h.DBs[0].GetEntry("n").Str != "1" {
+		t.Fatal("truncated transaction loaded")
+	}
+	if info, _ := os.Stat(conf.AOFFile); info.Size() != offset {
+		t.Fatalf("truncate to %d size %d", offset, info.Size())
+	}
+}
+
+// TestWatch watch 还不存在的 key 之后创建、删除、过期以及 flush 都会让事务失效，其他数据库的同名 key 与 unwatch 之后的修改不会
+func TestWatch(t *testing.T) {
+	h := NewHandler(&Conf{MaxDB: 2, ShardCount: 4, AOFFile: t.TempDir() + "/aof.log", AOFFsync: FsyncNo})
+	defer h.Close()
+	session, other := NewSession(NewFakeConn()), NewSession(NewFakeConn())
+	tx := func(name string, abort bool) {
+		execLocal(h, session, CmdMulti)
+		execLocal(h, session, CmdSet, "res", name)
+		if reply := execLocal(h, session, CmdExec); (reply.Type == ReplyError) != abort {
+			t.Fatalf("%s abort %v reply %v", name, abort, reply)
+		}
+	}
+	execLocal(h, session, CmdWatch, "missing")
+	execLocal(h, other, CmdSet, "missing", "1")
+	tx("create", true)
+	execLocal(h, session, CmdWatch, "missing")
+	execLocal(h, other, CmdDel, "missing")
+	tx("del", true)
+	execLocal(h, other, CmdSetEX, "ttl", "v", "1")
+	execLocal(h, session, CmdWatch, "ttl")
+	time.Sleep(1100 * time.Millisecond)
+	tx("expire", true)
+	execLocal(h, session, CmdWatch, "key")
+	execLocal(h, other, CmdSelect, "1")
+	execLocal(h, other, CmdSet, "key", "1")
+	execLocal(h, other, CmdSelect, "0")
+	tx("other db", false)
+	execLocal(h, session, CmdWatch, "key")
+	execLocal(h, session, CmdSelect, "1") // 切换数据库后原来 watch 的 key 仍然有效
+	execLocal(h, other, CmdSet, "key", "1")
+	tx("after select", true)
+	execLocal(h, session, CmdSelect, "0")
+	execLocal(h, session, CmdWatch, "missing")
+	execLocal(h, other, CmdFlushDB)
+	tx("flush", true)
+	execLocal(h, session, CmdWatch, "missing")
+	execLocal(h, other, CmdSet, "unrelated", "1")
+	tx("unrelated", false)
+	execLocal(h, session, CmdWatch, "key")
+	execLocal(h, session, CmdUnwatch)
+	execLocal(h, other, CmdSet, "key", "2")
+	tx("unwatch", false)
+	if reply := execLocal(h, session, CmdGet, "res"); reply.Str != "unwatch" {
+		t.Fatalf("res %v", reply)
+	}
+}
+
+// TestPSubscribe 模式订阅与频道订阅同时命中时各收到一条消息，PUBSUB 统计随订阅与断开变化
+func TestPSubscribe(t *testing.T) {
+	conf := &Conf{Ip: "127.0.0.1", Port: 3192, MaxDB: 2, ShardCount: 4, AOFFsync: FsyncNo}
+	server := startServer(t, conf)
+	defer server.Close()
+	c, sub := dialRESP(t, conf), dialRESP(t, conf)
+	defer c.conn.Close()
+	defer sub.conn.Close()
+	expect := func(name string, got string, want string) {
+		if got != want {
+			t.Fatalf("%s got %q want %q", name, got, want)
+		}
+	}
+	expect("psubscribe", sub.do(CmdPSubscribe, "orders.*", "x?"), "*[psubscribe orders.* :1]")
+	expect("psubscribe second", sub.read(), "*[psubscribe x? :2]")
+	expect("subscribe", sub.do(CmdSubscribe, "orders.1"), "*[subscribe orders.1 :3]")
+	expect("publish", c.do(CmdPublish, "orders.1", "hi"), ":2")
+	expect("message", sub.read(), "*[message orders.1 hi]")
+	expect("pmessage", sub.read(), "*[pmessage orders.* orders.1 hi]")
+	expect("publish miss", c.do(CmdPublish, "other", "hi"), ":0")
+
+	expect("channels", c.do(CmdPubSub, "CHANNELS"), "*[orders.1]")
+	expect("channels pattern", c.do(CmdPubSub, "CHANNELS", "x*"), "*[]")
+	expect("numsub", c.do(CmdPubSub, "NUMSUB", "orders.1", "none"), "*[orders.1 :1 none :0]")
+	expect("numpat", c.do(CmdPubSub, "NUMPAT"), ":2")
+	expect("unknown", c.do(CmdPubSub, "NOPE"), "-ERR Unknown PubSub Subcommand")
+
+	expect("punsubscribe", sub.do(CmdPUnsubscribe, "x?"), "*[punsubscribe x? :2]")
+	expect("punsubscribe all", sub.do(CmdPUnsubscribe), "*[punsubscribe orders.* :1]")
+	expect("punsubscribe none", sub.do(CmdPUnsubscribe), "*[punsubscribe $-1 :1]")
+	expect("numpat after", c.do(CmdPubSub, "NUMPAT"), ":0")
+	expect("publish after", c.do(CmdPublish, "orders.2", "hi"), ":0")
+
+	sub.conn.Close() // 断开的连接退出全部订阅
+	time.Sleep(50 * time.Millisecond)
+	expect("channels after close", c.do(CmdPubSub, "CHANNELS"), "*[]")
+}
+
+// TestSubscribeMode RESP2 订阅期间只能执行订阅相关指令与 PING RESET，RESET 退出订阅，RESP3 不受限制
+func TestSubscribeMode(t *testing.T) {
+	conf := &Conf{Ip: "127.0.0.1", Port: 3191, MaxDB: 2, ShardCount: 4, AOFFsync: FsyncNo}
+	server := startServer(t, conf)
+	defer server.Close()
+	a, b, c := dialRESP(t, conf), dialRESP(t, conf), dialRESP(t, conf)
+	defer a.conn.Close()
+	defer b.conn.Close()
+	defer c.conn.Close()
+	expect := func(name string, got string, want string) {
+		if got != want {
+			t.Fatalf("%s got %q want %q", name, got, want)
+		}
+	}
+	denied := func(cmd string) string {
+		return "-ERR Can't execute '" + strings.ToLower(cmd) + "': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / RESET are allowed in this context"
+	}
+	expect("subscribe a", a.do(CmdSubscribe, "ch"), "*[subscribe ch :1]")
+	expect("subscribe b", b.do(CmdSubscribe, "ch"), "*[subscribe ch :1]")
+	expect("psubscribe b", b.do(CmdPSubscribe, "c*"), "*[psubscribe c* :2]")
+	expect("unsubscribe a", a.do(CmdUnsubscribe, "ch"), "*[unsubscribe ch :0]")
+	expect("get after unsubscribe", a.do(CmdGet, "x"), "$-1") // 退订全部后回到普通模式
+	expect("publish", c.do(CmdPublish, "ch", "m"), ":2")
+	expect("message", b.read(), "*[message ch m]")
+	expect("pmessage", b.read(), "*[pmessage c* ch m]")
+
+	expect("get", b.do(CmdGet, "x"), denied(CmdGet))
+	expect("multi", b.do(CmdMulti), denied(CmdMulti))
+	expect("ping", b.do(CmdPing), "*[pong ]")
+	expect("ping msg", b.do(CmdPing, "hi"), "*[pong hi]")
+	expect("reset", b.do(CmdReset), "+RESET")
+	expect("get after reset", b.do(CmdGet, "x"), "$-1")
+	expect("channels", c.do(CmdPubSub, "CHANNELS"), "*[]")
+	expect("numpat", c.do(CmdPubSub, "NUMPAT"), ":0")
+
+	c.do(CmdHello, "3")
+	expect("subscribe resp3", c.do(CmdSubscribe, "ch"), ">[subscribe ch :1]")
+	expect("get resp3", c.do(CmdGet, "x"), "_")
+	expect("ping resp3", c.do(CmdPing), "+PONG")
+}
+
+// TestWait 副本确认写入后 WAIT 立即返回，副本不足时等到超时返回已确认的数量，事务中与副本上不允许 WAIT
+func TestWait(t *testing.T) {
+	conf := &Conf{Ip: "127.0.0.1", Port: 3190, MaxDB: 2, ShardCount: 4, AOFFsync: FsyncNo}
+	master := startServer(t, conf)
+	defer master.Close()
+	replicaConf := &Conf{Ip: "127.0.0.1", Port: 3189, MaxDB: 2, ShardCount: 4, AOFFsync: FsyncNo, ReplicaOf: "127.0.0.1:3190"}
+	replica := startServer(t, replicaConf)
+	defer replica.Close()
+	c := dialRESP(t, conf)
+	defer c.conn.Close()
+	rc := dialRESP(t, replicaConf)
+	defer rc.conn.Close()
+	expect := func(name string, got string, want string) {
+		if got != want {
+			t.Fatalf("%s got %q want %q", name, got, want)
+		}
+	}
+	for i := 0; !strings.Contains(c.do(CmdServerInfo, "replication"), "connected_slaves:1"); i++ {
+		if i > 50 {
+			t.Fatal("replica not connected")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	expect("wait 0", c.do(CmdWait, "0", "0"), ":1")
+	c.do(CmdSet, "k", "v")
+	start := time.Now()
+	expect("wait ack", c.do(CmdWait, "1", "1000"), ":1")
+	if cost := time.Since(start); cost > 500*time.Millisecond { // 副本确认后立即返回，不等到超时
+		t.Fatalf("wait ack after %v", cost)
+	}
+	expect("replica get", rc.do(CmdGet, "k"), "v")
+
+	c.do(CmdSet, "k", "v2")
+	start = time.Now()
+	expect("wait timeout", c.do(CmdWait, "2", "300"), ":1")
+	if cost := time.Since(start); cost < 250*time.Millisecond {
+		t.Fatalf("wait timeout after %v", cost)
+	}
+	expect("wait invalid", c.do(CmdWait, "x", "0"), "-ERR Invalid Num")
+	expect("multi", c.do(CmdMulti), "+OK")
+	expect("wait in multi", c.do(CmdWait, "1", "0"), "-ERR Invalid Wait In Transaction")
+	expect("exec", c.do(CmdExec), "-EXECABORT Transaction discarded because of previous errors")
+	expect("wait on replica", rc.do(CmdWait, "1", "0"), "-ERR Invalid Wait On Replica")
+}
+
+// TestRandCount 负数 count 允许重复，超过上限直接报错而不是按 count 分配结果
+func TestRandCount(t *testing.T) {
+	h := NewHandler(&Conf{MaxDB: 1, ShardCount: 4, AOFFile: t.TempDir() + "/aof.log", AOFFsync: FsyncNo})
+	defer h.Close()
+	session := NewSession(NewFakeConn())
+	execLocal(h, session, CmdHSet, "h", "f", "v")
+	huge := "-10000000000"
+	if reply := execLocal(h, session, CmdHRandField, "h", huge); reply.Type != ReplyError {
+		t.Fatalf("hrandfield huge count %v", reply)
+	}
+	if reply := execLocal(h, session, CmdHRandField, "h", "-3", "WITHVALUES"); len(reply.Items) != 6 {
+		t.Fatalf("hrandfield repeat %v", reply)
+	}
+	execLocal(h, session, CmdSAdd, "s", "m")
+	if reply := execLocal(h, session, CmdSRandMember, "s", huge); reply.Type != ReplyError {
+		t.Fatalf("srandmember huge count %v", reply)
+	}
+	if reply := execLocal(h, session, CmdSRandMember, "s", "-3"); len(reply.Items) != 3 {
+		t.Fatalf("srandmember repeat %v", reply)
+	}
+}
+
+// TestDictScan 每次只扫描几个桶，扫描期间扩容与缩容都不会遗漏一直存在的元素
+func TestDictScan(t *testing.T) {
+	dict := NewDict[int]()
+	for i := 0; i < 1000; i++ {
+		dict.Put("k"+strconv.Itoa(i), i)
+	}
+	seen := make(map[string]bool)
+	cursor, calls := uint64(0), 0
+	for {
+		got := 0
+		cursor = dict.Scan(cursor, 10, func(key string, _ int) {
+			seen[key] = true
+			got++
+		})
+		if got > 10*DictBucketSize {
+			t.Fatalf("scan %d items at once", got)
+		}
+		calls++
+		switch calls {
+		case 10: // 扩容
+			for i := 1000; i < 5000; i++ {
+				dict.Put("k"+strconv.Itoa(i), i)
+			}
+		case 30: // 缩容
+			for i := 500; i < 5000; i++ {
+				dict.Del("k" + strconv.Itoa(i))
+			}
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	for i := 0; i < 500; i++ {
+		if !seen["k"+strconv.Itoa(i)] {
+			t.Fatalf("k%d missed after %d calls", i, calls)
+		}
+	}
+	if dict.Len() != 500 || len(dict.Buckets) >= 5000/DictBucketSize {
+		t.Fatalf("len %d buckets %d", dict.Len(), len(dict.Buckets))
+	}
+}
+
+// TestSScan intset 一次返回全部元素，hashtable 编码按桶分多次返回，match 只过滤结果
+func TestSScan(t *testing.T) {
+	h := NewHandler(&Conf{MaxDB: 1, ShardCount: 4, AOFFile: t.TempDir() + "/aof.log", AOFFsync: FsyncNo})
+	defer h.Close()
+	session := NewSession(NewFakeConn())
+	execLocal(h, session, CmdSAdd, "ints", "1", "2", "3")
+	if reply := execLocal(h, session, CmdSScan, "ints", "0", "COUNT", "1"); reply.Items[0].Str != "0" || len(reply.Items[1].Items) != 3 {
+		t.Fatalf("sscan intset %v", reply)
+	}
+	for i := 0; i < 1000; i++ {
+		execLocal(h, session, CmdSAdd, "s", "m"+strconv.Itoa(i))
+	}
+	seen := make(map[string]bool)
+	cursor, calls := "0", 0
+	for ; cursor != "0" || calls == 0; calls++ {
+		reply := execLocal(h, session, CmdSScan, "s", cursor, "MATCH", "m1*", "COUNT", "10")
+		for _, item := range reply.Items[1].Items {
+			if !strings.HasPrefix(item.Str, "m1") {
+				t.Fatalf("sscan match %s", item.Str)
+			}
+			seen[item.Str] = true
+		}
+		cursor = reply.Items[0].Str
+	}
+	if len(seen) != 111 || calls < 10 {
+		t.Fatalf("sscan seen %d calls %d", len(seen), calls)
+	}
+}
+
+// TestMigrateUnlocked migrate 等待目标节点回复期间不持有 key 的锁，其他连接照常访问，期间被修改的 key 保留在本地
+func TestMigrateUnlocked(t *testing.T) {
+	conf := &Conf{Ip: "127.0.0.1", Port: 3188, MaxDB: 1, ShardCount: 4, AOFFsync: FsyncNo}
+	server := startServer(t, conf)
+	defer server.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	HandleErr(err)
+	defer listener.Close()
+	release := make(chan struct{})
+	go func() { // 目标节点收到 restore 之后等待测试放行再确认
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		target := NewSession(conn)
+		if target.DetectProto() != nil {
+			return
+		}
+		for {
+			req, err := target.ReadReq()
+			if err != nil {
+				return
+			}
+			if req.Cmd == CmdRestoreAsking {
+				<-release
+			}
+			_, _ = conn.Write([]byte("+OK\r\n"))
+		}
+	}()
+	a, b := dialRESP(t, conf), dialRESP(t, conf)
+	defer a.conn.Close()
+	defer b.conn.Close()
+	a.do(CmdSet, "k1", "v")
+	a.do(CmdSet, "k2", "v")
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	a.send(CmdMigrate, host, port, "", "0", "5000", "KEYS", "k1", "k2")
+	time.Sleep(50 * time.Millisecond) // 等待 migrate 发出 restore
+	if got := b.do(CmdGet, "k1"); got != "v" {
+		t.Fatalf("get during migrate %q", got)
+	}
+	if got := b.do(CmdSet, "k2", "new"); got != "+OK" {
+		t.Fatalf("set during migrate %q", got)
+	}
+	close(release)
+	if got := a.read(); got != "-ERR Keys Changed During Migrate k2" {
+		t.Fatalf("migrate %q", got)
+	}
+	if got := b.do(CmdGet, "k1"); got != "$-1" {
+		t.Fatalf("migrated key %q", got)
+	}
+	if got := b.do(CmdGet, "k2"); got != "new" {
+		t.Fatalf("changed key %q", got)
+	}
+}
+
+// TestReplicaExpire 从节点到期的 key 只在读取时隐藏，时间轮与加锁时都不删除，等待主节点的 del，成为主节点后再主动删除
+func TestReplicaExpire(t *testing.T) {
+	server := startServer(t, &Conf{Ip: "127.0.0.1", Port: 3187, MaxDB: 1, ShardCount: 4, AOFFsync: FsyncNo}) // 需要运行时间轮
+	defer server.Close()
+	h := server.Handler
+	master := NewSession(NewFakeConn())
+	master.Master = true
+	h.Repl.Lock.Lock()
+	h.Repl.MasterHost = "127.0.0.1" // 只标记为从节点，不连接主节点
+	h.Repl.Lock.Unlock()
+	for _, key := range []string{"a", "b"} {
+		execLocal(h, master, CmdRestore, key, "50", DumpEntry(key, &Entry{Type: TypeStr, Str: "v"}))
+	}
+	time.Sleep(300 * time.Millisecond)
+	stored := func(key string) bool { // 时间轮在其他协程中删除，需要加锁读取
+		unlock := h.DBs[0].DataMap.Lock(nil, []string{key})
+		defer unlock()
+		return h.DBs[0].DataMap.Get(key) != nil
+	}
+	session := NewSession(NewFakeConn())
+	if reply := execLocal(h, session, CmdGet, "a"); reply.Type != ReplyNil {
+		t.Fatalf("expired key visible %v", reply)
+	}
+	if !stored("a") || !stored("b") {
+		t.Fatal("replica deleted expired key")
+	}
+	execLocal(h, master, CmdDel, "a")
+	if stored("a") {
+		t.Fatal("del from master")
+	}
+	h.ReplicaOf("", 0)
+	time.Sleep(ReplExpireDelay + 300*time.Millisecond)
+	if stored("b") {
+		t.Fatal("expired key kept after promotion")
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
-import "time"
+import (
+	"sync"
+	"time"
+)
 
 type TaskNode struct {
 	Task   func(key string)
@@ -14,34 +17,42 @@ type TimeWheel struct {
 	TaskMap  map[string]int // key->SlotIdx
 	Interval time.Duration
 	Index    int
+	Lock     sync.Mutex // 添加与取消任务来自各个连接协程
 }
 
 func NewTimeWheel(size int, interval time.Duration) *TimeWheel {
 	return &TimeWheel{Slots: make([]*TaskNode, size), TaskMap: make(map[string]int), Interval: interval}
 }
 
+// AddTask 相同 key 的任务会覆盖之前的
 func (t *TimeWheel) AddTask(key string, task func(key string), delay time.Duration) {
-	count := int((delay + t.Interval - 1) / t.Interval)
+	t.Lock.Lock()
+	defer t.Lock.Unlock()
+	// 存在历史的清除掉
+	if oldIdx, ok := t.TaskMap[key]; ok {
+		t.Slots[oldIdx] = t.delNode(t.Slots[oldIdx], key)
+	}
+	// 下一次 tick 扫描的是 Index 所在的槽，所以需要执行 count 次 tick 的任务放在 Index+count-1
+	count := max(int((delay+t.Interval-1)/t.Interval)-1, 0)
 	node := &TaskNode{
 		Task:   task,
 		Key:    key,
 		Circle: count / len(t.Slots),
 	}
-	idx := count % len(t.Slots)
+	idx := (t.Index + count) % len(t.Slots)
 	t.Slots[idx] = t.addNode(t.Slots[idx], node)
-	// 存在历史的清除掉
-	if oldIdx, ok := t.TaskMap[key]; ok {
-		t.Slots[oldIdx] = t.delNode(t.Slots[oldIdx], key)
-	}
 	t.TaskMap[key] = idx
 }
 
 func (t *TimeWheel) CancelTask(key string) {
+	t.Lock.Lock()
+	defer t.Lock.Unlock()
 	idx, ok := t.TaskMap[key]
 	if !ok {
 		return
 	}
 	t.Slots[idx] = t.delNode(t.Slots[idx], key)
+	delete(t.TaskMap, key)
 }
 
 func (t *TimeWheel) Start() {
@@ -61,6 +72,9 @@ func (t *TimeWheel) addNode(root *TaskNode, node *TaskNode) *TaskNode {
 }
 
 func (t *TimeWheel) delNode(root *TaskNode, key string) *TaskNode {
+	if root == nil {
+		return nil
+	}
 	if root.Key == key {
 		return root.Next
 	}
@@ -80,26 +94,36 @@ func (t *TimeWheel) loop() {
 	for {
 		select { // 推荐添加，删除，等操作都通过通道在这里完成 并发也不用加锁了
 		case <-timeChan:
-			t.Slots[t.Index] = t.scanSlot(t.Slots[t.Index])
+			t.Lock.Lock()
+			var tasks []*TaskNode
+			t.Slots[t.Index], tasks = t.scanSlot(t.Slots[t.Index])
 			t.Index = (t.Index + 1) % len(t.Slots)
+			t.Lock.Unlock()
+			// 任务可能需要获取其他锁，放在时间轮的锁外执行
+			for _, task := range tasks {
+				task.Task(task.Key)
+			}
 		}
 	}
 }
 
-func (t *TimeWheel) scanSlot(node *TaskNode) *TaskNode {
+// scanSlot 返回剩余的节点与到期需要执行的任务
+func (t *TimeWheel) scanSlot(node *TaskNode) (*TaskNode, []*TaskNode) {
 	res := &TaskNode{}
 	temp := res
+	tasks := make([]*TaskNode, 0)
 	for node != nil {
+		next := node.Next
 		if node.Circle > 0 {
 			node.Circle--
 			temp.Next = node
 			temp = temp.Next
-			node = node.Next
 			temp.Next = nil
 		} else {
-			node.Task(node.Key)
-			node = node.Next
+			delete(t.TaskMap, node.Key)
+			tasks = append(tasks, node)
 		}
+		node = next
 	}
-	return res.Next
+	return res.Next, tasks
 }
@@ -3,10 +3,19 @@ package main
 import (
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"iter"
 	"math/rand"
+	"net"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -16,32 +25,49 @@ func HandleErr(err error) {
 	}
 }
 
+var (
+	// ErrProtocol 客户端发送了无法解析的数据，需要回复错误并断开连接
+	ErrProtocol = errors.New("Protocol error")
+)
+
 // target 必须是指针
-func ReadObj(reader io.Reader, target any) {
-	// 先获取数量
+func ReadObj(reader io.Reader, target any) error {
+	// 先获取数量 必须读满，否则短读会导致后续数据错位
 	bs := make([]byte, 4)
-	_, err := reader.Read(bs)
-	HandleErr(err)
+	if _, err := io.ReadFull(reader, bs); err != nil {
+		return err
+	}
 	count := binary.LittleEndian.Uint32(bs)
+	if count > MaxReqSize {
+		return fmt.Errorf("%w: invalid frame length %d", ErrProtocol, count)
+	}
 	// 再解析对象
 	bs = make([]byte, count)
-	_, err = reader.Read(bs)
-	HandleErr(err)
-	err = json.Unmarshal(bs, target)
-	HandleErr(err)
+	if _, err := io.ReadFull(reader, bs); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(bs, target); err != nil {
+		return fmt.Errorf("%w: %v", ErrProtocol, err)
+	}
+	return nil
 }
 
-func WriteObj(writer io.Writer, target any) {
+func WriteObj(writer io.Writer, target any) error {
 	bs, err := json.Marshal(target)
-	HandleErr(err)
-	// 先写入数量
-	temp := make([]byte, 4)
+	if err != nil {
+		return err
+	}
+	// 长度与数据一次写入，避免并发写时被其他数据插入
+	temp := make([]byte, 4, 4+len(bs))
 	binary.LittleEndian.PutUint32(temp, uint32(len(bs)))
-	_, err = writer.Write(temp)
-	HandleErr(err)
-	// 再写入数据
-	_, err = writer.Write(bs)
-	HandleErr(err)
+	_, err = writer.Write(append(temp, bs...))
+	return err
+}
+
+// IsClosedErr 对端关闭或连接已被关闭，属于正常断开
+func IsClosedErr(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
 }
 
 func ToStr(obj any) string {
@@ -61,6 +87,179 @@ func FileExist(fileName string) bool {
 	panic(err)
 }
 
+// WriteFileAtomic 先写入临时文件并刷盘再重命名，中途崩溃不会破坏原来的文件
+func WriteFileAtomic(fileName string, bs []byte) error {
+	tempName := fmt.Sprintf("%s.tmp-%d", fileName, os.Getpid())
+	file, err := os.OpenFile(tempName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(bs); err == nil {
+		err = file.Sync()
+	}
+	if err1 := file.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(tempName, fileName)
+	}
+	if err != nil {
+		_ = os.Remove(tempName)
+		return err
+	}
+	return SyncDir(filepath.Dir(fileName))
+}
+
+// SyncDir 重命名后目录也需要刷盘才能保证断电后生效
+func SyncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
 func GenID() string {
 	return fmt.Sprintf("%d-%03d", time.Now().Unix(), rand.Intn(1000))
 }
+
+// GenRunID 40 位随机十六进制串，用于标识 aof 文件等
+func GenRunID() string {
+	return fmt.Sprintf("%016x%016x%08x", rand.Uint64(), rand.Uint64(), rand.Uint32())
+}
+
+func HashStr(str string) uint64 {
+	hash := fnv.New64()
+	_, _ = hash.Write([]byte(str))
+	return hash.Sum64()
+}
+
+// MatchGlob 与 redis 一致的 glob 匹配 支持 * ? [abc] [^a] [a-z] 与 \ 转义
+func MatchGlob(pattern string, str string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' { // 连续的 * 等价于一个
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(str); i++ {
+				if MatchGlob(pattern[1:], str[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(str) == 0 {
+				return false
+			}
+			str = str[1:]
+			pattern = pattern[1:]
+		case '[':
+			if len(str) == 0 {
+				return false
+			}
+			var ok bool
+			ok, pattern = matchClass(pattern[1:], str[0])
+			if !ok {
+				return false
+			}
+			str = str[1:]
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			if len(str) == 0 || pattern[0] != str[0] {
+				return false
+			}
+			str = str[1:]
+			pattern = pattern[1:]
+		}
+	}
+	return len(str) == 0
+}
+
+// matchClass 匹配 [] 中的字符集合，返回剩余的模式
+func matchClass(pattern string, char byte) (bool, string) {
+	not := len(pattern) > 0 && pattern[0] == '^'
+	if not {
+		pattern = pattern[1:]
+	}
+	match := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		if pattern[0] == '\\' && len(pattern) > 1 {
+			match = match || pattern[1] == char
+			pattern = pattern[2:]
+		} else if len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']' {
+			start, end := pattern[0], pattern[2]
+			if start > end {
+				start, end = end, start
+			}
+			match = match || (char >= start && char <= end)
+			pattern = pattern[3:]
+		} else {
+			match = match || pattern[0] == char
+			pattern = pattern[1:]
+		}
+	}
+	if len(pattern) > 0 { // 跳过 ]
+		pattern = pattern[1:]
+	}
+	return match != not, pattern
+}
+
+// RandKeys 随机选取 count 个 key，count 为负数时允许重复
+func RandKeys(seq iter.Seq[string], count int64) []string {
+	return RandItems(slices.Collect(seq), count)
+}
+
+// RandItems 与 RandKeys 规则一致，会打乱 keys 的顺序
+func RandItems(keys []string, count int64) []string {
+	res := make([]string, 0)
+	if len(keys) == 0 || count == 0 {
+		return res
+	}
+	if count < 0 {
+		for i := int64(0); i < -count; i++ {
+			res = append(res, keys[rand.Intn(len(keys))])
+		}
+		return res
+	}
+	rand.Shuffle(len(keys), func(i, j int) {
+		keys[i], keys[j] = keys[j], keys[i]
+	})
+	return keys[:min(int64(len(keys)), count)]
+}
+
+// ParseScanArgs 解析 cursor [match pattern] [count num]
+func ParseScanArgs(args []string) (uint64, string, int, bool) {
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return 0, "", 0, false
+	}
+	pattern, count := "", 10
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return 0, "", 0, false
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			num, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || num < 1 {
+				return 0, "", 0, false
+			}
+			count = int(num)
+		default:
+			return 0, "", 0, false
+		}
+	}
+	if pattern == "*" {
+		pattern = ""
+	}
+	return cursor, pattern, count, true
+}
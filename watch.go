@@ -0,0 +1,71 @@
+package main
+
+// WatchedKey watch 的 key 与执行 watch 时所在的数据库绑定，之后切换数据库不影响
+type WatchedKey struct {
+	DB  *DB
+	Key string
+}
+
+// Watch 注册到数据库的 watch 表中，key 不存在也会注册，之后被创建同样视为修改
+func (d *DB) Watch(session *Session, key string) {
+	watched := WatchedKey{DB: d, Key: key}
+	if session.WatchKey[watched] {
+		return
+	}
+	session.WatchKey[watched] = true
+	d.WatchLock.Lock()
+	defer d.WatchLock.Unlock()
+	sessions := d.Watched[key]
+	if sessions == nil {
+		sessions = make(map[*Session]bool)
+		d.Watched[key] = sessions
+	}
+	sessions[session] = true
+	d.WatchCount.Add(1)
+}
+
+func (d *DB) unwatch(session *Session, key string) {
+	d.WatchLock.Lock()
+	defer d.WatchLock.Unlock()
+	sessions := d.Watched[key]
+	if !sessions[session] {
+		return
+	}
+	delete(sessions, session)
+	if len(sessions) == 0 {
+		delete(d.Watched, key)
+	}
+	d.WatchCount.Add(-1)
+}
+
+// Touch key 被修改、删除或过期后调用，watch 它的会话的事务都会失效
+func (d *DB) Touch(key string) {
+	if d.WatchCount.Load() == 0 { // 没有任何 watch 时不需要加锁
+		return
+	}
+	d.WatchLock.Lock()
+	defer d.WatchLock.Unlock()
+	for session := range d.Watched[key] {
+		session.WatchDirty.Store(true)
+	}
+}
+
+// TouchAll 清空数据库时所有被 watch 的 key 都视为修改
+func (d *DB) TouchAll() {
+	d.WatchLock.Lock()
+	defer d.WatchLock.Unlock()
+	for _, sessions := range d.Watched {
+		for session := range sessions {
+			session.WatchDirty.Store(true)
+		}
+	}
+}
+
+// UnwatchAll exec discard unwatch 以及连接断开时取消全部 watch
+func (s *Session) UnwatchAll() {
+	for watched := range s.WatchKey {
+		watched.DB.unwatch(s, watched.Key)
+	}
+	s.WatchKey = make(map[WatchedKey]bool)
+	s.WatchDirty.Store(false)
+}